@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// auditExtension is the extension of audit files, which hold the request as received on the wire
+const auditExtension = ".http"
+
+// auditPruneInterval is the minimum time between two AUDIT_RETENTION sweeps of the audit directory
+const auditPruneInterval = time.Minute
+
+// lastAuditPrune is the UnixNano time of the last audit directory sweep
+var lastAuditPrune atomic.Int64
+
+// auditWebhook writes the request line, headers and raw body of a webhook to a timestamped file in
+// AUDIT_DIR before it is processed. The request body is restored for the handler. The files can hold
+// tokens, so they are only readable by the owner. Nothing is written in VALIDATE_ONLY mode.
+func auditWebhook(r *http.Request, config Config, source string) {
+	if config.AuditDir == "" || config.ValidateOnly {
+		return
+	}
+	logger := requestLogger(r.Context())
+	dump, err := httputil.DumpRequest(r, true)
+	if err != nil {
+		logger.Printf("Error reading webhook for audit: %v", err)
+		return
+	}
+
+	id := requestID(r.Context())
+	if id == "" {
+		id = newRequestID()
+	}
+	received := now().UTC()
+	filename := received.Format("20060102T150405.000000000Z") + "-" + source + "-" + id + auditExtension
+	if err := os.MkdirAll(config.AuditDir, 0700); err != nil {
+		logger.Printf("Error creating audit directory: %v", err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(config.AuditDir, filename), dump, 0600); err != nil {
+		logger.Printf("Error writing audit file: %v", err)
+		return
+	}
+
+	if config.AuditRetention > 0 {
+		last := lastAuditPrune.Load()
+		if received.Sub(time.Unix(0, last)) >= auditPruneInterval && lastAuditPrune.CompareAndSwap(last, received.UnixNano()) {
+			go pruneAudit(config.AuditDir, config.AuditRetention)
+		}
+	}
+}
+
+// pruneAudit removes the audit files that are older than retention
+func pruneAudit(dir string, retention time.Duration) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Error listing audit directory: %v", err)
+		return
+	}
+	cutoff := now().Add(-retention)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), auditExtension) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			log.Printf("Error removing audit file: %v", err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditWebhookIgnoredEvent(t *testing.T) {
+	config := Config{OutputDir: t.TempDir(), AuditDir: filepath.Join(t.TempDir(), "audit")}
+	setNow(t, time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC))
+
+	// A media.play event is ignored, but still audited
+	req := newPlexRequest(t, "/plex", PlexWebhookPayload{
+		Event:    "media.play",
+		Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+	})
+	req.Header.Set("X-Plex-Product", "Plex Web")
+	handlePlexWebhook(httptest.NewRecorder(), req, config)
+
+	files, err := os.ReadDir(config.OutputDir)
+	if err != nil {
+		t.Fatalf("Error reading output dir: %v", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("Expected no watched files for an ignored event, found %d", len(files))
+	}
+
+	entries, err := os.ReadDir(config.AuditDir)
+	if err != nil {
+		t.Fatalf("Error reading audit dir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("audit files = %d, expected 1", len(entries))
+	}
+	name := entries[0].Name()
+	if !strings.HasPrefix(name, "20240301T123000.000000000Z-plex-") || !strings.HasSuffix(name, ".http") {
+		t.Errorf("audit file name = %q, expected a timestamped plex .http file", name)
+	}
+	content, err := os.ReadFile(filepath.Join(config.AuditDir, name))
+	if err != nil {
+		t.Fatalf("Error reading audit file: %v", err)
+	}
+	for _, expected := range []string{
+		"POST /plex HTTP/1.1",
+		"Content-Type: multipart/form-data; boundary=X",
+		"X-Plex-Product: Plex Web",
+		`"event":"media.play"`,
+		`"key":"/library/metadata/12345"`,
+	} {
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("audit file does not contain %q:\n%s", expected, content)
+		}
+	}
+}
+
+func TestAuditWebhookJellyfinBodyRestored(t *testing.T) {
+	config := Config{OutputDir: t.TempDir(), AuditDir: t.TempDir()}
+	const body = `{
+		"NotificationType": "PlaybackStop",
+		"ItemType": "Movie",
+		"Name": "Audited Movie",
+		"MediaStatus": {"PlayedToCompletion": true}
+	}`
+	handleJellyfinWebhook(httptest.NewRecorder(), newJellyfinRequest("/jellyfin", body), config)
+
+	// The handler still sees the body after it was audited
+	if _, err := os.Stat(filepath.Join(config.OutputDir, "Audited Movie.json")); err != nil {
+		t.Errorf("Expected the movie to be written: %v", err)
+	}
+	entries, err := os.ReadDir(config.AuditDir)
+	if err != nil {
+		t.Fatalf("Error reading audit dir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("audit files = %d, expected 1", len(entries))
+	}
+	content, err := os.ReadFile(filepath.Join(config.AuditDir, entries[0].Name()))
+	if err != nil {
+		t.Fatalf("Error reading audit file: %v", err)
+	}
+	if !strings.HasSuffix(string(content), body) {
+		t.Errorf("audit file does not end with the raw body:\n%s", content)
+	}
+}
+
+func TestPruneAudit(t *testing.T) {
+	dir := t.TempDir()
+	current := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	setNow(t, current)
+
+	files := []struct {
+		name     string
+		age      time.Duration
+		expected bool
+	}{
+		{name: "old.http", age: 48 * time.Hour, expected: false},
+		{name: "recent.http", age: time.Hour, expected: true},
+		{name: "other.txt", age: 48 * time.Hour, expected: true},
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		if err := os.WriteFile(path, []byte("x"), 0600); err != nil {
+			t.Fatalf("Error writing %s: %v", file.name, err)
+		}
+		modified := current.Add(-file.age)
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatalf("Error setting time of %s: %v", file.name, err)
+		}
+	}
+
+	pruneAudit(dir, 24*time.Hour)
+
+	for _, file := range files {
+		_, err := os.Stat(filepath.Join(dir, file.name))
+		if exists := err == nil; exists != file.expected {
+			t.Errorf("%s exists = %v, expected %v", file.name, exists, file.expected)
+		}
+	}
+}
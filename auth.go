@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseAllowedIPs parses a comma-separated list of CIDRs. Bare IP addresses are accepted and
+// treated as a single-host network.
+func parseAllowedIPs(value string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: entry}
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// clientIP returns the IP address of the client, honoring X-Forwarded-For when trusted. Only the
+// rightmost entry, appended by the reverse proxy in front of us, is used; the entries left of it
+// come from the client and can be forged.
+func clientIP(r *http.Request, trustForwardedFor bool) net.IP {
+	if trustForwardedFor {
+		if forwarded := strings.Join(r.Header.Values("X-Forwarded-For"), ","); forwarded != "" {
+			last := forwarded[strings.LastIndex(forwarded, ",")+1:]
+			if ip := net.ParseIP(strings.TrimSpace(last)); ip != nil {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// allowWebhookSource checks the client address against the configured allowlist. When no
+// allowlist is configured every request is allowed. If the request is rejected a 403 response
+// has already been written.
+func allowWebhookSource(w http.ResponseWriter, r *http.Request, config Config) bool {
+	if len(config.AllowedIPs) == 0 {
+		return true
+	}
+
+	ip := clientIP(r, config.TrustForwardedFor)
+	if ip != nil {
+		for _, ipNet := range config.AllowedIPs {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	log.Printf("Rejected webhook from disallowed address %s", ip)
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
+
+// authorizeWebhook checks the request's Basic auth credentials against the configured webhook
+// credentials. When no credentials are configured every request is allowed. If the request is
+// rejected a 401 response has already been written.
+func authorizeWebhook(w http.ResponseWriter, r *http.Request, config Config) bool {
+	if config.WebhookBasicUser == "" || config.WebhookBasicPass == "" {
+		return true
+	}
+
+	user, pass, ok := r.BasicAuth()
+	userMatch := subtle.ConstantTimeCompare([]byte(user), []byte(config.WebhookBasicUser)) == 1
+	passMatch := subtle.ConstantTimeCompare([]byte(pass), []byte(config.WebhookBasicPass)) == 1
+	if ok && userMatch && passMatch {
+		return true
+	}
+
+	log.Printf("Rejected webhook from %s: invalid or missing credentials", r.RemoteAddr)
+	w.Header().Set("WWW-Authenticate", `Basic realm="plex-clean"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
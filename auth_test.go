@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhookBasicAuth(t *testing.T) {
+	config := Config{
+		OutputDir:        t.TempDir(),
+		WebhookBasicUser: "plex",
+		WebhookBasicPass: "secret",
+	}
+
+	testCases := []struct {
+		name           string
+		user           string
+		pass           string
+		setAuth        bool
+		expectedStatus int
+	}{
+		{name: "Correct credentials", user: "plex", pass: "secret", setAuth: true, expectedStatus: http.StatusOK},
+		{name: "Wrong password", user: "plex", pass: "wrong", setAuth: true, expectedStatus: http.StatusUnauthorized},
+		{name: "Wrong user", user: "other", pass: "secret", setAuth: true, expectedStatus: http.StatusUnauthorized},
+		{name: "Missing credentials", setAuth: false, expectedStatus: http.StatusUnauthorized},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			handlers := map[string]func(http.ResponseWriter, *http.Request, Config){
+				"plex":     handlePlexWebhook,
+				"jellyfin": handleJellyfinWebhook,
+			}
+			for source, handler := range handlers {
+				var req *http.Request
+				if source == "plex" {
+					req = newPlexRequest(t, "/plex", PlexWebhookPayload{Event: "media.play"})
+				} else {
+					req = newJellyfinRequest("/jellyfin", `{"NotificationType": "PlaybackStart"}`)
+				}
+				if tc.setAuth {
+					req.SetBasicAuth(tc.user, tc.pass)
+				}
+
+				rr := httptest.NewRecorder()
+				handler(rr, req, config)
+
+				if rr.Code != tc.expectedStatus {
+					t.Errorf("%s handler returned wrong status code: got %v want %v", source, rr.Code, tc.expectedStatus)
+				}
+			}
+		})
+	}
+
+	// Without configured credentials no auth is enforced
+	rr := httptest.NewRecorder()
+	handleJellyfinWebhook(rr, newJellyfinRequest("/jellyfin", `{"NotificationType": "PlaybackStart"}`), Config{})
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code without auth configured: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestWebhookAllowedIPs(t *testing.T) {
+	allowedIPs, err := parseAllowedIPs("10.0.0.0/8, 192.168.1.5")
+	if err != nil {
+		t.Fatalf("parseAllowedIPs returned error: %v", err)
+	}
+	if _, err := parseAllowedIPs("not-a-cidr"); err == nil {
+		t.Errorf("parseAllowedIPs did not return an error for an invalid entry")
+	}
+
+	testCases := []struct {
+		name              string
+		remoteAddr        string
+		forwardedFor      string
+		trustForwardedFor bool
+		expectedStatus    int
+	}{
+		{name: "Allowed CIDR", remoteAddr: "10.1.2.3:5000", expectedStatus: http.StatusOK},
+		{name: "Allowed single IP", remoteAddr: "192.168.1.5:5000", expectedStatus: http.StatusOK},
+		{name: "Blocked IP", remoteAddr: "172.16.0.1:5000", expectedStatus: http.StatusForbidden},
+		{name: "Forwarded ignored when untrusted", remoteAddr: "172.16.0.1:5000", forwardedFor: "10.1.2.3", expectedStatus: http.StatusForbidden},
+		{name: "Forwarded honored when trusted", remoteAddr: "172.16.0.1:5000", forwardedFor: "172.16.0.9, 10.1.2.3", trustForwardedFor: true, expectedStatus: http.StatusOK},
+		{name: "Forged leftmost entry ignored", remoteAddr: "172.16.0.1:5000", forwardedFor: "10.1.2.3, 172.16.0.9", trustForwardedFor: true, expectedStatus: http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{
+				OutputDir:         t.TempDir(),
+				AllowedIPs:        allowedIPs,
+				TrustForwardedFor: tc.trustForwardedFor,
+			}
+			req := newJellyfinRequest("/jellyfin", `{"NotificationType": "PlaybackStart"}`)
+			req.RemoteAddr = tc.remoteAddr
+			if tc.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+			}
+
+			rr := httptest.NewRecorder()
+			handleJellyfinWebhook(rr, req, config)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tc.expectedStatus)
+			}
+		})
+	}
+}
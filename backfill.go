@@ -0,0 +1,21 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+)
+
+// backfill records the completions already in Tautulli's history, so a first deployment starts out
+// with the items watched before it. It returns the number of rows that were written.
+func backfill(ctx context.Context, config Config) (int, error) {
+	params := url.Values{}
+	params.Set("cmd", "get_history")
+	params.Set("order_column", "started")
+	params.Set("order", "desc")
+	params.Set("length", strconv.Itoa(config.BackfillLength))
+	if config.BackfillDays > 0 {
+		params.Set("after", now().AddDate(0, 0, -config.BackfillDays).Format("2006-01-02"))
+	}
+	return recordHistory(ctx, config, params, "Backfill")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackfill(t *testing.T) {
+	previous := dedup
+	cache, err := newDedupCache(time.Hour, "")
+	if err != nil {
+		t.Fatalf("newDedupCache() error = %v", err)
+	}
+	dedup = cache
+	t.Cleanup(func() {
+		dedup = previous
+	})
+	setNow(t, time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC))
+
+	var query url.Values
+	tautulliServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		response := TautulliResponse{}
+		response.Response.Data.Data = []MediaData{
+			{FullTitle: "First Show", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("1"), WatchedStatus: 1.0},
+			{FullTitle: "First Show", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("2"), WatchedStatus: 1.0},
+			{FullTitle: "Second Show", ParentMediaIndex: json.Number("2"), MediaIndex: json.Number("5"), WatchedStatus: 1.0},
+			{FullTitle: "Abandoned Show", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("1"), WatchedStatus: 0.5},
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			t.Errorf("Error encoding response: %v", err)
+		}
+	}))
+	defer tautulliServer.Close()
+
+	config := Config{
+		APIHost:        strings.TrimPrefix(tautulliServer.URL, "http://"),
+		APIKey:         "test-key",
+		OutputDir:      t.TempDir(),
+		BackfillLength: 50,
+		BackfillDays:   7,
+	}
+
+	// An item already recorded by a webhook is not written again
+	dedup.Mark(plexDedupKey(MediaData{FullTitle: "Second Show", ParentMediaIndex: json.Number("2"), MediaIndex: json.Number("5")}))
+
+	processed, err := backfill(t.Context(), config)
+	if err != nil {
+		t.Fatalf("backfill() error = %v", err)
+	}
+	if processed != 2 {
+		t.Errorf("processed = %d, expected 2", processed)
+	}
+	if got := query.Get("length"); got != "50" {
+		t.Errorf("length = %q, expected %q", got, "50")
+	}
+	if got := query.Get("after"); got != "2024-03-03" {
+		t.Errorf("after = %q, expected %q", got, "2024-03-03")
+	}
+
+	for _, name := range []string{"First Show - S1E1.json", "First Show - S1E2.json"} {
+		if _, err := os.Stat(filepath.Join(config.OutputDir, name)); err != nil {
+			t.Errorf("expected %s to be written: %v", name, err)
+		}
+	}
+	for _, name := range []string{"Second Show - S2E5.json", "Abandoned Show - S1E1.json"} {
+		if _, err := os.Stat(filepath.Join(config.OutputDir, name)); err == nil {
+			t.Errorf("expected %s not to be written", name)
+		}
+	}
+
+	// Without BACKFILL_DAYS the history is not limited by date
+	config.BackfillDays = 0
+	if _, err := backfill(t.Context(), config); err != nil {
+		t.Fatalf("backfill() error = %v", err)
+	}
+	if query.Has("after") {
+		t.Errorf("after = %q, expected no date limit", query.Get("after"))
+	}
+}
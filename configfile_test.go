@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	testCases := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{
+			name: "JSON",
+			file: "config.json",
+			content: `{
+				"PORT": 8080,
+				"API_HOST": "tautulli:8181",
+				"API_KEY": "file-key",
+				"DEBUG": true,
+				"TAUTULLI_TIMEOUT": "30s",
+				"PLEX_EVENTS": ["media.stop", "media.rate"]
+			}`,
+		},
+		{
+			name: "YAML",
+			file: "config.yaml",
+			content: `# plex-clean settings
+PORT: 8080
+API_HOST: tautulli:8181
+API_KEY: "file-key"
+DEBUG: true # verbose logging
+TAUTULLI_TIMEOUT: '30s'
+PLEX_EVENTS: media.stop,media.rate
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tc.file)
+			if err := os.WriteFile(path, []byte(tc.content), 0644); err != nil {
+				t.Fatalf("Error writing config file: %v", err)
+			}
+			t.Setenv("CONFIG_FILE", path)
+			// Environment variables override values from the file
+			t.Setenv("API_KEY", "env-key")
+			t.Cleanup(func() {
+				fileConfig = nil
+			})
+
+			config := loadConfig()
+
+			if config.Port != 8080 {
+				t.Errorf("Port = %d, expected 8080", config.Port)
+			}
+			if config.APIHost != "tautulli:8181" {
+				t.Errorf("APIHost = %q, expected tautulli:8181", config.APIHost)
+			}
+			if config.APIKey != "env-key" {
+				t.Errorf("APIKey = %q, expected the environment override env-key", config.APIKey)
+			}
+			if !config.Debug {
+				t.Errorf("Debug = false, expected true")
+			}
+			if config.TautulliTimeout != 30*time.Second {
+				t.Errorf("TautulliTimeout = %s, expected 30s", config.TautulliTimeout)
+			}
+			if !slices.Equal(config.PlexEvents, []string{PlexEventStop, PlexEventRate}) {
+				t.Errorf("PlexEvents = %v, expected [media.stop media.rate]", config.PlexEvents)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("PORT 8080\n"), 0644); err != nil {
+		t.Fatalf("Error writing config file: %v", err)
+	}
+	if _, err := loadConfigFile(path); err == nil {
+		t.Errorf("loadConfigFile() error = nil, expected an error for a line without a colon")
+	}
+}
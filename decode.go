@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// jsonErrorContext is the number of bytes shown on either side of the offset of a decode error
+const jsonErrorContext = 30
+
+// decodeJellyfinPayload decodes a Jellyfin webhook body. In strict mode fields that are not part of
+// JellyfinWebhookPayload are rejected, except for the Provider_* fields collected into ProviderIDs.
+func decodeJellyfinPayload(body []byte, strict bool) (JellyfinWebhookPayload, error) {
+	var payload JellyfinWebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil || !strict {
+		return payload, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return payload, err
+	}
+	for key := range fields {
+		if strings.HasPrefix(key, "Provider_") {
+			delete(fields, key)
+		}
+	}
+	known, err := json.Marshal(fields)
+	if err != nil {
+		return payload, err
+	}
+
+	type plain JellyfinWebhookPayload
+	decoder := json.NewDecoder(bytes.NewReader(known))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(new(plain)); err != nil {
+		return payload, err
+	}
+	return payload, nil
+}
+
+// describeJSONError explains a decode error with the offending field and offset where known, and
+// the part of the body around that offset
+func describeJSONError(body []byte, err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("%v at offset %d near %q", err, syntaxErr.Offset, jsonSnippet(body, syntaxErr.Offset))
+	case errors.As(err, &typeErr):
+		return fmt.Sprintf("field %q expects %s but got JSON %s at offset %d near %q",
+			typeErr.Field, typeErr.Type, typeErr.Value, typeErr.Offset, jsonSnippet(body, typeErr.Offset))
+	default:
+		return err.Error()
+	}
+}
+
+// jsonSnippet returns the part of body surrounding offset
+func jsonSnippet(body []byte, offset int64) string {
+	start := max(0, int(offset)-jsonErrorContext)
+	end := min(len(body), int(offset)+jsonErrorContext)
+	if start > end {
+		return ""
+	}
+	return string(body[start:end])
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJellyfinDecodeErrors(t *testing.T) {
+	testCases := []struct {
+		name           string
+		body           string
+		strict         bool
+		expectedStatus int
+		expectedLog    []string
+	}{
+		{
+			name:           "Type error names the field",
+			body:           `{"NotificationType": "PlaybackStop", "Played": "yes"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedLog:    []string{`field "Played" expects bool but got JSON string`, `near "`},
+		},
+		{
+			name:           "Syntax error shows the offset",
+			body:           `{"NotificationType": "PlaybackStop",, "ItemType": "Episode"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedLog:    []string{"at offset 37", `near "icationType`},
+		},
+		{
+			name:           "Strict mode rejects unknown fields",
+			body:           `{"NotificationType": "PlaybackStop", "SeriesNme": "Typo", "Provider_tvdb": "1"}`,
+			strict:         true,
+			expectedStatus: http.StatusBadRequest,
+			expectedLog:    []string{`unknown field "SeriesNme"`},
+		},
+		{
+			name:           "Unknown fields are accepted by default",
+			body:           `{"NotificationType": "PlaybackStop", "SeriesNme": "Typo"}`,
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := captureLog(t)
+			config := Config{OutputDir: t.TempDir(), Debug: true, StrictJSON: tc.strict}
+
+			rr := httptest.NewRecorder()
+			handleJellyfinWebhook(rr, newJellyfinRequest("/jellyfin", tc.body), config)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("status = %d, expected %d", rr.Code, tc.expectedStatus)
+			}
+			for _, expected := range tc.expectedLog {
+				if !strings.Contains(logs.String(), expected) {
+					t.Errorf("log = %q, expected it to contain %q", logs.String(), expected)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// dedupCache remembers recently written items so that repeats can be suppressed. When a path is
+// set the entries are persisted there so that they survive restarts.
+type dedupCache struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	path string
+	seen map[string]time.Time
+}
+
+// dedup is the shared cache of written items, created in main. A nil cache remembers nothing.
+var dedup *dedupCache
+
+// newDedupCache creates a cache whose entries expire after ttl, loading any state persisted at path
+func newDedupCache(ttl time.Duration, path string) (*dedupCache, error) {
+	c := &dedupCache{ttl: ttl, path: path, seen: make(map[string]time.Time)}
+	if path == "" {
+		return c, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading dedup state: %w", err)
+	}
+	if err := json.Unmarshal(content, &c.seen); err != nil {
+		return nil, fmt.Errorf("error parsing dedup state %s: %w", path, err)
+	}
+	c.prune()
+	return c, nil
+}
+
+// Seen reports whether key was marked within the TTL, pruning expired entries
+func (c *dedupCache) Seen(key string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prune()
+	_, ok := c.seen[key]
+	return ok
+}
+
+// Mark records key as written now and persists the state if a path is configured
+func (c *dedupCache) Mark(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen[key] = now()
+	if err := c.save(); err != nil {
+		log.Printf("Error saving dedup state: %v", err)
+	}
+}
+
+// prune removes expired entries, the caller must hold the lock
+func (c *dedupCache) prune() {
+	cutoff := now().Add(-c.ttl)
+	for key, markedAt := range c.seen {
+		if markedAt.Before(cutoff) {
+			delete(c.seen, key)
+		}
+	}
+}
+
+// save writes the entries to a temporary file and renames it over the state file so that a crash
+// never leaves a partial file behind. The caller must hold the lock.
+func (c *dedupCache) save() error {
+	if c.path == "" {
+		return nil
+	}
+	content, err := json.Marshal(c.seen)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
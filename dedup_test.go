@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupCacheExpires(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	setNow(t, start)
+	cache, err := newDedupCache(time.Minute, "")
+	if err != nil {
+		t.Fatalf("newDedupCache() error = %v", err)
+	}
+	cache.Mark("key")
+
+	if !cache.Seen("key") {
+		t.Errorf("Seen() = false, expected true")
+	}
+	setNow(t, start.Add(2*time.Minute))
+	if cache.Seen("key") {
+		t.Errorf("Seen() after TTL = true, expected false")
+	}
+}
+
+func TestDedupCachePersists(t *testing.T) {
+	setNow(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	stateFile := filepath.Join(t.TempDir(), "state", "dedup.json")
+
+	cache, err := newDedupCache(time.Hour, stateFile)
+	if err != nil {
+		t.Fatalf("newDedupCache() error = %v", err)
+	}
+	cache.Mark("expired")
+	setNow(t, time.Date(2024, 1, 1, 13, 30, 0, 0, time.UTC))
+	row := MediaData{
+		FullTitle:        "Binge Show",
+		ParentMediaIndex: json.Number("1"),
+		MediaIndex:       json.Number("7"),
+		WatchedStatus:    1.0,
+	}
+	cache.Mark(plexDedupKey(row))
+
+	// Simulate a restart by loading the state into a fresh cache
+	reloaded, err := newDedupCache(time.Hour, stateFile)
+	if err != nil {
+		t.Fatalf("newDedupCache() after restart error = %v", err)
+	}
+	if reloaded.Seen("expired") {
+		t.Errorf("Seen(expired) = true, expected entries older than the TTL to be pruned")
+	}
+
+	previous := dedup
+	dedup = reloaded
+	t.Cleanup(func() {
+		dedup = previous
+	})
+
+	tautulliServer := newTautulliServer(t, []MediaData{row})
+	config := Config{
+		APIHost:       strings.TrimPrefix(tautulliServer.URL, "http://"),
+		APIKey:        "test-key",
+		OutputDir:     t.TempDir(),
+		DedupWebhooks: true,
+	}
+	rr := httptest.NewRecorder()
+	handlePlexWebhook(rr, newPlexRequest(t, "/plex", PlexWebhookPayload{
+		Event:    PlexEventStop,
+		Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+	}), config)
+
+	if _, err := os.Stat(filepath.Join(config.OutputDir, "Binge Show - S1E7.json")); !os.IsNotExist(err) {
+		t.Errorf("expected the repeat event to be suppressed after a restart")
+	}
+
+	// Without DEDUP_WEBHOOKS a rewatch reported by the webhook is still written
+	config.DedupWebhooks = false
+	rr = httptest.NewRecorder()
+	handlePlexWebhook(rr, newPlexRequest(t, "/plex", PlexWebhookPayload{
+		Event:    PlexEventStop,
+		Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+	}), config)
+
+	if _, err := os.Stat(filepath.Join(config.OutputDir, "Binge Show - S1E7.json")); err != nil {
+		t.Errorf("expected the rewatch to be written without DEDUP_WEBHOOKS: %v", err)
+	}
+}
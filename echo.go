@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// EchoResponse describes a request received at /echo
+type EchoResponse struct {
+	Method      string              `json:"method"`
+	Path        string              `json:"path"`
+	ContentType string              `json:"content_type"`
+	Headers     map[string][]string `json:"headers"`
+	// Body is the raw request body
+	Body string `json:"body"`
+	// Payload is the JSON payload, taken from the multipart payload field for multipart requests,
+	// or omitted if the payload is not valid JSON
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// handleEcho logs a request and returns its headers and body as JSON without processing it, to
+// debug what Plex and Jellyfin send
+func handleEcho(w http.ResponseWriter, r *http.Request, config Config) {
+	if !allowWebhookSource(w, r, config) {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !authorizeWebhook(w, r, config) {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error reading echo request body: %v", err)
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+
+	response := EchoResponse{
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		ContentType: r.Header.Get("Content-Type"),
+		Headers:     r.Header.Clone(),
+		Body:        string(body),
+	}
+	// Credentials are not echoed back
+	delete(response.Headers, "Authorization")
+
+	payload := body
+	if mediaType, _, _ := mime.ParseMediaType(response.ContentType); strings.HasPrefix(mediaType, "multipart/") {
+		payload = []byte(multipartPayload(body, response.ContentType, config.multipartMaxMemory()))
+	}
+	if json.Valid(payload) {
+		response.Payload = payload
+	}
+
+	log.Printf("Echo %s %s content-type=%q: %s", r.Method, r.URL.Path, response.ContentType, body)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
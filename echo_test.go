@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEchoEndpoint(t *testing.T) {
+	const payload = `{"event": "media.scrobble", "Metadata": {"key": "/library/metadata/12345"}}`
+
+	testCases := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{name: "JSON", contentType: "application/json", body: payload},
+		{name: "Multipart", contentType: "multipart/form-data; boundary=X", body: "--X\r\nContent-Disposition: form-data; name=\"payload\"\r\n\r\n" + payload + "\r\n--X--\r\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			outputDir := t.TempDir()
+			router := newRouter(Config{OutputDir: outputDir, EchoEnabled: true})
+
+			req := httptest.NewRequest("POST", "/echo", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", tc.contentType)
+			req.Header.Set("X-Plex-Product", "Plex Media Server")
+			req.SetBasicAuth("user", "secret")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			var response EchoResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatalf("Error decoding response: %v", err)
+			}
+			if response.Body != tc.body {
+				t.Errorf("body = %q, expected %q", response.Body, tc.body)
+			}
+			if response.ContentType != tc.contentType {
+				t.Errorf("content_type = %q, expected %q", response.ContentType, tc.contentType)
+			}
+			var echoed PlexWebhookPayload
+			if err := json.Unmarshal(response.Payload, &echoed); err != nil || echoed.Event != "media.scrobble" {
+				t.Errorf("payload = %s, expected the parsed Plex payload", response.Payload)
+			}
+			if got := response.Headers["X-Plex-Product"]; len(got) != 1 || got[0] != "Plex Media Server" {
+				t.Errorf("X-Plex-Product = %v, expected it to be echoed", got)
+			}
+			if _, ok := response.Headers["Authorization"]; ok {
+				t.Errorf("Authorization header was echoed")
+			}
+		})
+	}
+
+	// Disabled by default
+	rr := httptest.NewRecorder()
+	newRouter(Config{OutputDir: t.TempDir()}).ServeHTTP(rr, httptest.NewRequest("POST", "/echo", strings.NewReader(payload)))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("status = %d, expected %d when disabled", rr.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// FetchErrorCategory tells apart the ways a Tautulli lookup can fail
+type FetchErrorCategory string
+
+// Categories of FetchError
+const (
+	// FetchErrorNetwork means Tautulli could not be reached or the response could not be read
+	FetchErrorNetwork FetchErrorCategory = "network"
+	// FetchErrorHTTPStatus means Tautulli answered with a status other than 200
+	FetchErrorHTTPStatus FetchErrorCategory = "http-status"
+	// FetchErrorDecode means the response was not the JSON that was expected
+	FetchErrorDecode FetchErrorCategory = "decode"
+	// FetchErrorAPI means Tautulli reported an error itself, e.g. for an invalid API key
+	FetchErrorAPI FetchErrorCategory = "api-error"
+)
+
+// FetchError is returned by fetchMetadata and the other Tautulli lookups
+type FetchError struct {
+	Category FetchErrorCategory
+	// StatusCode is the HTTP status Tautulli answered with, set for FetchErrorHTTPStatus
+	StatusCode int
+	Err        error
+}
+
+func (e *FetchError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// fetchError wraps err into a FetchError of the category
+func fetchError(category FetchErrorCategory, err error) *FetchError {
+	return &FetchError{Category: category, Err: err}
+}
+
+// fetchErrorStatus returns the status a webhook answers with when a Tautulli lookup failed: 502 Bad
+// Gateway when Tautulli is unreachable or failing, 500 for responses that cannot be decoded
+func fetchErrorStatus(err error) int {
+	var fetchErr *FetchError
+	if errors.As(err, &fetchErr) && fetchErr.Category != FetchErrorDecode {
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
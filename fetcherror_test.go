@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchErrorCategories(t *testing.T) {
+	testCases := []struct {
+		name             string
+		handler          http.HandlerFunc
+		closed           bool
+		expectedCategory FetchErrorCategory
+		expectedStatus   int
+	}{
+		{
+			name:             "Unreachable",
+			closed:           true,
+			expectedCategory: FetchErrorNetwork,
+			expectedStatus:   http.StatusBadGateway,
+		},
+		{
+			name: "HTTP status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			},
+			expectedCategory: FetchErrorHTTPStatus,
+			expectedStatus:   http.StatusBadGateway,
+		},
+		{
+			name: "Malformed JSON",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"response": {"result": "success", "data": `)
+			},
+			expectedCategory: FetchErrorDecode,
+			expectedStatus:   http.StatusInternalServerError,
+		},
+		{
+			name: "API error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"response": {"result": "error", "message": "Invalid apikey", "data": {}}}`)
+			},
+			expectedCategory: FetchErrorAPI,
+			expectedStatus:   http.StatusBadGateway,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(tc.handler)
+			if tc.closed {
+				server.Close()
+			} else {
+				defer server.Close()
+			}
+			config := Config{APIHost: strings.TrimPrefix(server.URL, "http://"), APIKey: "test-key"}
+
+			_, err := fetchMetadata(t.Context(), "/library/metadata/12345", config)
+			var fetchErr *FetchError
+			if !errors.As(err, &fetchErr) {
+				t.Fatalf("fetchMetadata() error = %v, expected a *FetchError", err)
+			}
+			if fetchErr.Category != tc.expectedCategory {
+				t.Errorf("category = %q, expected %q", fetchErr.Category, tc.expectedCategory)
+			}
+			if status := fetchErrorStatus(err); status != tc.expectedStatus {
+				t.Errorf("fetchErrorStatus() = %d, expected %d", status, tc.expectedStatus)
+			}
+		})
+	}
+}
+
+func TestFetchErrorHTTPStatusCode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	_, err := fetchMetadata(t.Context(), "/library/metadata/12345", Config{APIHost: strings.TrimPrefix(server.URL, "http://")})
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) || fetchErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("fetchMetadata() error = %#v, expected status code %d", err, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// forwardTimeout bounds a forwarded webhook request
+const forwardTimeout = 10 * time.Second
+
+// forwardHeaderSeparator separates FORWARD_HEADERS entries. Header values may contain commas, so
+// the usual list separator can't be used.
+const forwardHeaderSeparator = ";;"
+
+// parseForwardHeaders parses ";;"-separated "Key:Value" pairs into headers, skipping malformed entries
+func parseForwardHeaders(list string) http.Header {
+	headers := http.Header{}
+	for _, pair := range strings.Split(list, forwardHeaderSeparator) {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			log.Printf("Invalid FORWARD_HEADERS entry: %s, expected Key:Value", pair)
+			continue
+		}
+		headers.Add(key, strings.TrimSpace(value))
+	}
+	return headers
+}
+
+// forwardWebhook sends a copy of an accepted webhook to FORWARD_URL in the background, with the
+// original body and content type and the configured FORWARD_HEADERS. The request body is restored
+// for the handler. Nothing is forwarded in VALIDATE_ONLY mode.
+func forwardWebhook(r *http.Request, config Config) {
+	logger := requestLogger(r.Context())
+
+	if config.ForwardURL == "" || config.ValidateOnly || r.Body == nil {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		logger.Printf("Error reading webhook body for forwarding: %v", err)
+		return
+	}
+	go sendForward(logger, config, body, r.Header.Get("Content-Type"))
+}
+
+// sendForward performs the request of forwardWebhook
+func sendForward(logger *log.Logger, config Config, body []byte, contentType string) {
+	method := config.ForwardMethod
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequest(method, config.ForwardURL, bytes.NewReader(body))
+	if err != nil {
+		logger.Printf("Error creating forward request: %v", err)
+		return
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for key, values := range config.ForwardHeaders {
+		req.Header[key] = values
+	}
+
+	client := &http.Client{Timeout: forwardTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Printf("Error forwarding webhook to %s: %v", config.ForwardURL, err)
+		return
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			logger.Printf("Error closing response body: %v", closeErr)
+		}
+	}()
+	if resp.StatusCode >= 300 {
+		logger.Printf("Forwarding webhook to %s returned %d %s", config.ForwardURL, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// forwardedRequest is what the downstream of a forwarded webhook received
+type forwardedRequest struct {
+	method string
+	header http.Header
+	body   string
+}
+
+func TestForwardHeaders(t *testing.T) {
+	received := make(chan forwardedRequest, 1)
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- forwardedRequest{method: r.Method, header: r.Header, body: string(body)}
+	}))
+	defer downstream.Close()
+
+	config := Config{
+		OutputDir:      t.TempDir(),
+		ForwardURL:     downstream.URL,
+		ForwardMethod:  http.MethodPut,
+		ForwardHeaders: parseForwardHeaders("Authorization: Bearer secret;;Content-Type:application/vnd.webhook+json;;invalid"),
+	}
+	body := `{"NotificationType": "PlaybackStart", "ItemType": "Episode", "SeriesName": "Forwarded Series"}`
+	handleJellyfinWebhook(httptest.NewRecorder(), newJellyfinRequest("/jellyfin", body), config)
+
+	select {
+	case forwarded := <-received:
+		if forwarded.method != http.MethodPut {
+			t.Errorf("method = %s, expected %s", forwarded.method, http.MethodPut)
+		}
+		if got := forwarded.header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("Authorization = %q, expected %q", got, "Bearer secret")
+		}
+		if got := forwarded.header.Get("Content-Type"); got != "application/vnd.webhook+json" {
+			t.Errorf("Content-Type = %q, expected %q", got, "application/vnd.webhook+json")
+		}
+		if forwarded.body != body {
+			t.Errorf("body = %q, expected %q", forwarded.body, body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Webhook was not forwarded")
+	}
+}
+
+func TestParseForwardHeaders(t *testing.T) {
+	headers := parseForwardHeaders("X-Api-Key: abc:def;;NoColon;; ;;:empty;;Accept: text/html, application/json")
+	if got := headers.Get("X-Api-Key"); got != "abc:def" {
+		t.Errorf("X-Api-Key = %q, expected %q", got, "abc:def")
+	}
+	if got := headers.Get("Accept"); got != "text/html, application/json" {
+		t.Errorf("Accept = %q, expected %q", got, "text/html, application/json")
+	}
+	if len(headers) != 2 {
+		t.Errorf("headers = %v, expected only X-Api-Key and Accept", headers)
+	}
+}
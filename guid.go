@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// GUIDList is a list of Plex guids such as "imdb://tt0959621". It decodes both plain strings and
+// the {"id": "..."} objects of Plex's multi-guid form.
+type GUIDList []string
+
+// UnmarshalJSON accepts an array of strings or of objects with an id field, and null
+func (l *GUIDList) UnmarshalJSON(data []byte) error {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+
+	guids := make(GUIDList, 0, len(items))
+	for _, item := range items {
+		var guid string
+		if err := json.Unmarshal(item, &guid); err != nil {
+			var object struct {
+				ID string `json:"id"`
+			}
+			if err := json.Unmarshal(item, &object); err != nil {
+				return err
+			}
+			guid = object.ID
+		}
+		if guid != "" {
+			guids = append(guids, guid)
+		}
+	}
+	*l = guids
+	return nil
+}
+
+// guidProviders maps guid schemes, including the legacy Plex agent names, to provider names
+var guidProviders = map[string]string{
+	"tvdb":       "tvdb",
+	"imdb":       "imdb",
+	"tmdb":       "tmdb",
+	"thetvdb":    "tvdb",
+	"themoviedb": "tmdb",
+}
+
+// parseGUID extracts the provider and external ID from a Plex guid. It understands the current form
+// ("tvdb://121361", "imdb://tt0959621", "tmdb://1399") and the legacy agent form
+// ("com.plexapp.agents.thetvdb://121361/1/2?lang=en"). Plex-internal and unknown guids are rejected.
+func parseGUID(guid string) (provider, id string, ok bool) {
+	scheme, rest, found := strings.Cut(guid, "://")
+	if !found {
+		return "", "", false
+	}
+	provider, ok = guidProviders[strings.TrimPrefix(scheme, "com.plexapp.agents.")]
+	if !ok {
+		return "", "", false
+	}
+
+	id, _, _ = strings.Cut(rest, "?")
+	id, _, _ = strings.Cut(id, "/")
+	if provider == "imdb" {
+		ok = strings.HasPrefix(id, "tt") && isDigits(id[2:])
+	} else {
+		ok = isDigits(id)
+	}
+	return provider, id, ok
+}
+
+// providerIDs collects the external IDs from the given guids, ignoring any it cannot parse
+func providerIDs(guids ...string) map[string]string {
+	var ids map[string]string
+	for _, guid := range guids {
+		provider, id, ok := parseGUID(guid)
+		if !ok {
+			continue
+		}
+		if ids == nil {
+			ids = make(map[string]string)
+		}
+		ids[provider] = id
+	}
+	return ids
+}
+
+// isDigits reports whether s is a non-empty string of ASCII digits
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseGUID(t *testing.T) {
+	testCases := []struct {
+		guid       string
+		provider   string
+		id         string
+		expectedOK bool
+	}{
+		{guid: "tvdb://121361", provider: "tvdb", id: "121361", expectedOK: true},
+		{guid: "imdb://tt0959621", provider: "imdb", id: "tt0959621", expectedOK: true},
+		{guid: "tmdb://1399", provider: "tmdb", id: "1399", expectedOK: true},
+		{guid: "com.plexapp.agents.thetvdb://121361/1/2?lang=en", provider: "tvdb", id: "121361", expectedOK: true},
+		{guid: "com.plexapp.agents.imdb://tt0959621?lang=en", provider: "imdb", id: "tt0959621", expectedOK: true},
+		{guid: "com.plexapp.agents.themoviedb://1399?lang=en", provider: "tmdb", id: "1399", expectedOK: true},
+		{guid: "plex://episode/5d9c086c46115600200aa2fe", expectedOK: false},
+		{guid: "com.plexapp.agents.hama://anidb-123", expectedOK: false},
+		{guid: "imdb://0959621", expectedOK: false},
+		{guid: "local://42", expectedOK: false},
+		{guid: "", expectedOK: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.guid, func(t *testing.T) {
+			provider, id, ok := parseGUID(tc.guid)
+			if ok != tc.expectedOK {
+				t.Fatalf("parseGUID(%q) ok = %v, expected %v", tc.guid, ok, tc.expectedOK)
+			}
+			if ok && (provider != tc.provider || id != tc.id) {
+				t.Errorf("parseGUID(%q) = %s, %s, expected %s, %s", tc.guid, provider, id, tc.provider, tc.id)
+			}
+		})
+	}
+}
+
+func TestPlexProviderIDs(t *testing.T) {
+	testCases := []struct {
+		name     string
+		row      string
+		expected map[string]string
+	}{
+		{
+			name:     "Legacy guid",
+			row:      `"guid": "com.plexapp.agents.thetvdb://121361/1/2?lang=en"`,
+			expected: map[string]string{"tvdb": "121361"},
+		},
+		{
+			name:     "Multi-guid strings",
+			row:      `"guid": "plex://episode/5d9c086c46115600200aa2fe", "guids": ["imdb://tt0959621", "tmdb://62085", "tvdb://349232"]`,
+			expected: map[string]string{"imdb": "tt0959621", "tmdb": "62085", "tvdb": "349232"},
+		},
+		{
+			name:     "Multi-guid objects",
+			row:      `"guids": [{"id": "imdb://tt0959621"}, {"id": "tvdb://349232"}]`,
+			expected: map[string]string{"imdb": "tt0959621", "tvdb": "349232"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var data MediaData
+			if err := json.Unmarshal([]byte(`{"full_title": "Guid Show", `+tc.row+`}`), &data); err != nil {
+				t.Fatalf("Error unmarshaling row: %v", err)
+			}
+			if !maps.Equal(data.ProviderIDs, tc.expected) {
+				t.Errorf("ProviderIDs = %v, expected %v", data.ProviderIDs, tc.expected)
+			}
+		})
+	}
+
+	// The IDs end up in the written file
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{
+			FullTitle:        "Guid Show",
+			ParentMediaIndex: json.Number("1"),
+			MediaIndex:       json.Number("2"),
+			WatchedStatus:    1.0,
+			GUIDs:            GUIDList{"imdb://tt0959621", "tvdb://349232"},
+		},
+	})
+	config := Config{
+		APIHost:            strings.TrimPrefix(tautulliServer.URL, "http://"),
+		APIKey:             "test-key",
+		OutputDir:          t.TempDir(),
+		IncludeProviderIDs: true,
+	}
+	handlePlexWebhook(httptest.NewRecorder(), newPlexRequest(t, "/plex", PlexWebhookPayload{
+		Event:    PlexEventStop,
+		Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+	}), config)
+
+	fileContent, err := os.ReadFile(filepath.Join(config.OutputDir, "Guid Show - S1E2.json"))
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	var fileData MediaData
+	if err := json.Unmarshal(fileContent, &fileData); err != nil {
+		t.Fatalf("Error unmarshaling file content: %v", err)
+	}
+	if expected := map[string]string{"imdb": "tt0959621", "tvdb": "349232"}; !maps.Equal(fileData.ProviderIDs, expected) {
+		t.Errorf("provider_ids = %v, expected %v", fileData.ProviderIDs, expected)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// postWriteWaitDelay bounds how long a timed out command's output is awaited after it was killed
+const postWriteWaitDelay = time.Second
+
+// runPostWriteCmd runs POST_WRITE_CMD after a file has been written. The path is passed as the last
+// argument and the key fields as PLEX_CLEAN_* environment variables. The command is best-effort:
+// it is killed along with any children after PostWriteTimeout and failures are only logged.
+func runPostWriteCmd(ctx context.Context, config Config, path string, data MediaData) {
+	logger := requestLogger(ctx)
+
+	args := strings.Fields(config.PostWriteCmd)
+	if len(args) == 0 {
+		return
+	}
+
+	// The command runs to completion even if the request it was written for has ended
+	cmdCtx := context.WithoutCancel(ctx)
+	if config.PostWriteTimeout > 0 {
+		var cancel context.CancelFunc
+		cmdCtx, cancel = context.WithTimeout(cmdCtx, config.PostWriteTimeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(cmdCtx, args[0], append(args[1:], path)...)
+	// Run the command in its own process group so children holding the output open are killed too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = postWriteWaitDelay
+	cmd.Env = append(os.Environ(),
+		"PLEX_CLEAN_FILE="+path,
+		"PLEX_CLEAN_TITLE="+data.FullTitle,
+		"PLEX_CLEAN_SEASON="+data.ParentMediaIndex.String(),
+		"PLEX_CLEAN_EPISODE="+data.MediaIndex.String(),
+		"PLEX_CLEAN_SOURCE="+data.Source,
+	)
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		logger.Printf("Post-write command output for %s: %s", path, strings.TrimSpace(string(out)))
+	}
+	if err != nil {
+		logger.Printf("Error running post-write command for %s: %v", path, err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostWriteCmd(t *testing.T) {
+	dir := t.TempDir()
+	sentinel := filepath.Join(dir, "sentinel")
+	script := filepath.Join(dir, "hook.sh")
+	content := "#!/bin/sh\nprintf '%s|%s|%s' \"$1\" \"$PLEX_CLEAN_TITLE\" \"$PLEX_CLEAN_EPISODE\" > " + sentinel + "\necho done\n"
+	if err := os.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatalf("Error writing script: %v", err)
+	}
+	logs := captureLog(t)
+
+	config := Config{
+		OutputDir:        filepath.Join(dir, "output"),
+		PostWriteCmd:     script,
+		PostWriteTimeout: 5 * time.Second,
+	}
+	data := MediaData{FullTitle: "Hooked Show", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("3")}
+	outputPath, err := writeMediaData(t.Context(), config, config.OutputDir, "Hooked Show - S1E3.json", data)
+	if err != nil {
+		t.Fatalf("writeMediaData() error = %v", err)
+	}
+
+	got, err := os.ReadFile(sentinel)
+	if err != nil {
+		t.Fatalf("post-write command did not run: %v", err)
+	}
+	if expected := outputPath + "|Hooked Show|3"; string(got) != expected {
+		t.Errorf("sentinel = %q, expected %q", got, expected)
+	}
+	if !strings.Contains(logs.String(), "done") {
+		t.Errorf("log = %q, expected the command output", logs.String())
+	}
+}
+
+func TestPostWriteCmdTimeout(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "slow.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nsleep 10; echo x\n"), 0755); err != nil {
+		t.Fatalf("Error writing script: %v", err)
+	}
+	captureLog(t)
+
+	config := Config{OutputDir: dir, PostWriteCmd: script, PostWriteTimeout: 100 * time.Millisecond}
+	start := time.Now()
+	if _, err := writeMediaData(t.Context(), config, dir, "Slow Show - S1E1.json", MediaData{FullTitle: "Slow Show"}); err != nil {
+		t.Fatalf("writeMediaData() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("write took %s, expected the command to be killed after the timeout", elapsed)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jellyfinAPITimeout bounds a Jellyfin API request
+const jellyfinAPITimeout = 10 * time.Second
+
+// jellyfinSeriesCache remembers resolved series names by series ID
+var jellyfinSeriesCache = struct {
+	sync.Mutex
+	names map[string]string
+}{names: make(map[string]string)}
+
+// resolveSeriesName fills in the series name of an episode payload that only carries a SeriesId,
+// looking it up on the Jellyfin API when JELLYFIN_URL is set and falling back to the configured
+// placeholder. Without either the name stays empty and the episode is dropped as before.
+func resolveSeriesName(config Config, payload *JellyfinWebhookPayload) {
+	if payload.ItemType != "Episode" || payload.SeriesName != "" || payload.SeriesID == "" {
+		return
+	}
+	if config.JellyfinURL != "" {
+		name, err := fetchJellyfinItemName(config, payload.SeriesID)
+		if err == nil {
+			payload.SeriesName = name
+			return
+		}
+		log.Printf("Error resolving Jellyfin series %s: %v", payload.SeriesID, err)
+	}
+	payload.SeriesName = config.JellyfinSeriesPlaceholder
+}
+
+// fetchJellyfinItemName returns the name of a Jellyfin item, asking the API only once per item
+func fetchJellyfinItemName(config Config, itemID string) (string, error) {
+	jellyfinSeriesCache.Lock()
+	name, ok := jellyfinSeriesCache.names[itemID]
+	jellyfinSeriesCache.Unlock()
+	if ok {
+		return name, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(config.JellyfinURL, "/")+"/Items/"+url.PathEscape(itemID), nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %w", err)
+	}
+	if config.JellyfinToken != "" {
+		req.Header.Set("X-Emby-Token", config.JellyfinToken)
+	}
+	client := &http.Client{Timeout: jellyfinAPITimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error making HTTP request: %w", err)
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			log.Printf("Error closing response body: %v", closeErr)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("received non-200 response: %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	var item struct {
+		Name string `json:"Name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+		return "", fmt.Errorf("error unmarshaling response: %w", err)
+	}
+	name = strings.TrimSpace(item.Name)
+	if name == "" {
+		return "", errors.New("item has no name")
+	}
+
+	jellyfinSeriesCache.Lock()
+	jellyfinSeriesCache.names[itemID] = name
+	jellyfinSeriesCache.Unlock()
+	return name, nil
+}
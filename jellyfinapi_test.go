@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestJellyfinSeriesIDResolution(t *testing.T) {
+	var apiCalls atomic.Int32
+	jellyfinServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiCalls.Add(1)
+		if r.Header.Get("X-Emby-Token") != "jellyfin-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/Items/series-123":
+			w.Header().Set("Content-Type", "application/json")
+			if _, err := w.Write([]byte(`{"Id": "series-123", "Name": "Resolved Series", "Type": "Series"}`)); err != nil {
+				t.Errorf("Error writing response: %v", err)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer jellyfinServer.Close()
+
+	jellyfinSeriesCache.Lock()
+	jellyfinSeriesCache.names = make(map[string]string)
+	jellyfinSeriesCache.Unlock()
+
+	payload := func(seriesID string) string {
+		return `{
+			"NotificationType": "PlaybackStop",
+			"ItemType": "Episode",
+			"Name": "Pilot",
+			"SeriesId": "` + seriesID + `",
+			"SeasonNumber": 1,
+			"EpisodeNumber": 2,
+			"MediaStatus": {"PlayedToCompletion": true}
+		}`
+	}
+
+	testCases := []struct {
+		name         string
+		seriesID     string
+		jellyfinURL  string
+		placeholder  string
+		expectedFile string
+	}{
+		{name: "Resolved on the Jellyfin API", seriesID: "series-123", jellyfinURL: jellyfinServer.URL, expectedFile: "Resolved Series - S1E2.json"},
+		{name: "Unknown series falls back to the placeholder", seriesID: "series-404", jellyfinURL: jellyfinServer.URL, placeholder: "Unknown Series", expectedFile: "Unknown Series - S1E2.json"},
+		{name: "Placeholder without an API", seriesID: "series-123", placeholder: "Unknown Series", expectedFile: "Unknown Series - S1E2.json"},
+		{name: "Neither configured", seriesID: "series-123"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{
+				OutputDir:                 t.TempDir(),
+				JellyfinURL:               tc.jellyfinURL,
+				JellyfinToken:             "jellyfin-token",
+				JellyfinSeriesPlaceholder: tc.placeholder,
+			}
+			rr := httptest.NewRecorder()
+			handleJellyfinWebhook(rr, newJellyfinRequest("/jellyfin", payload(tc.seriesID)), config)
+
+			if rr.Code != http.StatusOK {
+				t.Errorf("status = %v, expected %v", rr.Code, http.StatusOK)
+			}
+			files, err := os.ReadDir(config.OutputDir)
+			if err != nil {
+				t.Fatalf("Error reading output dir: %v", err)
+			}
+			if tc.expectedFile == "" {
+				if len(files) != 0 {
+					t.Errorf("Expected no files, found %d", len(files))
+				}
+				return
+			}
+			if _, err := os.Stat(filepath.Join(config.OutputDir, tc.expectedFile)); err != nil {
+				t.Errorf("Expected %s to be written: %v", tc.expectedFile, err)
+			}
+		})
+	}
+
+	// Resolved names are cached, so a repeat of the series does not query the API again
+	calls := apiCalls.Load()
+	config := Config{OutputDir: t.TempDir(), JellyfinURL: jellyfinServer.URL, JellyfinToken: "jellyfin-token"}
+	handleJellyfinWebhook(httptest.NewRecorder(), newJellyfinRequest("/jellyfin", payload("series-123")), config)
+	if got := apiCalls.Load(); got != calls {
+		t.Errorf("Jellyfin API calls = %d, expected %d", got, calls)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// JellyseerrEventMediaAvailable is sent by Jellyseerr and Overseerr when requested media becomes available
+const JellyseerrEventMediaAvailable = "MEDIA_AVAILABLE"
+
+// jellyseerrYearSuffix matches the release year Jellyseerr appends to the subject, e.g. " (2008)"
+var jellyseerrYearSuffix = regexp.MustCompile(`\s*\(\d{4}\)$`)
+
+// JellyseerrWebhookPayload represents the payload of the Jellyseerr/Overseerr webhook agent. Season
+// and episode are not part of the default template, they are read from "extra" entries named
+// "Season" and "Episode".
+type JellyseerrWebhookPayload struct {
+	NotificationType string `json:"notification_type"`
+	Subject          string `json:"subject"`
+	Media            struct {
+		MediaType string `json:"media_type"`
+		TmdbID    string `json:"tmdbId"`
+		TvdbID    string `json:"tvdbId"`
+	} `json:"media"`
+	Extra []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"extra"`
+}
+
+// extra returns the value of the "extra" entry with the given name, ignoring case
+func (p JellyseerrWebhookPayload) extra(name string) string {
+	for _, entry := range p.Extra {
+		if strings.EqualFold(entry.Name, name) {
+			return strings.TrimSpace(entry.Value)
+		}
+	}
+	return ""
+}
+
+// providerIDs returns the TMDB and TVDB IDs of the payload, or nil if it has none
+func (p JellyseerrWebhookPayload) providerIDs() map[string]string {
+	var ids map[string]string
+	for provider, id := range map[string]string{"tmdb": p.Media.TmdbID, "tvdb": p.Media.TvdbID} {
+		if id == "" {
+			continue
+		}
+		if ids == nil {
+			ids = make(map[string]string)
+		}
+		ids[provider] = id
+	}
+	return ids
+}
+
+// jellyseerrEventEnabled reports whether a Jellyseerr notification type should be processed. None
+// are by default: Jellyseerr reports availability rather than plays, so recording its events as
+// watched has to be asked for explicitly.
+func (c Config) jellyseerrEventEnabled(event string) bool {
+	return slices.Contains(c.JellyseerrEvents, event)
+}
+
+// handleJellyseerrWebhook processes Jellyseerr and Overseerr webhook requests
+func handleJellyseerrWebhook(w http.ResponseWriter, r *http.Request, config Config) {
+	logger := requestLogger(r.Context())
+
+	if !allowWebhookSource(w, r, config) {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !authorizeWebhook(w, r, config) {
+		return
+	}
+
+	stats.JellyseerrEvents.Add(1)
+	auditWebhook(r, config, SourceJellyseerr)
+	forwardWebhook(r, config)
+
+	var payload JellyseerrWebhookPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		logger.Printf("Error unmarshaling Jellyseerr payload: %v", err)
+		http.Error(w, "Error parsing payload", http.StatusBadRequest)
+		return
+	}
+
+	title := jellyseerrYearSuffix.ReplaceAllString(strings.TrimSpace(payload.Subject), "")
+	if config.ValidateOnly {
+		respondValidation(w, validateJellyseerrPayload(payload, title, config))
+		return
+	}
+
+	reason, err := processJellyseerrEvent(r.Context(), config, payload, title)
+	recent.add(SourceJellyseerr, title, reason, err)
+	if err != nil {
+		respondWriteError(w, r, err, config)
+		return
+	}
+	if reason != "" {
+		respondIgnored(w, r, reason)
+		return
+	}
+
+	respondOK(w)
+}
+
+// processJellyseerrEvent writes the media of a decoded Jellyseerr event with the given title. It
+// returns the reason when the event is ignored.
+func processJellyseerrEvent(ctx context.Context, config Config, payload JellyseerrWebhookPayload, title string) (string, error) {
+	logger := requestLogger(ctx)
+
+	if !config.jellyseerrEventEnabled(payload.NotificationType) {
+		countIgnored(IgnoreReasonEventType)
+		if config.Debug {
+			logger.Printf("Ignoring Jellyseerr event: %s", payload.NotificationType)
+		}
+		return "event not subscribed", nil
+	}
+
+	if title == "" {
+		countIgnored(IgnoreReasonNoMetadata)
+		if config.Debug {
+			logger.Printf("Jellyseerr payload has no subject, ignoring")
+		}
+		return "no metadata", nil
+	}
+
+	if config.titleIgnored(title) {
+		countIgnored(IgnoreReasonTitle)
+		if config.Debug {
+			logger.Printf("Jellyseerr media %q matches IGNORE_TITLE_REGEX, ignoring", title)
+		}
+		return "title ignored", nil
+	}
+
+	mediaData := MediaData{
+		FullTitle:        title,
+		ParentMediaIndex: json.Number("0"),
+		MediaIndex:       json.Number("0"),
+		WatchedStatus:    1.0,
+		PercentComplete:  100,
+		Source:           SourceJellyseerr,
+		ProviderIDs:      payload.providerIDs(),
+	}
+	mediaData.WatchedAt = watchedAt(mediaData, config.Location)
+
+	var filename string
+	switch payload.Media.MediaType {
+	case "movie":
+		mediaData.MediaType = "movie"
+		filename = config.outputFilename(pathSafe(title))
+	case "tv":
+		season, seasonErr := strconv.ParseInt(payload.extra("Season"), 10, 64)
+		episode, episodeErr := strconv.ParseInt(payload.extra("Episode"), 10, 64)
+		if seasonErr != nil || episodeErr != nil {
+			countIgnored(IgnoreReasonNoEpisodeInfo)
+			logger.Printf("Warning: Jellyseerr payload for %q has no Season and Episode extra fields; no file written", title)
+			return "no episode information", nil
+		}
+		mediaData.MediaType = "episode"
+		mediaData.GrandparentTitle = title
+		mediaData.ParentMediaIndex = json.Number(strconv.FormatInt(season, 10))
+		mediaData.MediaIndex = json.Number(strconv.FormatInt(episode, 10))
+		filename = config.outputFilename(config.episodeBaseName(mediaData, season, episode, title))
+	default:
+		countIgnored(IgnoreReasonUnsupportedType)
+		if config.Debug {
+			logger.Printf("Unsupported Jellyseerr media type: %s", payload.Media.MediaType)
+		}
+		return "unsupported item type", nil
+	}
+
+	logger.Printf("Media reported by Jellyseerr, writing to file %s", filename)
+	outputPath, err := writeMediaData(ctx, config, config.OutputDir, filename, mediaData)
+	if err != nil {
+		return "", err
+	}
+	if outputPath != "" {
+		logger.Printf("Wrote %s", outputPath)
+	}
+	return "", nil
+}
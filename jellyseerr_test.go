@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestJellyseerrWebhook(t *testing.T) {
+	testCases := []struct {
+		name         string
+		body         string
+		expectedFile string
+		expectedIDs  map[string]string
+	}{
+		{
+			name: "Movie available",
+			body: `{
+				"notification_type": "MEDIA_AVAILABLE",
+				"event": "Movie Request Now Available",
+				"subject": "Inception (2010)",
+				"message": "A dream within a dream.",
+				"media": {"media_type": "movie", "tmdbId": "27205", "tvdbId": "", "status": "AVAILABLE"},
+				"request": {"request_id": "12", "requestedBy_username": "alice"},
+				"extra": []
+			}`,
+			expectedFile: "Inception.json",
+			expectedIDs:  map[string]string{"tmdb": "27205"},
+		},
+		{
+			name: "Episode available",
+			body: `{
+				"notification_type": "MEDIA_AVAILABLE",
+				"subject": "Breaking Bad (2008)",
+				"media": {"media_type": "tv", "tmdbId": "1396", "tvdbId": "81189"},
+				"extra": [{"name": "Season", "value": "2"}, {"name": "Episode", "value": "3"}]
+			}`,
+			expectedFile: "Breaking Bad - S2E3.json",
+			expectedIDs:  map[string]string{"tmdb": "1396", "tvdb": "81189"},
+		},
+		{
+			name: "Series without episode",
+			body: `{
+				"notification_type": "MEDIA_AVAILABLE",
+				"subject": "Breaking Bad (2008)",
+				"media": {"media_type": "tv", "tmdbId": "1396"},
+				"extra": [{"name": "Requested Seasons", "value": "1, 2"}]
+			}`,
+		},
+		{
+			name: "Path in subject",
+			body: `{
+				"notification_type": "MEDIA_AVAILABLE",
+				"subject": "../escaped",
+				"media": {"media_type": "movie", "tmdbId": "27205"}
+			}`,
+			expectedFile: "escaped.json",
+			expectedIDs:  map[string]string{"tmdb": "27205"},
+		},
+		{
+			name: "Ignored title",
+			body: `{
+				"notification_type": "MEDIA_AVAILABLE",
+				"subject": "Sample Trailer (2010)",
+				"media": {"media_type": "movie", "tmdbId": "27205"}
+			}`,
+		},
+		{
+			name: "Other notification",
+			body: `{
+				"notification_type": "MEDIA_PENDING",
+				"subject": "Inception (2010)",
+				"media": {"media_type": "movie", "tmdbId": "27205"}
+			}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{
+				OutputDir:          t.TempDir(),
+				IncludeProviderIDs: true,
+				JellyseerrEnabled:  true,
+				JellyseerrEvents:   []string{JellyseerrEventMediaAvailable},
+				IgnoreTitleRegex:   regexp.MustCompile(`Trailer`),
+			}
+
+			req := httptest.NewRequest("POST", "/jellyseerr", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			newRouter(config).ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+
+			entries, err := os.ReadDir(config.OutputDir)
+			if err != nil {
+				t.Fatalf("Error reading output dir: %v", err)
+			}
+			if tc.expectedFile == "" {
+				if len(entries) != 0 {
+					t.Errorf("files = %d, expected none", len(entries))
+				}
+				return
+			}
+
+			fileContent, err := os.ReadFile(filepath.Join(config.OutputDir, tc.expectedFile))
+			if err != nil {
+				t.Fatalf("Error reading file: %v", err)
+			}
+			var fileData MediaData
+			if err := json.Unmarshal(fileContent, &fileData); err != nil {
+				t.Fatalf("Error unmarshaling file content: %v", err)
+			}
+			if fileData.Source != SourceJellyseerr {
+				t.Errorf("source = %q, expected %q", fileData.Source, SourceJellyseerr)
+			}
+			if !maps.Equal(fileData.ProviderIDs, tc.expectedIDs) {
+				t.Errorf("provider_ids = %v, expected %v", fileData.ProviderIDs, tc.expectedIDs)
+			}
+		})
+	}
+}
+
+func TestJellyseerrWebhookDisabled(t *testing.T) {
+	req := httptest.NewRequest("POST", "/jellyseerr", strings.NewReader(`{}`))
+	rr := httptest.NewRecorder()
+	newRouter(Config{OutputDir: t.TempDir()}).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestJellyseerrEventsDefault(t *testing.T) {
+	config := Config{OutputDir: t.TempDir(), JellyseerrEnabled: true}
+	body := `{"notification_type": "MEDIA_AVAILABLE", "subject": "Available Movie (2020)", "media": {"media_type": "movie"}}`
+	req := httptest.NewRequest("POST", "/jellyseerr", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	newRouter(config).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	entries, err := os.ReadDir(config.OutputDir)
+	if err != nil {
+		t.Fatalf("Error reading output dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("files = %d, expected none without JELLYSEERR_EVENTS", len(entries))
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plex-clean.log")
+	out, err := logOutput(Config{LogFile: path, LogStdoutDisabled: true})
+	if err != nil {
+		t.Fatalf("logOutput() error = %v", err)
+	}
+	t.Cleanup(func() { out.(*rotatingFile).Close() })
+
+	logger := log.New(out, "", 0)
+	logger.Printf("first line")
+	logger.Printf("second line")
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading log file: %v", err)
+	}
+	if got := string(content); got != "first line\nsecond line\n" {
+		t.Errorf("log file = %q, expected both lines", got)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plex-clean.log")
+	file, err := newRotatingFile(path, 20)
+	if err != nil {
+		t.Fatalf("newRotatingFile() error = %v", err)
+	}
+	defer file.Close()
+
+	for _, line := range []string{"0123456789\n", "abcdefghij\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	current, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading log file: %v", err)
+	}
+	backup, err := os.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatalf("Error reading rotated log file: %v", err)
+	}
+	if string(current) != "abcdefghij\n" || !strings.HasPrefix(string(backup), "0123456789") {
+		t.Errorf("log = %q, backup = %q, expected the first line to be rotated out", current, backup)
+	}
+}
@@ -1,16 +1,37 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	_ "time/tzdata" // Embed the timezone database, the scratch image has none
+	"unicode/utf8"
 )
 
 // Config holds the application configuration
@@ -20,14 +41,727 @@ type Config struct {
 	APIKey    string
 	OutputDir string
 	Debug     bool
+
+	// PlexOutputDir and JellyfinOutputDir override OutputDir for the respective source when set
+	PlexOutputDir     string
+	JellyfinOutputDir string
+	// PlexDisabled and JellyfinDisabled remove the respective webhook endpoint and its autodetection
+	// on "/", so that a disabled source answers with 404
+	PlexDisabled     bool
+	JellyfinDisabled bool
+	// JellyseerrEnabled registers the /jellyseerr endpoint, which is off unless explicitly enabled
+	JellyseerrEnabled bool
+	// EchoEnabled registers the /echo endpoint that returns requests as received, for debugging
+	EchoEnabled bool
+	// DebugAcceptGet lets GET /plex?event=...&key=... stand in for a Plex webhook, for manual testing
+	DebugAcceptGet bool
+	// StrictJSON rejects Jellyfin payloads with fields that are not known, for validating templates
+	StrictJSON bool
+	// WriteWorkers runs file writes on this many goroutines fed by a queue of WriteQueueSize, 0
+	// writes in the handler. A full queue fails writes after WriteQueueTimeout.
+	WriteWorkers      int
+	WriteQueueSize    int
+	WriteQueueTimeout time.Duration
+	// AsyncWrites answers webhooks as soon as their writes are queued, without waiting for them
+	AsyncWrites bool
+	// RequestTimeout answers requests whose handler takes longer with a 503, 0 disables it
+	RequestTimeout time.Duration
+	// ServerReadTimeout, ServerWriteTimeout and ServerIdleTimeout bound how long a connection may take
+	// to send its request, to receive the response and to sit idle between requests, 0 disables one
+	ServerReadTimeout  time.Duration
+	ServerWriteTimeout time.Duration
+	ServerIdleTimeout  time.Duration
+	// AuditDir, when set, receives a copy of every webhook request as received. Copies older than
+	// AuditRetention are removed, 0 keeps them forever.
+	AuditDir       string
+	AuditRetention time.Duration
+	// RecentBufferSize is the number of processed events listed by /recent
+	RecentBufferSize int
+	// MaxConcurrentRequests sheds requests beyond this many in flight with a 503, 0 is unlimited
+	MaxConcurrentRequests int
+	// ValidateOnly answers webhooks with a summary of the decoded payload, without contacting
+	// Tautulli or writing files
+	ValidateOnly bool
+
+	// PlexWatchMode decides how a Plex item counts as watched, "status" or "percent"
+	PlexWatchMode string
+	// PlexWatchedPercent is the percent_complete at which an item counts as watched in percent mode
+	PlexWatchedPercent int
+	// MinPercentComplete is the minimum percent_complete required for a Plex item to be written
+	MinPercentComplete int
+	// SkipZeroIndex skips Plex episodes that Tautulli reports as season 0 episode 0
+	SkipZeroIndex bool
+
+	// TautulliTimeout bounds every request made to Tautulli, zero means no timeout
+	TautulliTimeout time.Duration
+	// TautulliStartupCheck probes Tautulli once at startup to surface misconfiguration early
+	TautulliStartupCheck bool
+	// TautulliUserAgent is sent as the User-Agent header on Tautulli requests
+	TautulliUserAgent string
+	// TautulliMaxConcurrency limits the number of simultaneous Tautulli requests
+	TautulliMaxConcurrency int
+	// TautulliSettleRetries re-queries the history this many times while the latest row is not yet
+	// the watched play of the webhook's item, waiting TautulliSettleDelay in between
+	TautulliSettleRetries int
+	TautulliSettleDelay   time.Duration
+	// TautulliKeyParams are the get_history parameters the webhook's key is passed as, tried in order
+	// until one returns rows
+	TautulliKeyParams []string
+	// TautulliMediaType, TautulliUserID and TautulliTranscodeDecision scope the get_history query
+	// to matching rows when set
+	TautulliMediaType         string
+	TautulliUserID            string
+	TautulliTranscodeDecision string
+	// EmptyDataBehavior decides what happens when Tautulli has no history for a Plex webhook: skip
+	// the event, retry up to EmptyDataRetries times EmptyDataRetryDelay apart, or fail so Plex retries
+	EmptyDataBehavior   string
+	EmptyDataRetries    int
+	EmptyDataRetryDelay time.Duration
+	// TautulliBasePath is the API path on API_HOST, for Tautulli instances mounted under a subpath
+	TautulliBasePath string
+
+	// OutputBackend selects where records are written, "file" or "s3"
+	OutputBackend string
+	// S3 settings for the s3 output backend, the credentials use the standard AWS variables
+	S3Bucket       string
+	S3Prefix       string
+	S3Endpoint     string
+	S3Region       string
+	S3AccessKey    string
+	S3SecretKey    string
+	S3SessionToken string
+
+	// FailOnWriteError answers failed writes with 500 so that the sender retries the webhook
+	FailOnWriteError bool
+
+	// OnConflict controls what happens when the output file already exists
+	OnConflict string
+	// OutputExtension is appended to every output filename, e.g. ".watched.json"
+	OutputExtension string
+	// OutputFormat is "json" or "nfo" for Kodi NFO XML files, which use the .nfo extension
+	OutputFormat string
+	// OutputSchemaVersion selects the shape of written JSON, 0 means the current SchemaVersion
+	OutputSchemaVersion int
+	// OutputCompress compresses written files, "none" or "gzip". Gzip files get a .gz suffix.
+	OutputCompress string
+	// FilenameTemplate names episode files using {full_title}, {grandparent_title}, {parent_title},
+	// {title}, {season} and {episode} placeholders, empty keeps "<title> - S<season>E<episode>"
+	FilenameTemplate string
+	// FilenameTemplates overrides FilenameTemplate per library, keyed by the library name as an
+	// environment variable suffix, e.g. "TV_SHOWS" for FILENAME_TEMPLATE_TV_SHOWS
+	FilenameTemplates map[string]string
+	// TitleNormalizeRegex rewrites the full_title of Plex episodes with TitleNormalizeReplacement
+	// before it is used in a filename, nil leaves titles untouched
+	TitleNormalizeRegex       *regexp.Regexp
+	TitleNormalizeReplacement string
+	// IgnoreTitleRegex skips events whose full or series title matches, nil processes every title
+	IgnoreTitleRegex *regexp.Regexp
+	// FilenameCase is "preserve", "lower" or "upper" and applies to filenames without extension
+	FilenameCase string
+	// FilenameSpaceReplacement, when set, replaces spaces in filenames
+	FilenameSpaceReplacement string
+	// SeasonPadWidth and EpisodePadWidth zero-pad the numbers in filenames, e.g. 2 for S01E02
+	SeasonPadWidth  int
+	EpisodePadWidth int
+	// MaxFilenameBytes limits the length of output filenames, longer titles are truncated
+	MaxFilenameBytes int
+
+	// WebhookBasicUser and WebhookBasicPass, when both set, are required as Basic auth on webhooks
+	WebhookBasicUser string
+	WebhookBasicPass string
+
+	// AllowedIPs restricts webhook sources to these networks, empty allows everyone
+	AllowedIPs []*net.IPNet
+	// TrustForwardedFor uses X-Forwarded-For as the client address for the allowlist
+	TrustForwardedFor bool
+
+	// MultipartMaxMemory is the number of bytes of a multipart Plex webhook kept in memory, the
+	// rest such as attached posters is spilled to temporary files
+	MultipartMaxMemory int64
+	// MaxBodyBytes bounds the body read on "/" to detect the webhook source, 0 means the default
+	MaxBodyBytes int64
+
+	// PlexEvents lists the Plex webhook events that are processed
+	PlexEvents []string
+	// PlexStopEvent is the Plex event name treated as media.stop, for Plex versions that rename it
+	PlexStopEvent string
+	// PlexSkipTautulliMovies builds movie records from the Plex webhook instead of querying Tautulli
+	PlexSkipTautulliMovies bool
+	// AllowedMediaTypes lists the Tautulli media types that are recorded, empty means episode and movie
+	AllowedMediaTypes []string
+	// NewMediaDir is where library.new records are written
+	NewMediaDir string
+	// PartialDir, when set, receives items stopped between PartialMinPercent and PartialMaxPercent
+	PartialDir        string
+	PartialMinPercent int
+	PartialMaxPercent int
+
+	// JellyfinEvents lists the Jellyfin notification types that are processed
+	JellyfinEvents []string
+	// JellyfinStopEvent is the Jellyfin notification type or event treated as PlaybackStop, in
+	// addition to the plugin's "playback.stop" event
+	JellyfinStopEvent string
+	// JellyfinCompletionPercent also counts a stopped item as watched once this share of its run
+	// time was played, regardless of PlayedToCompletion. 0 trusts the flag alone.
+	JellyfinCompletionPercent int
+	// JellyfinMusicEnabled records played Audio and MusicAlbum items in MusicOutputDir
+	JellyfinMusicEnabled bool
+	// MusicOutputDir is where Jellyfin music records are written
+	MusicOutputDir string
+	// JellyseerrEvents lists the Jellyseerr notification types that are processed
+	JellyseerrEvents []string
+
+	// DedupTTL is how long written items are remembered to suppress repeats
+	DedupTTL time.Duration
+	// DedupFile persists the remembered items across restarts, empty keeps them in memory only
+	DedupFile string
+	// DedupWebhooks also suppresses webhook events for remembered items, otherwise only the poller
+	// and backfill skip them so that rewatches are still written
+	DedupWebhooks bool
+	// PollEnabled periodically polls Tautulli's history for completions missed by webhooks
+	PollEnabled bool
+	// PollInterval is the time between two polls
+	PollInterval time.Duration
+	// PollLength is the number of recent history rows requested per poll
+	PollLength int
+	// Backfill records the completions in Tautulli's history once at startup
+	Backfill bool
+	// BackfillLength is the number of history rows requested by the backfill
+	BackfillLength int
+	// BackfillDays limits the backfill to the last number of days, 0 means no limit
+	BackfillDays int
+	// ForwardURL receives a copy of every accepted webhook, sent with ForwardMethod and ForwardHeaders
+	ForwardURL     string
+	ForwardMethod  string
+	ForwardHeaders http.Header
+	// PostWriteCmd is run after every successful write with the written path as its last argument
+	PostWriteCmd string
+	// PostWriteTimeout bounds how long PostWriteCmd may run
+	PostWriteTimeout time.Duration
+	// IncludeProviderIDs writes the Plex guid and Jellyfin Provider_* IDs under "provider_ids"
+	IncludeProviderIDs bool
+	// IncludeRawMetadata embeds the complete Tautulli row under a "raw" key in the output
+	IncludeRawMetadata bool
+	// IncludePlexHeaders records the account, player and device from the X-Plex-* request headers
+	IncludePlexHeaders bool
+	// IncludeID writes a deterministic "id" per watched event so consumers can ingest idempotently
+	IncludeID bool
+	// TMDBAPIKey enables looking up the TMDB ID and year of movies that lack them, with TMDBURL as
+	// the API base URL and TMDBTimeout bounding each lookup
+	TMDBAPIKey  string
+	TMDBURL     string
+	TMDBTimeout time.Duration
+	// JellyfinURL and JellyfinToken let episodes that only carry a SeriesId be resolved to their series
+	// name on the Jellyfin API. JellyfinSeriesPlaceholder names them when that is not possible.
+	JellyfinURL               string
+	JellyfinToken             string
+	JellyfinSeriesPlaceholder string
+	// IncludeDuration writes the Tautulli duration and view offset along with the computed watched seconds
+	IncludeDuration bool
+
+	// LogFile additionally writes the log to this file, rotated at LogMaxSize megabytes. With
+	// LogStdoutDisabled the log is only written to the file.
+	LogFile           string
+	LogMaxSize        int
+	LogStdoutDisabled bool
+
+	// Location is the timezone used for written timestamps and log output
+	Location *time.Location
+}
+
+// Values for MediaData.SchemaVersion. SchemaVersionCurrent is bumped on breaking changes to the
+// written JSON; SchemaVersionLegacy is the original five field shape.
+const (
+	SchemaVersionLegacy  = 1
+	SchemaVersionCurrent = 2
+)
+
+// schemaVersion returns the configured output schema version, defaulting to SchemaVersionCurrent
+func (c Config) schemaVersion() int {
+	if c.OutputSchemaVersion == 0 {
+		return SchemaVersionCurrent
+	}
+	return c.OutputSchemaVersion
+}
+
+// outputExtension returns the configured output file extension, defaulting to ".json". The NFO
+// format replaces a ".json" suffix with ".nfo", and ".gz" is appended when output is gzip compressed.
+func (c Config) outputExtension() string {
+	extension := c.OutputExtension
+	if extension == "" {
+		extension = defaultOutputExtension
+	}
+	if c.OutputFormat == OutputFormatNFO && !strings.HasSuffix(extension, nfoExtension) {
+		extension = strings.TrimSuffix(extension, defaultOutputExtension) + nfoExtension
+	}
+	if c.OutputCompress == OutputCompressGzip {
+		extension += gzipExtension
+	}
+	return extension
+}
+
+// outputFilename appends the output file extension to a base filename, normalizing it and
+// truncating it to fit MaxFilenameBytes
+func (c Config) outputFilename(base string) string {
+	return truncateFilename(base, c.outputExtension(), c.maxFilenameBytes(), c.normalizeFilename)
+}
+
+// maxFilenameBytes returns the configured filename length limit, defaulting to 255
+func (c Config) maxFilenameBytes() int {
+	if c.MaxFilenameBytes <= 0 {
+		return defaultMaxFilenameBytes
+	}
+	return c.MaxFilenameBytes
+}
+
+// episodeSuffixRegex matches the episode marker that must survive truncation
+var episodeSuffixRegex = regexp.MustCompile(` - S\d+E\d+( - rated)?$`)
+
+// truncateFilename joins base and extension after applying normalize to everything but the
+// extension, shortening the title portion of the last path element when it exceeds maxBytes. The
+// episode suffix and extension are kept, and a short hash of the name keeps truncated names unique.
+func truncateFilename(base, extension string, maxBytes int, normalize func(string) string) string {
+	dir, name := filepath.Split(base)
+	suffix := episodeSuffixRegex.FindString(name)
+	title := normalize(strings.TrimSuffix(name, suffix))
+	dir, suffix = normalize(dir), normalize(suffix)
+	if len(title)+len(suffix)+len(extension) <= maxBytes {
+		return dir + title + suffix + extension
+	}
+
+	sum := sha1.Sum([]byte(title + suffix))
+	tail := "~" + hex.EncodeToString(sum[:])[:8] + suffix + extension
+
+	// Cut on a rune boundary so the result stays valid UTF-8
+	limit := max(maxBytes-len(tail), 0)
+	for limit > 0 && !utf8.RuneStart(title[limit]) {
+		limit--
+	}
+	return dir + title[:limit] + tail
+}
+
+// pathSafe removes the path separators and ".." sequences from a title, so a title received in a
+// webhook cannot name a file outside the output directory
+func pathSafe(title string) string {
+	title = strings.NewReplacer("/", "", "\\", "").Replace(title)
+	for strings.Contains(title, "..") {
+		title = strings.ReplaceAll(title, "..", "")
+	}
+	return title
+}
+
+// normalizeFilename applies FILENAME_CASE and FILENAME_SPACE_REPLACEMENT to part of a filename
+func (c Config) normalizeFilename(name string) string {
+	switch c.FilenameCase {
+	case FilenameCaseLower:
+		name = strings.ToLower(name)
+	case FilenameCaseUpper:
+		name = strings.ToUpper(name)
+	}
+	if c.FilenameSpaceReplacement != "" {
+		name = strings.ReplaceAll(name, " ", c.FilenameSpaceReplacement)
+	}
+	return name
+}
+
+// episodeBaseName returns the filename without extension for an episode. Without FILENAME_TEMPLATE
+// the name is built from title; in a template the granular title fields fall back to full_title
+// when Tautulli leaves them empty.
+func (c Config) episodeBaseName(data MediaData, season, episode int64, title string) string {
+	seasonStr := fmt.Sprintf("%0*d", c.SeasonPadWidth, season)
+	episodeStr := fmt.Sprintf("%0*d", c.EpisodePadWidth, episode)
+	template := c.filenameTemplate(data.LibraryName)
+	if template == "" {
+		return fmt.Sprintf("%s - S%sE%s", pathSafe(title), seasonStr, episodeStr)
+	}
+
+	// Slashes in the template create directories, slashes in the titles must not
+	orFullTitle := func(value string) string {
+		if value == "" {
+			return pathSafe(data.FullTitle)
+		}
+		return pathSafe(value)
+	}
+	return strings.NewReplacer(
+		"{full_title}", pathSafe(data.FullTitle),
+		"{grandparent_title}", orFullTitle(data.GrandparentTitle),
+		"{parent_title}", orFullTitle(data.ParentTitle),
+		"{title}", orFullTitle(data.Title),
+		"{season}", seasonStr,
+		"{episode}", episodeStr,
+	).Replace(template)
+}
+
+// filenameTemplate returns the FILENAME_TEMPLATE_<LIBRARY> override of the library, falling back to
+// FILENAME_TEMPLATE
+func (c Config) filenameTemplate(library string) string {
+	if template, ok := c.FilenameTemplates[envSuffix(library)]; ok && library != "" {
+		return template
+	}
+	return c.FilenameTemplate
+}
+
+// nonEnvCharsRegex matches the runs of characters that cannot appear in an environment variable name
+var nonEnvCharsRegex = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// envSuffix normalizes a name such as a library name to an environment variable suffix, e.g.
+// "TV Shows" to "TV_SHOWS"
+func envSuffix(name string) string {
+	return strings.Trim(nonEnvCharsRegex.ReplaceAllString(strings.ToUpper(name), "_"), "_")
+}
+
+// normalizeTitle applies TITLE_NORMALIZE_REGEX to the full_title of Plex episodes, whose shape
+// varies between Tautulli versions. Other media types keep their title unchanged.
+func (c Config) normalizeTitle(data MediaData) string {
+	if c.TitleNormalizeRegex == nil || data.MediaType != "episode" {
+		return data.FullTitle
+	}
+	return c.TitleNormalizeRegex.ReplaceAllString(data.FullTitle, c.TitleNormalizeReplacement)
+}
+
+// titleIgnored reports whether any of the non-empty titles matches IGNORE_TITLE_REGEX
+func (c Config) titleIgnored(titles ...string) bool {
+	if c.IgnoreTitleRegex == nil {
+		return false
+	}
+	return slices.ContainsFunc(titles, func(title string) bool {
+		return title != "" && c.IgnoreTitleRegex.MatchString(title)
+	})
+}
+
+// plexOutputDir returns the directory Plex watches are written to, defaulting to OutputDir
+func (c Config) plexOutputDir() string {
+	if c.PlexOutputDir == "" {
+		return c.OutputDir
+	}
+	return c.PlexOutputDir
+}
+
+// jellyfinOutputDir returns the directory Jellyfin watches are written to, defaulting to OutputDir
+func (c Config) jellyfinOutputDir() string {
+	if c.JellyfinOutputDir == "" {
+		return c.OutputDir
+	}
+	return c.JellyfinOutputDir
+}
+
+// newMediaDir returns the directory for library.new records, defaulting to "new" inside the output directory
+func (c Config) newMediaDir() string {
+	if c.NewMediaDir == "" {
+		return filepath.Join(c.OutputDir, "new")
+	}
+	return c.NewMediaDir
+}
+
+// musicOutputDir returns the directory for Jellyfin music records, defaulting to "music" inside the output directory
+func (c Config) musicOutputDir() string {
+	if c.MusicOutputDir == "" {
+		return filepath.Join(c.OutputDir, "music")
+	}
+	return c.MusicOutputDir
+}
+
+// plexEvent maps the configured PLEX_STOP_EVENT to media.stop and returns other events unchanged
+func (c Config) plexEvent(event string) string {
+	if c.PlexStopEvent != "" && event == c.PlexStopEvent {
+		return PlexEventStop
+	}
+	return event
+}
+
+// jellyfinEvent returns the notification type of a Jellyfin payload, mapping the plugin's
+// playback.stop event and the configured JELLYFIN_STOP_EVENT to PlaybackStop
+func (c Config) jellyfinEvent(payload JellyfinWebhookPayload) string {
+	if payload.Event == "playback.stop" {
+		return JellyfinEventPlaybackStop
+	}
+	if c.JellyfinStopEvent != "" && (payload.NotificationType == c.JellyfinStopEvent || payload.Event == c.JellyfinStopEvent) {
+		return JellyfinEventPlaybackStop
+	}
+	return payload.NotificationType
+}
+
+// plexEventEnabled reports whether a Plex event should be processed, defaulting to media.stop only.
+// media.resume and media.play are always processed while partial tracking is enabled.
+func (c Config) plexEventEnabled(event string) bool {
+	if (event == PlexEventResume || event == PlexEventPlay) && c.PartialDir != "" {
+		return true
+	}
+	if len(c.PlexEvents) == 0 {
+		return event == PlexEventStop
+	}
+	return slices.Contains(c.PlexEvents, event)
+}
+
+// multipartMaxMemory returns how much of a multipart webhook is held in memory, defaulting to 10 MB
+func (c Config) multipartMaxMemory() int64 {
+	if c.MultipartMaxMemory <= 0 {
+		return defaultMultipartMaxMemory
+	}
+	return c.MultipartMaxMemory
+}
+
+// enabledWebhooks returns the names of the webhook sources whose endpoints are registered
+func (c Config) enabledWebhooks() []string {
+	var sources []string
+	if !c.PlexDisabled {
+		sources = append(sources, "Plex")
+	}
+	if !c.JellyfinDisabled {
+		sources = append(sources, "Jellyfin")
+	}
+	if c.JellyseerrEnabled {
+		sources = append(sources, "Jellyseerr")
+	}
+	return sources
+}
+
+// maxBodyBytes returns the largest body read to detect the source of a webhook on "/", defaulting
+// to 32 MB
+func (c Config) maxBodyBytes() int64 {
+	if c.MaxBodyBytes <= 0 {
+		return defaultMaxBodyBytes
+	}
+	return c.MaxBodyBytes
 }
 
+// Tautulli get_history parameters a rating key can be looked up by
+const (
+	TautulliKeyRating            = "rating_key"
+	TautulliKeyParentRating      = "parent_rating_key"
+	TautulliKeyGrandparentRating = "grandparent_rating_key"
+)
+
+// tautulliKeyParams returns the key parameters to query in order, defaulting to rating_key only
+func (c Config) tautulliKeyParams() []string {
+	if len(c.TautulliKeyParams) == 0 {
+		return []string{TautulliKeyRating}
+	}
+	return c.TautulliKeyParams
+}
+
+// addHistoryFilters adds the configured get_history filters to the query parameters
+func (c Config) addHistoryFilters(params url.Values) {
+	if c.TautulliMediaType != "" {
+		params.Set("media_type", c.TautulliMediaType)
+	}
+	if c.TautulliUserID != "" {
+		params.Set("user_id", c.TautulliUserID)
+	}
+	if c.TautulliTranscodeDecision != "" {
+		params.Set("transcode_decision", c.TautulliTranscodeDecision)
+	}
+}
+
+// tautulliBasePath returns the path of the Tautulli API, defaulting to "/api/v2"
+func (c Config) tautulliBasePath() string {
+	if c.TautulliBasePath == "" {
+		return defaultTautulliBasePath
+	}
+	return c.TautulliBasePath
+}
+
+// plexWatched reports whether a Tautulli row counts as watched. By default Tautulli's
+// watched_status decides, in percent mode percent_complete must reach PlexWatchedPercent.
+func (c Config) plexWatched(data MediaData) bool {
+	if c.PlexWatchMode == PlexWatchModePercent {
+		return int(data.PercentComplete) >= c.PlexWatchedPercent
+	}
+	return data.WatchedStatus >= 1.0
+}
+
+// partiallyWatched reports whether an incomplete item falls in the PARTIAL_DIR percent range
+func (c Config) partiallyWatched(percentComplete int) bool {
+	return c.PartialDir != "" && percentComplete >= c.PartialMinPercent && percentComplete <= c.PartialMaxPercent
+}
+
+// defaultAllowedMediaTypes are the Tautulli media types recorded unless ALLOWED_MEDIA_TYPES is set
+var defaultAllowedMediaTypes = []string{"episode", "movie"}
+
+// mediaTypeAllowed reports whether Plex rows of the Tautulli media type are recorded. Rows without
+// a media type are let through.
+func (c Config) mediaTypeAllowed(mediaType string) bool {
+	if mediaType == "" {
+		return true
+	}
+	if len(c.AllowedMediaTypes) == 0 {
+		return slices.Contains(defaultAllowedMediaTypes, mediaType)
+	}
+	return slices.Contains(c.AllowedMediaTypes, mediaType)
+}
+
+// jellyfinEventEnabled reports whether a Jellyfin notification type should be processed, defaulting
+// to PlaybackStop only
+func (c Config) jellyfinEventEnabled(event string) bool {
+	if len(c.JellyfinEvents) == 0 {
+		return event == JellyfinEventPlaybackStop
+	}
+	return slices.Contains(c.JellyfinEvents, event)
+}
+
+// defaultOutputExtension is used when OUTPUT_EXTENSION is not set
+const defaultOutputExtension = ".json"
+
+// gzipExtension is appended to the output extension of gzip compressed files
+const gzipExtension = ".gz"
+
+// Values for Config.OutputCompress
+const (
+	OutputCompressNone = "none"
+	OutputCompressGzip = "gzip"
+)
+
+// defaultMultipartMaxMemory is used when MULTIPART_MAX_MEMORY is not set
+const defaultMultipartMaxMemory = 10 << 20
+
+// defaultMaxBodyBytes is used when MAX_BODY_BYTES is not set, enough for a Plex webhook with a poster
+const defaultMaxBodyBytes = 32 << 20
+
+// defaultTautulliBasePath is used when TAUTULLI_BASE_PATH is not set
+const defaultTautulliBasePath = "/api/v2"
+
+// defaultTitleNormalizeRegex reduces both "Series - S01E02 - Title" and "Series - Title" to the
+// series name when used with the replacement "$1"
+const defaultTitleNormalizeRegex = `^(.+?) - (?:S\d+E\d+ - )?.+$`
+
+// defaultMaxFilenameBytes is the filename limit of common filesystems such as ext4
+const defaultMaxFilenameBytes = 255
+
+// Values for Config.PlexWatchMode
+const (
+	PlexWatchModeStatus  = "status"
+	PlexWatchModePercent = "percent"
+)
+
+// Values for Config.EmptyDataBehavior
+const (
+	EmptyDataSkip  = "skip"
+	EmptyDataRetry = "retry"
+	EmptyDataFail  = "fail"
+)
+
+// Values for Config.FilenameCase
+const (
+	FilenameCasePreserve = "preserve"
+	FilenameCaseLower    = "lower"
+	FilenameCaseUpper    = "upper"
+)
+
+// Values for Config.OnConflict
+const (
+	OnConflictOverwrite = "overwrite"
+	OnConflictSkip      = "skip"
+	OnConflictSuffix    = "suffix"
+)
+
+// Plex webhook events that can be processed
+const (
+	PlexEventStop = "media.stop"
+	PlexEventRate = "media.rate"
+	// PlexEventLibraryNew records newly added media into the new media directory
+	PlexEventLibraryNew = "library.new"
+	// PlexEventResume clears the partial record of an item that is being watched again
+	PlexEventResume = "media.resume"
+	// PlexEventPlay is sent instead of media.resume when a stopped item is started again later
+	PlexEventPlay = "media.play"
+)
+
+// Jellyfin notification types that can be processed
+const (
+	JellyfinEventPlaybackStop = "PlaybackStop"
+	// JellyfinEventUserDataSaved is sent when an item is manually marked as played
+	JellyfinEventUserDataSaved = "UserDataSaved"
+)
+
 // PlexWebhookPayload represents the payload received from Plex webhook
 type PlexWebhookPayload struct {
-	Event    string `json:"event"`
-	Metadata struct {
-		Key string `json:"key"`
-	} `json:"Metadata"`
+	Event    string       `json:"event"`
+	Account  PlexAccount  `json:"Account"`
+	Metadata PlexMetadata `json:"Metadata"`
+}
+
+// PlexAccount identifies the Plex Home user a webhook was sent for
+type PlexAccount struct {
+	ID    FlexibleInt `json:"id"`
+	Title string      `json:"title"`
+}
+
+// PlexMetadata represents the metadata of the item a Plex webhook refers to
+type PlexMetadata struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+	// Rating is the user's own rating, set on media.rate events
+	Rating    float64     `json:"userRating"`
+	RatingKey FlexibleInt `json:"ratingKey"`
+	Title     string      `json:"title"`
+	Year      FlexibleInt `json:"year"`
+	GUID      string      `json:"guid"`
+	GUIDs     GUIDList    `json:"Guid"`
+	// Duration and ViewOffset are in milliseconds, ViewCount counts completed plays
+	Duration   FlexibleInt `json:"duration"`
+	ViewOffset FlexibleInt `json:"viewOffset"`
+	ViewCount  FlexibleInt `json:"viewCount"`
+	// LibrarySectionTitle is the name of the item's library, which get_history rows do not carry
+	LibrarySectionTitle string `json:"librarySectionTitle"`
+}
+
+// plexWebhookWatchedPercent is the share of a movie that counts as watched when it is recorded from
+// the webhook alone, matching Tautulli's default movie watched percent
+const plexWebhookWatchedPercent = 85
+
+// mediaData builds a Tautulli style row for a movie from the webhook metadata. Plex clears the view
+// offset once a movie was played to the end, so a counted play without an offset is complete. The
+// webhook's duration is the length of the movie rather than Tautulli's time played, so it is only
+// used for the percentage and the final position.
+func (m PlexMetadata) mediaData() MediaData {
+	data := MediaData{
+		RatingKey:        m.RatingKey,
+		FullTitle:        strings.TrimSpace(m.Title),
+		Title:            strings.TrimSpace(m.Title),
+		ParentMediaIndex: json.Number("0"),
+		MediaIndex:       json.Number("0"),
+		MediaType:        "movie",
+		GUID:             m.GUID,
+		GUIDs:            m.GUIDs,
+		ProviderIDs:      providerIDs(append([]string{m.GUID}, m.GUIDs...)...),
+		Year:             m.Year,
+		ViewOffset:       m.ViewOffset,
+		LibraryName:      m.LibrarySectionTitle,
+	}
+	switch {
+	case m.ViewOffset == 0 && m.ViewCount > 0:
+		data.PercentComplete = 100
+		data.ViewOffset = m.Duration
+	case m.Duration > 0:
+		data.PercentComplete = min(m.ViewOffset*100/m.Duration, 100)
+	}
+	if data.PercentComplete >= plexWebhookWatchedPercent {
+		data.WatchedStatus = 1.0
+	}
+	return data
+}
+
+// PlexClient describes who and what triggered a Plex webhook, taken from the X-Plex-* request headers
+type PlexClient struct {
+	AccountID string `json:"account_id,omitempty"`
+	Player    string `json:"player,omitempty"`
+	Device    string `json:"device,omitempty"`
+}
+
+// plexClient reads the X-Plex-* headers of a webhook request, returning nil when none are present
+func plexClient(r *http.Request) *PlexClient {
+	client := PlexClient{
+		AccountID: r.Header.Get("X-Plex-Account-ID"),
+		Player:    r.Header.Get("X-Plex-Product"),
+		Device:    r.Header.Get("X-Plex-Device-Name"),
+	}
+	if client.Device == "" {
+		client.Device = r.Header.Get("X-Plex-Device")
+	}
+	if client == (PlexClient{}) {
+		return nil
+	}
+	return &client
 }
 
 // JellyfinWebhookPayload represents the payload received from Jellyfin webhook
@@ -41,17 +775,148 @@ type JellyfinWebhookPayload struct {
 		IsPaused           bool   `json:"IsPaused"`
 		PlayedToCompletion bool   `json:"PlayedToCompletion"`
 	} `json:"MediaStatus"`
-	NotificationType string `json:"NotificationType"`
-	Title            string `json:"Name"`
-	SeriesName       string `json:"SeriesName"`
-	SeasonNumber     int    `json:"SeasonNumber"`
-	EpisodeNumber    int    `json:"EpisodeNumber"`
+	NotificationType string      `json:"NotificationType"`
+	Title            string      `json:"Name"`
+	SeriesName       string      `json:"SeriesName"`
+	SeriesID         string      `json:"SeriesId"`
+	SeasonNumber     FlexibleInt `json:"SeasonNumber"`
+	EpisodeNumber    FlexibleInt `json:"EpisodeNumber"`
+	IndexNumberEnd   FlexibleInt `json:"IndexNumberEnd"`
+	User             string      `json:"NotificationUsername"`
+	Year             FlexibleInt `json:"Year"`
+	// Artist, Album and TrackNumber are sent for Audio and MusicAlbum items
+	Artist      string      `json:"Artist"`
+	Album       string      `json:"Album"`
+	TrackNumber FlexibleInt `json:"TrackNumber"`
+	// RunTimeTicks and PlaybackPositionTicks give the length and stop position of the item in 100ns units
+	RunTimeTicks          int64 `json:"RunTimeTicks"`
+	PlaybackPositionTicks int64 `json:"PlaybackPositionTicks"`
+	// Played and SaveReason are sent with UserDataSaved notifications
+	Played     bool   `json:"Played"`
+	SaveReason string `json:"SaveReason"`
+	// ProviderIDs holds the Provider_* fields keyed by lowercase provider, e.g. "tvdb" or "imdb"
+	ProviderIDs map[string]string `json:"-"`
+}
+
+// maxJellyfinEpisodeSpan is the most episodes a single multi-episode item may cover, larger spans
+// in IndexNumberEnd are rejected rather than written as one file per episode
+const maxJellyfinEpisodeSpan = 10
+
+// episodeSpanValid reports whether IndexNumberEnd covers at most maxJellyfinEpisodeSpan episodes
+func (p JellyfinWebhookPayload) episodeSpanValid() bool {
+	return p.IndexNumberEnd <= p.EpisodeNumber || p.IndexNumberEnd-p.EpisodeNumber < maxJellyfinEpisodeSpan
+}
+
+// percentComplete returns how far the item was played, computed from the position and run time
+// ticks, or 0 if the run time is unknown
+func (p JellyfinWebhookPayload) percentComplete() int {
+	position := p.MediaStatus.PositionTicks
+	if position == 0 {
+		position = p.PlaybackPositionTicks
+	}
+	if p.RunTimeTicks <= 0 {
+		return 0
+	}
+	return int(position * 100 / p.RunTimeTicks)
+}
+
+// displayTitle returns "Series - Episode" for episodes and the item name otherwise
+func (p JellyfinWebhookPayload) displayTitle() string {
+	if p.SeriesName != "" {
+		return p.SeriesName + " - " + p.Title
+	}
+	return p.Title
+}
+
+// UnmarshalJSON decodes the known fields, trims whitespace including non-breaking spaces from the
+// titles and collects the Provider_* fields into ProviderIDs
+func (p *JellyfinWebhookPayload) UnmarshalJSON(data []byte) error {
+	type plain JellyfinWebhookPayload
+	if err := json.Unmarshal(data, (*plain)(p)); err != nil {
+		return err
+	}
+	p.Title = strings.TrimSpace(p.Title)
+	p.SeriesName = strings.TrimSpace(p.SeriesName)
+	p.Artist = strings.TrimSpace(p.Artist)
+	p.Album = strings.TrimSpace(p.Album)
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for key, raw := range fields {
+		provider, ok := strings.CutPrefix(key, "Provider_")
+		if !ok || provider == "" {
+			continue
+		}
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			// Some templates render IDs as bare numbers
+			value = strings.TrimSpace(string(raw))
+		}
+		if value == "" || value == "null" {
+			continue
+		}
+		if p.ProviderIDs == nil {
+			p.ProviderIDs = make(map[string]string)
+		}
+		p.ProviderIDs[strings.ToLower(provider)] = value
+	}
+	return nil
+}
+
+// FlexibleInt is an integer that can be decoded from a JSON number or a numeric string such as "01".
+// Zero-padding in the source is dropped here; padding is applied when the filename is built.
+// Fractional values such as 98.5 are rounded to the nearest integer.
+type FlexibleInt int
+
+// UnmarshalJSON accepts integers, floats, numeric strings, empty strings and null
+func (i *FlexibleInt) UnmarshalJSON(data []byte) error {
+	str := strings.TrimSpace(strings.Trim(strings.TrimSpace(string(data)), `"`))
+	if str == "" || str == "null" {
+		*i = 0
+		return nil
+	}
+	if value, err := strconv.Atoi(str); err == nil {
+		*i = FlexibleInt(value)
+		return nil
+	}
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return fmt.Errorf("invalid integer value %s: %w", data, err)
+	}
+	*i = FlexibleInt(math.Round(value))
+	return nil
+}
+
+// tautulliNumber is a json.Number that decodes an empty string as "0"
+type tautulliNumber json.Number
+
+func (n *tautulliNumber) UnmarshalJSON(data []byte) error {
+	if string(data) == `""` {
+		*n = "0"
+		return nil
+	}
+	return json.Unmarshal(data, (*json.Number)(n))
+}
+
+// tautulliFloat is a float64 that decodes an empty string as 0
+type tautulliFloat float64
+
+func (f *tautulliFloat) UnmarshalJSON(data []byte) error {
+	if string(data) == `""` {
+		*f = 0
+		return nil
+	}
+	return json.Unmarshal(data, (*float64)(f))
 }
 
 // TautulliResponse represents the response from Tautulli API
 type TautulliResponse struct {
 	Response struct {
-		Data struct {
+		Result  string `json:"result"`
+		Message string `json:"message"`
+		Data    struct {
 			Data []MediaData `json:"data"`
 		} `json:"data"`
 	} `json:"response"`
@@ -59,378 +924,1936 @@ type TautulliResponse struct {
 
 // MediaData represents the media data from Tautulli
 type MediaData struct {
+	// SchemaVersion identifies the shape of the written JSON for downstream consumers
+	SchemaVersion    int         `json:"schema_version,omitempty"`
+	RatingKey        FlexibleInt `json:"rating_key,omitempty"`
 	FullTitle        string      `json:"full_title"`
+	GrandparentTitle string      `json:"grandparent_title,omitempty"`
+	ParentTitle      string      `json:"parent_title,omitempty"`
+	Title            string      `json:"title,omitempty"`
 	ParentMediaIndex json.Number `json:"parent_media_index"`
 	MediaIndex       json.Number `json:"media_index"`
 	WatchedStatus    float64     `json:"watched_status"`
-	PercentComplete  int         `json:"percent_complete"`
+	PercentComplete  FlexibleInt `json:"percent_complete"`
+	MediaType        string      `json:"media_type,omitempty"`
+	Source           string      `json:"source,omitempty"`
+	WatchedAt        string      `json:"watched_at,omitempty"`
+	Rating           float64     `json:"user_rating,omitempty"`
+	Date             FlexibleInt `json:"date,omitempty"`
+	Stopped          FlexibleInt `json:"stopped,omitempty"`
+	User             string      `json:"user,omitempty"`
+	GUID             string      `json:"guid,omitempty"`
+	GUIDs            GUIDList    `json:"guids,omitempty"`
+	LibraryName      string      `json:"library_name,omitempty"`
+	// ProviderIDs maps metadata providers such as tvdb or imdb to the item's ID, taken from the
+	// guids for Plex and the Provider_* fields for Jellyfin
+	ProviderIDs map[string]string `json:"provider_ids,omitempty"`
+	// Year is written when the source reports it or TMDB enrichment finds it, TMDBID only when TMDB
+	// enrichment is enabled with TMDB_API_KEY
+	Year   FlexibleInt `json:"year,omitempty"`
+	TMDBID FlexibleInt `json:"tmdb_id,omitempty"`
+	// Duration is the time played in seconds as reported by get_history, not the length of the item.
+	// ViewOffset in milliseconds is the playback position. They and WatchedSeconds are only written
+	// when INCLUDE_DURATION is enabled
+	Duration       FlexibleInt `json:"duration,omitempty"`
+	ViewOffset     FlexibleInt `json:"view_offset,omitempty"`
+	WatchedSeconds int         `json:"watched_seconds,omitempty"`
+	// PlexClient is only written when INCLUDE_PLEX_HEADERS is enabled
+	PlexClient *PlexClient `json:"plex_client,omitempty"`
+	// ID identifies the watched event for downstream deduplication, only written when INCLUDE_ID is enabled
+	ID string `json:"id,omitempty"`
+	// Raw is the complete Tautulli row, only written when INCLUDE_RAW_METADATA is enabled
+	Raw json.RawMessage `json:"raw,omitempty"`
+}
+
+// UnmarshalJSON decodes the known fields, trims whitespace including non-breaking spaces from the
+// titles, keeps a copy of the complete row in Raw and extracts the provider IDs from the guids
+func (m *MediaData) UnmarshalJSON(data []byte) error {
+	// Tautulli sends empty strings for some numeric fields, these shadow the fields of plain
+	type plain MediaData
+	row := struct {
+		*plain
+		ParentMediaIndex tautulliNumber `json:"parent_media_index"`
+		MediaIndex       tautulliNumber `json:"media_index"`
+		WatchedStatus    tautulliFloat  `json:"watched_status"`
+	}{
+		plain:            (*plain)(m),
+		ParentMediaIndex: tautulliNumber(m.ParentMediaIndex),
+		MediaIndex:       tautulliNumber(m.MediaIndex),
+		WatchedStatus:    tautulliFloat(m.WatchedStatus),
+	}
+	if err := json.Unmarshal(data, &row); err != nil {
+		return err
+	}
+	m.ParentMediaIndex = json.Number(row.ParentMediaIndex)
+	m.MediaIndex = json.Number(row.MediaIndex)
+	m.WatchedStatus = float64(row.WatchedStatus)
+	m.FullTitle = strings.TrimSpace(m.FullTitle)
+	m.GrandparentTitle = strings.TrimSpace(m.GrandparentTitle)
+	m.ParentTitle = strings.TrimSpace(m.ParentTitle)
+	m.Title = strings.TrimSpace(m.Title)
+	m.Raw = append(json.RawMessage(nil), data...)
+	if ids := providerIDs(append([]string{m.GUID}, m.GUIDs...)...); ids != nil {
+		m.ProviderIDs = ids
+	}
+	return nil
+}
+
+// now returns the current time, replaceable in tests
+var now = time.Now
+
+// watchedAt returns the RFC3339 time the media was watched in the given location (UTC if nil),
+// preferring Tautulli's stopped or date epoch fields and falling back to the current time
+func watchedAt(data MediaData, loc *time.Location) string {
+	if loc == nil {
+		loc = time.UTC
+	}
+	switch {
+	case data.Stopped > 0:
+		return time.Unix(int64(data.Stopped), 0).In(loc).Format(time.RFC3339)
+	case data.Date > 0:
+		return time.Unix(int64(data.Date), 0).In(loc).Format(time.RFC3339)
+	default:
+		return now().In(loc).Format(time.RFC3339)
+	}
+}
+
+// Values for MediaData.Source
+const (
+	SourcePlex       = "plex"
+	SourceJellyfin   = "jellyfin"
+	SourceJellyseerr = "jellyseerr"
+)
+
+// newServer returns the HTTP server for the configured port and timeouts
+func newServer(config Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         fmt.Sprintf(":%d", config.Port),
+		Handler:      handler,
+		ReadTimeout:  config.ServerReadTimeout,
+		WriteTimeout: config.ServerWriteTimeout,
+		IdleTimeout:  config.ServerIdleTimeout,
+	}
 }
 
 func main() {
+	startTime = now()
+
 	// Load configuration from environment variables
 	config := loadConfig()
+	logOut, err := logOutput(config)
+	if err != nil {
+		log.Fatalf("Invalid LOG_FILE: %v", err)
+	}
+	log.SetFlags(0)
+	log.SetOutput(&timezoneLogWriter{out: logOut, loc: config.Location})
 
-	// Create HTTP server with routing
-	http.HandleFunc("/plex", func(w http.ResponseWriter, r *http.Request) {
-		handlePlexWebhook(w, r, config)
-	})
+	if config.TautulliMaxConcurrency > 0 {
+		tautulliSemaphore = make(chan struct{}, config.TautulliMaxConcurrency)
+	}
+	recent = newRecentEvents(config.RecentBufferSize)
+	if config.WriteWorkers > 0 {
+		writes = newWritePool(config.WriteWorkers, config.WriteQueueSize, config.WriteQueueTimeout)
+	}
 
-	http.HandleFunc("/jellyfin", func(w http.ResponseWriter, r *http.Request) {
-		handleJellyfinWebhook(w, r, config)
-	})
+	cache, err := newDedupCache(config.DedupTTL, config.DedupFile)
+	if err != nil {
+		log.Fatalf("Error loading dedup state: %v", err)
+	}
+	dedup = cache
 
-	// Default handler for backward compatibility
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// If the path is exactly "/", try to detect the webhook type from the content
-		if r.URL.Path == "/" {
-			contentType := r.Header.Get("Content-Type")
+	switch config.OutputBackend {
+	case OutputBackendS3:
+		writer, err := newS3Writer(config)
+		if err != nil {
+			log.Fatalf("Error configuring S3 output: %v", err)
+		}
+		output = writer
+		log.Printf("Writing output to S3 bucket %s", config.S3Bucket)
+	default:
+		for _, dir := range []string{config.OutputDir, config.PlexOutputDir, config.JellyfinOutputDir} {
+			if dir == "" {
+				continue
+			}
+			if err := checkOutputDir(dir); err != nil {
+				log.Fatalf("Output directory check failed: %v", err)
+			}
+		}
+	}
 
-			// Plex webhooks are typically sent as multipart/form-data
-			if strings.Contains(contentType, "multipart/form-data") {
-				if config.Debug {
-					log.Printf("Detected Plex webhook based on Content-Type")
-				}
-				handlePlexWebhook(w, r, config)
+	if config.TautulliStartupCheck {
+		if status, err := checkTautulli(config); err != nil {
+			log.Printf("Tautulli startup check failed (HTTP status %d): %v", status, err)
+		} else {
+			log.Printf("Tautulli startup check succeeded (HTTP status %d)", status)
+		}
+	}
+
+	// Start server
+	log.Printf("plex-clean version %s (commit %s, built %s)", version, commit, buildDate)
+	log.Printf("Server running on port %d", config.Port)
+	if sources := config.enabledWebhooks(); len(sources) > 0 {
+		log.Printf("Webhook support is enabled for %s", strings.Join(sources, ", "))
+	} else {
+		log.Printf("Warning: all webhook endpoints are disabled")
+	}
+	if config.JellyseerrEnabled && len(config.JellyseerrEvents) == 0 {
+		log.Printf("Warning: JELLYSEERR_EVENTS is empty, Jellyseerr webhooks are accepted but nothing is written")
+	}
+
+	router := newReloadableRouter(config)
+	server := newServer(config, logRequests(limitRequests(router, config), config))
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	// Stop background work and wait for a termination signal, then let in-flight requests finish
+	// before flushing the output
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if config.PollEnabled && config.PollInterval > 0 {
+		log.Printf("Polling Tautulli history every %s", config.PollInterval)
+		go pollTautulli(ctx, router.currentConfig)
+	}
+
+	// The backfill runs alongside the server, so webhooks are accepted while it catches up
+	if config.Backfill {
+		go func() {
+			processed, err := backfill(ctx, config)
+			if err != nil {
+				log.Printf("Error backfilling Tautulli history: %v", err)
+				return
+			}
+			log.Printf("Backfill recorded %d completed items from Tautulli history", processed)
+		}()
+	}
+
+	// SIGHUP re-reads the configuration, invalid settings keep the running one
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
 				return
+			case <-hup:
+				next, err := readConfig()
+				if err != nil {
+					log.Printf("Error reloading configuration, keeping the running one: %v", err)
+					continue
+				}
+				router.reload(next)
+				log.Printf("Configuration reloaded")
 			}
+		}
+	}()
+
+	<-ctx.Done()
+
+	log.Printf("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
+	if writes != nil {
+		writes.Close()
+	}
+	if err := output.Close(); err != nil {
+		log.Printf("Error closing output: %v", err)
+	}
+}
+
+// newRouter registers all routes, including the webhook type autodetection on "/"
+func newRouter(config Config) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	if !config.PlexDisabled {
+		mux.HandleFunc("/plex", func(w http.ResponseWriter, r *http.Request) {
+			handlePlexWebhook(w, r, config)
+		})
+	}
+
+	if !config.JellyfinDisabled {
+		mux.HandleFunc("/jellyfin", func(w http.ResponseWriter, r *http.Request) {
+			handleJellyfinWebhook(w, r, config)
+		})
+	}
+
+	if config.JellyseerrEnabled {
+		mux.HandleFunc("/jellyseerr", func(w http.ResponseWriter, r *http.Request) {
+			handleJellyseerrWebhook(w, r, config)
+		})
+	}
+
+	if config.EchoEnabled {
+		mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+			handleEcho(w, r, config)
+		})
+	}
+
+	mux.HandleFunc("/stats", handleStats)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/version", handleVersion)
+	mux.HandleFunc("/recent", handleRecent)
+
+	// Default handler for backward compatibility
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// Health checkers probe "/" with GET, which is answered with a status instead of an error
+		if r.URL.Path == "/" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			handleStatus(w, r)
+			return
+		}
+
+		// If the path is exactly "/", try to detect the webhook type from the content. The sender is
+		// checked first, so that the body is only read for allowed and authenticated requests.
+		if r.URL.Path == "/" {
+			if !allowWebhookSource(w, r, config) || !authorizeWebhook(w, r, config) {
+				return
+			}
+			logger := requestLogger(r.Context())
+			r.Body = http.MaxBytesReader(w, r.Body, config.maxBodyBytes())
+			source, err := detectWebhookSource(r, config)
+			var tooLarge *http.MaxBytesError
+			switch {
+			case errors.As(err, &tooLarge):
+				logger.Printf("Webhook body exceeds %d bytes, rejecting", tooLarge.Limit)
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			case err != nil:
+				logger.Printf("Error reading webhook body: %v", err)
+				http.Error(w, "Error reading request body", http.StatusBadRequest)
+			case source == SourcePlex && config.PlexDisabled, source == SourceJellyfin && config.JellyfinDisabled:
+				if config.Debug {
+					logger.Printf("Detected %s webhook, but the source is disabled", source)
+				}
+				http.NotFound(w, r)
+			case source == SourcePlex:
+				if config.Debug {
+					logger.Printf("Detected Plex webhook")
+				}
+				handlePlexWebhook(w, r, config)
+			case source == SourceJellyfin:
+				if config.Debug {
+					logger.Printf("Detected Jellyfin webhook")
+				}
+				handleJellyfinWebhook(w, r, config)
+			default:
+				// If we can't determine the type, return an error
+				logger.Printf("Unable to determine webhook type from request")
+				http.Error(w, "Unable to determine webhook type", http.StatusBadRequest)
+			}
+			return
+		}
+
+		// For any other path, return 404
+		http.NotFound(w, r)
+	})
+
+	return mux
+}
+
+// detectWebhookSource decides whether a request on "/" comes from Plex or Jellyfin. It looks at the
+// decoded payload, so that either sender works with multipart or JSON bodies, and falls back to the
+// Content-Type when the payload is inconclusive. The body is restored for the chosen handler.
+func detectWebhookSource(r *http.Request, config Config) (string, error) {
+	contentType := r.Header.Get("Content-Type")
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	payload := body
+	if strings.Contains(contentType, "multipart/form-data") {
+		payload = []byte(multipartPayload(body, contentType, config.multipartMaxMemory()))
+	}
+
+	// Field names are compared exactly, encoding/json would match Plex's "event" to Jellyfin's "Event"
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(payload, &fields) == nil {
+		_, hasMetadata := fields["Metadata"]
+		_, hasPlexEvent := fields["event"]
+		_, hasNotificationType := fields["NotificationType"]
+		_, hasJellyfinEvent := fields["Event"]
+		switch {
+		case hasMetadata || hasPlexEvent:
+			return SourcePlex, nil
+		case hasNotificationType || hasJellyfinEvent:
+			return SourceJellyfin, nil
+		}
+	}
+
+	switch {
+	case strings.Contains(contentType, "multipart/form-data"):
+		return SourcePlex, nil
+	case strings.Contains(contentType, "application/json"):
+		return SourceJellyfin, nil
+	}
+	return "", nil
+}
+
+// multipartPayload returns the "payload" field of a multipart body, or the first field if there is
+// none, without consuming the request
+func multipartPayload(body []byte, contentType string, maxMemory int64) string {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	form, err := multipart.NewReader(bytes.NewReader(body), params["boundary"]).ReadForm(maxMemory)
+	if err != nil {
+		return ""
+	}
+	defer func() {
+		_ = form.RemoveAll()
+	}()
+	return firstFormValue(form, "payload")
+}
+
+// firstFormValue returns the named form value, falling back to the first non-empty value in
+// alphabetical field order
+func firstFormValue(form *multipart.Form, name string) string {
+	if values := form.Value[name]; len(values) > 0 && values[0] != "" {
+		return values[0]
+	}
+	keys := slices.Sorted(maps.Keys(form.Value))
+	for _, key := range keys {
+		if values := form.Value[key]; len(values) > 0 && values[0] != "" {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// handlePlexWebhook processes Plex webhook requests
+func handlePlexWebhook(w http.ResponseWriter, r *http.Request, config Config) {
+	logger := requestLogger(r.Context())
+
+	if !allowWebhookSource(w, r, config) {
+		return
+	}
+
+	debugGet := r.Method == http.MethodGet && config.DebugAcceptGet
+	if r.Method != http.MethodPost && !debugGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !authorizeWebhook(w, r, config) {
+		return
+	}
+
+	stats.PlexEvents.Add(1)
+	auditWebhook(r, config, SourcePlex)
+	forwardWebhook(r, config)
+
+	var payloadStr string
+	var err error
+	if debugGet {
+		logger.Printf("Warning: building a Plex payload from the query of GET %s, DEBUG_ACCEPT_GET is for manual testing only", r.URL.Path)
+		payloadStr, err = plexQueryPayload(r.URL.Query())
+	} else {
+		payloadStr, err = readPlexPayload(r, config.multipartMaxMemory())
+	}
+	if err != nil {
+		logger.Printf("Error reading Plex payload: %v", err)
+		http.Error(w, "Error reading payload", http.StatusBadRequest)
+		return
+	}
+
+	// Parse payload
+	var payload PlexWebhookPayload
+	if err := json.Unmarshal([]byte(payloadStr), &payload); err != nil {
+		logger.Printf("Error unmarshaling Plex payload: %v", err)
+		http.Error(w, "Error parsing payload", http.StatusBadRequest)
+		return
+	}
+	payload.Event = config.plexEvent(payload.Event)
+
+	if config.ValidateOnly {
+		respondValidation(w, validatePlexPayload(payload, config))
+		return
+	}
+
+	// Check if this is an event we process
+	if !config.plexEventEnabled(payload.Event) {
+		countIgnored(IgnoreReasonEventType)
+		if config.Debug {
+			logger.Printf("Ignoring Plex event: %s", payload.Event)
+		}
+		respondIgnored(w, r, "event not subscribed")
+		return
+	}
+
+	// Check if metadata is present
+	if payload.Metadata.Key == "" {
+		countIgnored(IgnoreReasonNoMetadata)
+		if config.Debug {
+			logger.Printf("Invalid Plex request, No metadata found")
+		}
+		respondIgnored(w, r, "no metadata")
+		return
+	}
+
+	// A resumed or restarted item is being watched again, so its partial record is stale
+	if payload.Event == PlexEventResume || payload.Event == PlexEventPlay {
+		removePartialRecords(r.Context(), config, extractKeyFromPath(payload.Metadata.Key))
+		respondOK(w)
+		return
+	}
+
+	// New library items have no play history yet, so they are looked up directly
+	if payload.Event == PlexEventLibraryNew {
+		handlePlexLibraryNew(w, r, payload, config)
+		return
+	}
+
+	var mediaData []MediaData
+	if config.PlexSkipTautulliMovies && payload.Metadata.Type == "movie" {
+		// The webhook already carries everything needed for a movie
+		if config.Debug {
+			logger.Printf("Building movie %q from the Plex webhook, skipping Tautulli", payload.Metadata.Title)
+		}
+		mediaData = []MediaData{payload.Metadata.mediaData()}
+	} else {
+		// Fetch metadata from Tautulli, waiting for a free slot if too many requests are in flight.
+		// The slot is only held per query, not while waiting to retry.
+		mediaData, err = fetchMetadata(r.Context(), payload.Metadata.Key, config)
+		for attempt := 0; err == nil && len(mediaData) == 0 && config.EmptyDataBehavior == EmptyDataRetry && attempt < config.EmptyDataRetries; attempt++ {
+			if config.Debug {
+				logger.Printf("No entries found in Tautulli for metadata key %s yet, retrying in %s", payload.Metadata.Key, config.EmptyDataRetryDelay)
+			}
+			if err = sleepContext(r.Context(), config.EmptyDataRetryDelay); err == nil {
+				mediaData, err = fetchMetadata(r.Context(), payload.Metadata.Key, config)
+			}
+		}
+		if errors.Is(err, errNoTautulliSlot) {
+			logger.Printf("Error fetching metadata from Tautulli: %v", err)
+			http.Error(w, "Request cancelled", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error fetching metadata from Tautulli: %v", err)
+			http.Error(w, "Error fetching metadata", fetchErrorStatus(err))
+			return
+		}
+	}
+
+	if len(mediaData) == 0 && config.EmptyDataBehavior == EmptyDataFail {
+		logger.Printf("No entries found in Tautulli for metadata key %s, asking Plex to retry", payload.Metadata.Key)
+		http.Error(w, "No history found", http.StatusInternalServerError)
+		return
+	}
+
+	if len(mediaData) == 0 {
+		countIgnored(IgnoreReasonEmptyData)
+		if config.Debug {
+			logger.Printf("No entries found in Tautulli for metadata key: %s", payload.Metadata.Key)
+		}
+		respondIgnored(w, r, "no history found")
+		return
+	} else if config.Debug {
+		logger.Printf("Found %d entries for %s", len(mediaData), payload.Metadata.Key)
+	}
+
+	// Process media data. Failed writes are acknowledged unless FAIL_ON_WRITE_ERROR asks Plex to retry,
+	// and the event is reported as ignored when every row was skipped.
+	var client *PlexClient
+	if config.IncludePlexHeaders {
+		client = plexClient(r)
+	}
+	var writeErr error
+	var written bool
+	var ignoredReason string
+	for _, data := range mediaData {
+		data.PlexClient = client
+		// The webhook's account is the most reliable identity, Tautulli's user is the fallback
+		if payload.Account.Title != "" {
+			data.User = payload.Account.Title
+		}
+		// Tautulli's history has no library name, the webhook does
+		if data.LibraryName == "" {
+			data.LibraryName = payload.Metadata.LibrarySectionTitle
+		}
+		reason, err := processPlexRow(r.Context(), config, payload.Event, payload.Metadata.Rating, data)
+		switch {
+		case err != nil:
+			writeErr = err
+		case reason != "":
+			if ignoredReason == "" {
+				ignoredReason = reason
+			}
+		default:
+			written = true
+		}
+		recent.add(SourcePlex, data.FullTitle, reason, err)
+	}
+	if writeErr != nil && config.FailOnWriteError {
+		respondWriteError(w, r, writeErr, config)
+		return
+	}
+	if !written && writeErr == nil {
+		respondIgnored(w, r, ignoredReason)
+		return
+	}
+
+	respondOK(w)
+}
+
+// processPlexRow records a single Tautulli history row for a Plex event. It returns the reason the
+// row was skipped, or the error of a failed write; both are empty when the row was written.
+func processPlexRow(ctx context.Context, config Config, event string, rating float64, data MediaData) (string, error) {
+	logger := requestLogger(ctx)
+
+	if !config.mediaTypeAllowed(data.MediaType) {
+		countIgnored(IgnoreReasonMediaType)
+		if config.Debug {
+			logger.Printf("Media %q has media type %s, ignoring", data.FullTitle, data.MediaType)
+		}
+		return "media type not allowed", nil
+	}
+
+	// Convert ParentMediaIndex and MediaIndex to integers
+	parentMediaIndex, err := data.ParentMediaIndex.Int64()
+	if err != nil {
+		logger.Printf("Error converting ParentMediaIndex to int: %v", err)
+		return "invalid season number", nil
+	}
+	mediaIndex, err := data.MediaIndex.Int64()
+	if err != nil {
+		logger.Printf("Error converting MediaIndex to int: %v", err)
+		return "invalid episode number", nil
+	}
+
+	// Unmatched items come back from Tautulli as season 0 episode 0, movies legitimately do too
+	if config.SkipZeroIndex && data.MediaType == "episode" && parentMediaIndex == 0 && mediaIndex == 0 {
+		countIgnored(IgnoreReasonZeroIndex)
+		logger.Printf("Warning: Tautulli returned season 0 episode 0 for episode %q, skipping", data.FullTitle)
+		return "season 0 episode 0", nil
+	}
+
+	if config.titleIgnored(data.FullTitle, data.GrandparentTitle) {
+		countIgnored(IgnoreReasonTitle)
+		if config.Debug {
+			logger.Printf("Media %q matches IGNORE_TITLE_REGEX, ignoring", data.FullTitle)
+		}
+		return "title ignored", nil
+	}
+
+	watched := config.plexWatched(data)
+	if event == PlexEventRate {
+		filename := config.outputFilename(config.episodeBaseName(data, parentMediaIndex, mediaIndex, config.normalizeTitle(data)) + " - rated")
+		logger.Printf("Media rated %.1f in Plex, writing to file %s", rating, filename)
+
+		data.Source = SourcePlex
+		data.Rating = rating
+		outputPath, err := writeMediaData(ctx, config, config.plexOutputDir(), filename, data)
+		if err != nil {
+			logger.Printf("Error writing media data: %v", err)
+			return "", err
+		}
+		if outputPath != "" {
+			logger.Printf("Wrote %s", outputPath)
+		}
+	} else if watched && int(data.PercentComplete) < config.MinPercentComplete {
+		countIgnored(IgnoreReasonBelowMinPercent)
+		if config.Debug {
+			logger.Printf("Media only %d%% complete (minimum %d%%), ignoring", data.PercentComplete, config.MinPercentComplete)
+		}
+		return "below minimum percent complete", nil
+	} else if watched && config.DedupWebhooks && dedup.Seen(plexDedupKey(data)) {
+		countIgnored(IgnoreReasonDuplicate)
+		if config.Debug {
+			logger.Printf("Media %s already recorded, ignoring repeat", data.FullTitle)
+		}
+		return "duplicate", nil
+	} else if watched {
+		filename := config.outputFilename(config.episodeBaseName(data, parentMediaIndex, mediaIndex, config.normalizeTitle(data)))
+		logger.Printf("Media marked as watched by Plex, writing to file %s", filename)
+
+		data.Source = SourcePlex
+		data.WatchedAt = watchedAt(data, config.Location)
+		outputPath, err := writeMediaData(ctx, config, config.plexOutputDir(), filename, data)
+		if err != nil {
+			logger.Printf("Error writing media data: %v", err)
+			return "", err
+		}
+		dedup.Mark(plexDedupKey(data))
+		if outputPath != "" {
+			logger.Printf("Wrote %s", outputPath)
+		}
+	} else if config.partiallyWatched(int(data.PercentComplete)) {
+		filename := config.outputFilename(config.episodeBaseName(data, parentMediaIndex, mediaIndex, config.normalizeTitle(data)))
+		logger.Printf("Media partially watched (%d%%) in Plex, writing to file %s", data.PercentComplete, filename)
+
+		data.Source = SourcePlex
+		data.WatchedAt = watchedAt(data, config.Location)
+		outputPath, err := writeMediaData(ctx, config, config.PartialDir, filename, data)
+		if err != nil {
+			logger.Printf("Error writing media data: %v", err)
+			return "", err
+		}
+		if outputPath != "" {
+			logger.Printf("Wrote %s", outputPath)
+		}
+	} else {
+		countIgnored(IgnoreReasonNotCompleted)
+		if config.Debug {
+			logger.Printf("Media not marked as watched by Plex, ignoring")
+		}
+		return "not watched", nil
+	}
+	return "", nil
+}
+
+// plexDedupKey identifies a Plex item in the dedup cache
+func plexDedupKey(data MediaData) string {
+	return fmt.Sprintf("%s|%s|S%sE%s", SourcePlex, data.FullTitle, data.ParentMediaIndex, data.MediaIndex)
+}
+
+// readPlexPayload returns the raw JSON payload of a Plex webhook. Plex itself sends a multipart
+// form with a "payload" field, while some proxies and test tools post the JSON body directly.
+func readPlexPayload(r *http.Request, maxMemory int64) (string, error) {
+	if strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return "", fmt.Errorf("error reading request body: %w", err)
+		}
+		if len(bytes.TrimSpace(body)) == 0 {
+			return "", errors.New("no payload found")
+		}
+		return string(body), nil
+	}
+
+	// Parse multipart form
+	if err := r.ParseMultipartForm(maxMemory); err != nil {
+		return "", fmt.Errorf("error parsing multipart form: %w", err)
+	}
+
+	// Get payload from form
+	payloadStr := r.FormValue("payload")
+	if payloadStr == "" {
+		return "", errors.New("no payload found")
+	}
+	return payloadStr, nil
+}
+
+// plexQueryPayload builds a Plex webhook payload from the event and key query parameters of a
+// DEBUG_ACCEPT_GET request
+func plexQueryPayload(query url.Values) (string, error) {
+	payload := PlexWebhookPayload{
+		Event:    query.Get("event"),
+		Metadata: PlexMetadata{Key: query.Get("key")},
+	}
+	if payload.Event == "" {
+		return "", errors.New("no event query parameter")
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// readJellyfinPayload returns the JSON payload of a Jellyfin webhook, sent either as the request
+// body or as a multipart form field
+func readJellyfinPayload(r *http.Request, maxMemory int64) ([]byte, error) {
+	if !strings.Contains(r.Header.Get("Content-Type"), "multipart/form-data") {
+		return io.ReadAll(r.Body)
+	}
+	if err := r.ParseMultipartForm(maxMemory); err != nil {
+		return nil, fmt.Errorf("error parsing multipart form: %w", err)
+	}
+	payload := firstFormValue(r.MultipartForm, "payload")
+	if payload == "" {
+		return nil, errors.New("no payload found")
+	}
+	return []byte(payload), nil
+}
+
+// handlePlexLibraryNew records a newly added Plex item as unwatched in the new media directory
+func handlePlexLibraryNew(w http.ResponseWriter, r *http.Request, payload PlexWebhookPayload, config Config) {
+	logger := requestLogger(r.Context())
+
+	if err := acquireTautulli(r.Context()); err != nil {
+		logger.Printf("Gave up waiting for a Tautulli slot: %v", err)
+		http.Error(w, "Request cancelled", http.StatusServiceUnavailable)
+		return
+	}
+	data, err := fetchLibraryMetadata(r.Context(), payload.Metadata.Key, config)
+	releaseTautulli()
+	if err != nil {
+		logger.Printf("Error fetching metadata from Tautulli: %v", err)
+		http.Error(w, "Error fetching metadata", fetchErrorStatus(err))
+		return
+	}
+
+	if data == nil {
+		countIgnored(IgnoreReasonNoMetadata)
+		if config.Debug {
+			logger.Printf("No metadata found in Tautulli for new item: %s", payload.Metadata.Key)
+		}
+		respondIgnored(w, r, "no metadata found")
+		return
+	}
+
+	parentMediaIndex, _ := data.ParentMediaIndex.Int64()
+	mediaIndex, _ := data.MediaIndex.Int64()
+	filename := config.outputFilename(config.episodeBaseName(*data, parentMediaIndex, mediaIndex, config.normalizeTitle(*data)))
+	logger.Printf("Media added to Plex, writing to file %s", filename)
+
+	data.WatchedStatus = 0
+	data.Source = SourcePlex
+	if config.IncludePlexHeaders {
+		data.PlexClient = plexClient(r)
+	}
+	outputPath, err := writeMediaData(r.Context(), config, config.newMediaDir(), filename, *data)
+	if err != nil {
+		respondWriteError(w, r, err, config)
+		return
+	}
+	if outputPath != "" {
+		logger.Printf("Wrote %s", outputPath)
+	}
+
+	respondOK(w)
+}
+
+// handleJellyfinWebhook processes Jellyfin webhook requests
+func handleJellyfinWebhook(w http.ResponseWriter, r *http.Request, config Config) {
+	logger := requestLogger(r.Context())
+
+	if !allowWebhookSource(w, r, config) {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !authorizeWebhook(w, r, config) {
+		return
+	}
+
+	stats.JellyfinEvents.Add(1)
+	auditWebhook(r, config, SourceJellyfin)
+	forwardWebhook(r, config)
+
+	// Read the request body
+	body, err := readJellyfinPayload(r, config.multipartMaxMemory())
+	if err != nil {
+		logger.Printf("Error reading Jellyfin request body: %v", err)
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			logger.Printf("Error closing Jellyfin request body: %v", err)
+		}
+	}(r.Body)
+
+	// Batches coalesced by a proxy arrive as a JSON array of events
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		handleJellyfinBatch(w, r, body, config)
+		return
+	}
+
+	// Parse the JSON payload
+	payload, err := decodeJellyfinPayload(body, config.StrictJSON)
+	if err != nil {
+		logJellyfinDecodeError(logger, body, err, config)
+		http.Error(w, "Error parsing payload", http.StatusBadRequest)
+		return
+	}
+
+	if config.ValidateOnly {
+		respondValidation(w, validateJellyfinPayload(payload, config))
+		return
+	}
+
+	reason, err := processJellyfinEvent(r.Context(), config, payload)
+	recent.add(SourceJellyfin, payload.displayTitle(), reason, err)
+	if err != nil {
+		respondWriteError(w, r, err, config)
+		return
+	}
+	if reason != "" {
+		respondIgnored(w, r, reason)
+		return
+	}
+
+	respondOK(w)
+}
+
+// BatchResponse summarizes the outcome of a batch of Jellyfin events
+type BatchResponse struct {
+	Processed int `json:"processed"`
+	Ignored   int `json:"ignored"`
+	Failed    int `json:"failed"`
+}
+
+// handleJellyfinBatch processes every event of a JSON array body and responds with a summary. Events
+// that cannot be decoded or written are counted as failed without stopping the rest of the batch.
+func handleJellyfinBatch(w http.ResponseWriter, r *http.Request, body []byte, config Config) {
+	logger := requestLogger(r.Context())
+
+	var events []json.RawMessage
+	if err := json.Unmarshal(body, &events); err != nil {
+		logJellyfinDecodeError(logger, body, err, config)
+		http.Error(w, "Error parsing payload", http.StatusBadRequest)
+		return
+	}
+	// The request itself was already counted as one event
+	stats.JellyfinEvents.Add(int64(len(events) - 1))
+
+	var summary BatchResponse
+	var validations []ValidationSummary
+	var writeErr error
+	for _, event := range events {
+		payload, err := decodeJellyfinPayload(event, config.StrictJSON)
+		if err != nil {
+			logJellyfinDecodeError(logger, event, err, config)
+			summary.Failed++
+			validations = append(validations, ValidationSummary{Source: SourceJellyfin, Problems: []string{err.Error()}})
+			continue
+		}
+		if config.ValidateOnly {
+			validations = append(validations, validateJellyfinPayload(payload, config))
+			continue
+		}
+		reason, err := processJellyfinEvent(r.Context(), config, payload)
+		recent.add(SourceJellyfin, payload.displayTitle(), reason, err)
+		switch {
+		case err != nil:
+			writeErr = err
+			summary.Failed++
+		case reason != "":
+			summary.Ignored++
+		default:
+			summary.Processed++
+		}
+	}
+	if config.ValidateOnly {
+		respondValidation(w, validations)
+		return
+	}
+	if config.Debug {
+		logger.Printf("Processed Jellyfin batch of %d events: %d written, %d ignored, %d failed",
+			len(events), summary.Processed, summary.Ignored, summary.Failed)
+	}
+	if writeErr != nil {
+		respondWriteError(w, r, writeErr, config)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		logger.Printf("Error writing response: %v", err)
+	}
+}
+
+// logJellyfinDecodeError logs a payload that could not be decoded, with the offending field and
+// offset in debug mode
+func logJellyfinDecodeError(logger *log.Logger, body []byte, err error, config Config) {
+	if config.Debug {
+		logger.Printf("Error unmarshaling Jellyfin payload: %s", describeJSONError(body, err))
+	} else {
+		logger.Printf("Error unmarshaling Jellyfin payload: %v", err)
+	}
+}
+
+// processJellyfinEvent records a single decoded Jellyfin event. It returns the reason the event was
+// ignored, or the error of a failed write; both are empty when the event was written.
+func processJellyfinEvent(ctx context.Context, config Config, payload JellyfinWebhookPayload) (string, error) {
+	logger := requestLogger(ctx)
+
+	// Check if this is an enabled event
+	event := config.jellyfinEvent(payload)
+	if !config.jellyfinEventEnabled(event) {
+		countIgnored(IgnoreReasonEventType)
+		if config.Debug {
+			logger.Printf("Ignoring Jellyfin event: %s/%s", payload.Event, payload.NotificationType)
+		}
+		return "event not subscribed", nil
+	}
+
+	resolveSeriesName(config, &payload)
+	if config.titleIgnored(payload.Title, payload.SeriesName) {
+		countIgnored(IgnoreReasonTitle)
+		if config.Debug {
+			logger.Printf("Jellyfin media %q matches IGNORE_TITLE_REGEX, ignoring", payload.Title)
+		}
+		return "title ignored", nil
+	}
+
+	// Check if the media was played to completion or marked as played
+	var watched bool
+	switch event {
+	case JellyfinEventPlaybackStop:
+		// Jellyfin does not set PlayedToCompletion for items stopped just before the end
+		watched = payload.MediaStatus.PlayedToCompletion ||
+			(config.JellyfinCompletionPercent > 0 && payload.percentComplete() >= config.JellyfinCompletionPercent)
+	case JellyfinEventUserDataSaved:
+		// Finished playback also saves user data, only a manual toggle is a new transition to played
+		watched = payload.Played && (payload.SaveReason == "" || payload.SaveReason == "TogglePlayed")
+	}
+	if !watched {
+		countIgnored(IgnoreReasonNotCompleted)
+		if config.Debug {
+			logger.Printf("Jellyfin media not played to completion, ignoring")
+		}
+		return "not played to completion", nil
+	}
+
+	switch {
+	case payload.ItemType == "Episode" && payload.SeriesName != "":
+		// For episodes, use series name, season, and episode. Multi-episode files report
+		// the last episode they cover in IndexNumberEnd, so write one file per episode.
+		if !payload.episodeSpanValid() {
+			countIgnored(IgnoreReasonEpisodeSpan)
+			logger.Printf("Warning: Jellyfin episode %q spans episodes %d to %d, more than %d; no file written",
+				payload.Title, payload.EpisodeNumber, payload.IndexNumberEnd, maxJellyfinEpisodeSpan)
+			return "episode span too large", nil
+		}
+		lastEpisode := max(payload.EpisodeNumber, payload.IndexNumberEnd)
+		for episode := payload.EpisodeNumber; episode <= lastEpisode; episode++ {
+			// Create a MediaData object to maintain consistency with Plex
+			mediaData := MediaData{
+				FullTitle:        payload.SeriesName + " - " + payload.Title,
+				GrandparentTitle: payload.SeriesName,
+				Title:            payload.Title,
+				ParentMediaIndex: json.Number(strconv.Itoa(int(payload.SeasonNumber))),
+				MediaIndex:       json.Number(strconv.Itoa(int(episode))),
+				WatchedStatus:    1.0, // Marked as watched
+				PercentComplete:  100, // Assuming 100% complete
+				Source:           SourceJellyfin,
+			}
+
+			mediaData.WatchedAt = watchedAt(mediaData, config.Location)
+			mediaData.ProviderIDs = payload.ProviderIDs
+			mediaData.User = payload.User
+
+			filename := config.outputFilename(config.episodeBaseName(mediaData, int64(payload.SeasonNumber), int64(episode), payload.SeriesName))
+			logger.Printf("Media marked as watched by Jellyfin, writing to file %s", filename)
+
+			outputPath, err := writeMediaData(ctx, config, config.jellyfinOutputDir(), filename, mediaData)
+			if err != nil {
+				return "", err
+			}
+			if outputPath != "" {
+				logger.Printf("Wrote %s", outputPath)
+			}
+		}
+	case payload.ItemType == "Movie":
+		// Handle movies
+		mediaData := MediaData{
+			FullTitle:        payload.Title,
+			ParentMediaIndex: json.Number("0"), // No season for movies
+			MediaIndex:       json.Number("0"), // No episode for movies
+			MediaType:        "movie",
+			WatchedStatus:    1.0, // Marked as watched
+			PercentComplete:  100, // Assuming 100% complete
+			Year:             payload.Year,
+			Source:           SourceJellyfin,
+		}
+
+		mediaData.WatchedAt = watchedAt(mediaData, config.Location)
+		mediaData.ProviderIDs = payload.ProviderIDs
+		mediaData.User = payload.User
+
+		filename := config.outputFilename(pathSafe(payload.Title))
+		logger.Printf("Movie marked as watched by Jellyfin, writing to file %s", filename)
+
+		outputPath, err := writeMediaData(ctx, config, config.jellyfinOutputDir(), filename, mediaData)
+		if err != nil {
+			return "", err
+		}
+		if outputPath != "" {
+			logger.Printf("Wrote %s", outputPath)
+		}
+	case config.JellyfinMusicEnabled && (payload.ItemType == "Audio" || payload.ItemType == "MusicAlbum"):
+		// Music uses Tautulli's track layout: artist as grandparent, album as parent, track as title
+		mediaData := MediaData{
+			GrandparentTitle: payload.Artist,
+			ParentTitle:      payload.Album,
+			Title:            payload.Title,
+			ParentMediaIndex: json.Number("0"),
+			MediaIndex:       json.Number(strconv.Itoa(int(payload.TrackNumber))),
+			MediaType:        "track",
+			WatchedStatus:    1.0, // Marked as watched
+			PercentComplete:  100, // Assuming 100% complete
+			Source:           SourceJellyfin,
+		}
+		parts := []string{payload.Artist, payload.Album, payload.Title}
+		if payload.ItemType == "MusicAlbum" {
+			// The album is the item itself, so its name arrives as the title
+			mediaData.MediaType = "album"
+			mediaData.ParentTitle = payload.Title
+			mediaData.Title = ""
+			parts = []string{payload.Artist, payload.Title}
+		}
+		mediaData.FullTitle = payload.Title
+		if payload.Artist != "" {
+			mediaData.FullTitle = payload.Artist + " - " + payload.Title
+		}
+		mediaData.WatchedAt = watchedAt(mediaData, config.Location)
+		mediaData.ProviderIDs = payload.ProviderIDs
+		mediaData.User = payload.User
+
+		// Kodi NFO files have no music equivalent of <episodedetails>, so music is always JSON
+		musicConfig := config
+		musicConfig.OutputFormat = OutputFormatJSON
+		parts = slices.DeleteFunc(parts, func(part string) bool { return part == "" })
+		filename := musicConfig.outputFilename(pathSafe(strings.Join(parts, " - ")))
+		logger.Printf("Music marked as played by Jellyfin, writing to file %s", filename)
+
+		outputPath, err := writeMediaData(ctx, musicConfig, musicConfig.musicOutputDir(), filename, mediaData)
+		if err != nil {
+			return "", err
+		}
+		if outputPath != "" {
+			logger.Printf("Wrote %s", outputPath)
+		}
+	case payload.ItemType == "Season" || payload.ItemType == "Series":
+		// Jellyfin does not include the child episodes in the payload, so there is nothing to write
+		countIgnored(IgnoreReasonNoEpisodeInfo)
+		logger.Printf("Warning: Jellyfin %s %q marked as played, but the payload carries no episode information; no file written",
+			payload.ItemType, payload.Title)
+		return "no episode information", nil
+	default:
+		countIgnored(IgnoreReasonUnsupportedType)
+		if config.Debug {
+			logger.Printf("Unsupported Jellyfin item type: %s", payload.ItemType)
+		}
+		return "unsupported item type", nil
+	}
+
+	return "", nil
+}
+
+// respondOK acknowledges a webhook with a plain 200 OK
+func respondOK(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte("OK")); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// IgnoredResponse is returned for ignored webhooks to clients that accept JSON
+type IgnoredResponse struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// respondIgnored acknowledges a webhook that was not processed. Clients that accept JSON get a
+// body naming the reason so that they can tell ignored events apart, everyone else a plain OK.
+func respondIgnored(w http.ResponseWriter, r *http.Request, reason string) {
+	if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		respondOK(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(IgnoredResponse{Status: "ignored", Reason: reason}); err != nil {
+		requestLogger(r.Context()).Printf("Error writing response: %v", err)
+	}
+}
+
+// writeMediaData writes the media data into dir through the active OutputWriter, applying the
+// configured conflict behavior. It returns the path that was written, or an empty string if the
+// write was skipped or queued with ASYNC_WRITES. Concurrent writes for the same filename are serialized.
+func writeMediaData(ctx context.Context, config Config, dir, filename string, data MediaData) (string, error) {
+	if writes != nil {
+		return writes.write(ctx, config, dir, filename, data, config.AsyncWrites)
+	}
+	return writeMediaDataNow(ctx, config, dir, filename, data)
+}
+
+// writeMediaDataNow performs a writeMediaData in the calling goroutine
+func writeMediaDataNow(ctx context.Context, config Config, dir, filename string, data MediaData) (string, error) {
+	logger := requestLogger(ctx)
+
+	path := filepath.Join(dir, filename)
+	unlock := lockPath(path)
+	defer unlock()
+
+	outputPath, ok, err := resolveOutputPath(path, config.outputExtension(), config.OnConflict)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		logger.Printf("File %s already exists, skipping", filename)
+		return "", nil
+	}
+	ratingKey := data.RatingKey
+
+	if config.TMDBAPIKey != "" {
+		enrichMovie(ctx, config, &data)
+	} else {
+		data.TMDBID = 0
+	}
+	if !config.IncludeRawMetadata {
+		data.Raw = nil
+	}
+	if !config.IncludeProviderIDs {
+		data.ProviderIDs = nil
+	}
+	if config.IncludeID {
+		data.ID = mediaID(data)
+	}
+	if config.IncludeDuration {
+		data.WatchedSeconds = watchedSeconds(data)
+	} else {
+		data.Duration, data.ViewOffset, data.WatchedSeconds = 0, 0, 0
+	}
+	if config.schemaVersion() == SchemaVersionLegacy {
+		data = data.legacy()
+	}
+	data.SchemaVersion = config.schemaVersion()
+	if err := output.Write(data, outputPath); err != nil {
+		return "", err
+	}
+	if dir == config.PartialDir {
+		partials.add(ratingKey, outputPath)
+	} else {
+		partials.forget(ratingKey)
+	}
+	stats.FilesWritten.Add(1)
+	runPostWriteCmd(ctx, config, outputPath, data)
+	return outputPath, nil
+}
+
+// legacy returns the data reduced to the fields of schema version 1, for consumers that predate
+// the later additions
+func (m MediaData) legacy() MediaData {
+	return MediaData{
+		FullTitle:        m.FullTitle,
+		ParentMediaIndex: m.ParentMediaIndex,
+		MediaIndex:       m.MediaIndex,
+		WatchedStatus:    m.WatchedStatus,
+		PercentComplete:  m.PercentComplete,
+	}
+}
+
+// watchedSeconds returns how far into the item playback got, from the view offset when Tautulli
+// reports one and from the time played otherwise
+func watchedSeconds(data MediaData) int {
+	if data.ViewOffset > 0 {
+		return int(data.ViewOffset) / 1000
+	}
+	return int(data.Duration)
+}
+
+// mediaID returns a deterministic ID for a watched event, the SHA1 of its source, title, season,
+// episode and user
+func mediaID(data MediaData) string {
+	title := data.GrandparentTitle
+	if title == "" {
+		title = data.FullTitle
+	}
+	parts := []string{data.Source, title, data.ParentMediaIndex.String(), data.MediaIndex.String(), data.User}
+	sum := sha1.Sum([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// resolveOutputPath decides where to write given an existing record at path, checked in the
+// active output backend. It returns false if the write should be skipped altogether.
+func resolveOutputPath(path, extension, onConflict string) (string, bool, error) {
+	if onConflict != OnConflictSkip && onConflict != OnConflictSuffix {
+		return path, true, nil
+	}
+	exists, err := outputExists(path)
+	if err != nil {
+		return "", false, err
+	}
+	if !exists {
+		return path, true, nil
+	}
+
+	if onConflict == OnConflictSkip {
+		return "", false, nil
+	}
+	ext := extension
+	if !strings.HasSuffix(path, ext) {
+		ext = filepath.Ext(path)
+	}
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		exists, err := outputExists(candidate)
+		if err != nil {
+			return "", false, err
+		}
+		if !exists {
+			return candidate, true, nil
+		}
+	}
+}
+
+// loadConfig loads configuration from environment variables and the optional CONFIG_FILE
+func loadConfig() Config {
+	config, err := readConfig()
+	if err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
+	}
+	return config
+}
+
+// readConfig reads the configuration like loadConfig, returning invalid settings as an error so that
+// a reload can keep the running configuration
+func readConfig() (_ Config, err error) {
+	// The file values are only kept if the configuration they produce is valid
+	previous := fileConfig
+	defer func() {
+		if err != nil {
+			fileConfig = previous
+		}
+	}()
+
+	fileConfig = nil
+	if path := os.ExpandEnv(os.Getenv("CONFIG_FILE")); path != "" {
+		values, err := loadConfigFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid CONFIG_FILE: %w", err)
+		}
+		fileConfig = values
+	}
+
+	allowedIPs, err := parseAllowedIPs(getEnv("ALLOWED_IPS", ""))
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid ALLOWED_IPS value: %w", err)
+	}
+
+	outputExtension := getEnv("OUTPUT_EXTENSION", defaultOutputExtension)
+	if !strings.HasPrefix(outputExtension, ".") {
+		log.Printf("Invalid OUTPUT_EXTENSION value: %s, must start with a dot, using default %s", outputExtension, defaultOutputExtension)
+		outputExtension = defaultOutputExtension
+	}
+
+	outputSchemaVersion := getEnvInt("OUTPUT_SCHEMA_VERSION", SchemaVersionCurrent)
+	if outputSchemaVersion < SchemaVersionLegacy || outputSchemaVersion > SchemaVersionCurrent {
+		log.Printf("Invalid OUTPUT_SCHEMA_VERSION value: %d, must be between %d and %d, using default %d", outputSchemaVersion, SchemaVersionLegacy, SchemaVersionCurrent, SchemaVersionCurrent)
+		outputSchemaVersion = SchemaVersionCurrent
+	}
+
+	multipartMaxMemory := getEnvInt("MULTIPART_MAX_MEMORY", defaultMultipartMaxMemory)
+	if multipartMaxMemory <= 0 {
+		log.Printf("Invalid MULTIPART_MAX_MEMORY value: %d, must be positive, using default %d", multipartMaxMemory, defaultMultipartMaxMemory)
+		multipartMaxMemory = defaultMultipartMaxMemory
+	}
+
+	// An explicitly empty TITLE_NORMALIZE_REGEX disables normalization
+	var titleNormalizeRegex *regexp.Regexp
+	titleNormalizePattern, ok := lookupEnv("TITLE_NORMALIZE_REGEX")
+	if !ok {
+		titleNormalizePattern = defaultTitleNormalizeRegex
+	}
+	if titleNormalizePattern != "" {
+		titleNormalizeRegex, err = regexp.Compile(titleNormalizePattern)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid TITLE_NORMALIZE_REGEX value: %w", err)
+		}
+	}
+
+	// Asynchronous writes need workers, so ASYNC_WRITES starts a pool unless WRITE_WORKERS is set
+	asyncWrites := getEnv("ASYNC_WRITES", "false") == "true"
+	defaultWriteWorkers := 0
+	if asyncWrites {
+		defaultWriteWorkers = 4
+	}
+	writeWorkers := getEnvNonNegativeInt("WRITE_WORKERS", defaultWriteWorkers)
+	if asyncWrites && writeWorkers == 0 {
+		log.Printf("ASYNC_WRITES needs WRITE_WORKERS, writing synchronously")
+		asyncWrites = false
+	}
+
+	var ignoreTitleRegex *regexp.Regexp
+	if ignoreTitlePattern := getEnv("IGNORE_TITLE_REGEX", ""); ignoreTitlePattern != "" {
+		ignoreTitleRegex, err = regexp.Compile(ignoreTitlePattern)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid IGNORE_TITLE_REGEX value: %w", err)
+		}
+	}
+
+	tautulliKeyParams := slices.DeleteFunc(getEnvList("TAUTULLI_KEY_PARAM", TautulliKeyRating), func(param string) bool {
+		if param == TautulliKeyRating || param == TautulliKeyParentRating || param == TautulliKeyGrandparentRating {
+			return false
+		}
+		log.Printf("Invalid TAUTULLI_KEY_PARAM value: %s, ignoring", param)
+		return true
+	})
+
+	return Config{
+		Port:      getEnvInt("PORT", 3333),
+		APIHost:   getEnv("API_HOST", ""),
+		APIKey:    getEnv("API_KEY", ""),
+		OutputDir: getEnvPath("OUTPUT_DIR", "/output"),
+		Debug:     getEnv("DEBUG", "false") == "true",
+
+		PlexOutputDir:     getEnvPath("PLEX_OUTPUT_DIR", ""),
+		JellyfinOutputDir: getEnvPath("JELLYFIN_OUTPUT_DIR", ""),
+
+		PlexDisabled:      getEnv("PLEX_ENABLED", "true") == "false",
+		JellyfinDisabled:  getEnv("JELLYFIN_ENABLED", "true") == "false",
+		JellyseerrEnabled: getEnv("JELLYSEERR_ENABLED", "false") == "true",
+		EchoEnabled:       getEnv("ECHO_ENABLED", "false") == "true",
+		DebugAcceptGet:    getEnv("DEBUG_ACCEPT_GET", "false") == "true",
+		StrictJSON:        getEnv("STRICT_JSON", "false") == "true",
+
+		WriteWorkers:      writeWorkers,
+		WriteQueueSize:    getEnvNonNegativeInt("WRITE_QUEUE_SIZE", 100),
+		WriteQueueTimeout: getEnvDuration("WRITE_QUEUE_TIMEOUT", 5*time.Second),
+		AsyncWrites:       asyncWrites,
+
+		RequestTimeout:        getEnvDuration("REQUEST_TIMEOUT", 0),
+		AuditDir:              getEnvPath("AUDIT_DIR", ""),
+		AuditRetention:        getEnvDuration("AUDIT_RETENTION", 0),
+		ServerReadTimeout:     getEnvDuration("SERVER_READ_TIMEOUT", 30*time.Second),
+		ServerWriteTimeout:    getEnvDuration("SERVER_WRITE_TIMEOUT", 2*time.Minute),
+		ServerIdleTimeout:     getEnvDuration("SERVER_IDLE_TIMEOUT", 2*time.Minute),
+		MaxConcurrentRequests: getEnvNonNegativeInt("MAX_CONCURRENT_REQUESTS", 0),
+		RecentBufferSize:      getEnvNonNegativeInt("RECENT_BUFFER_SIZE", defaultRecentBufferSize),
+		ValidateOnly:          getEnv("VALIDATE_ONLY", "false") == "true",
+
+		PlexWatchMode:      getEnvChoice("PLEX_WATCH_MODE", PlexWatchModeStatus, PlexWatchModePercent),
+		PlexWatchedPercent: getEnvInt("PLEX_WATCHED_PERCENT", 90),
+		MinPercentComplete: getEnvInt("MIN_PERCENT_COMPLETE", 0),
+		SkipZeroIndex:      getEnv("SKIP_ZERO_INDEX", "false") == "true",
+
+		TautulliTimeout:      getEnvDuration("TAUTULLI_TIMEOUT", 10*time.Second),
+		TautulliStartupCheck: getEnv("TAUTULLI_STARTUP_CHECK", "false") == "true",
+		TautulliUserAgent:    getEnv("TAUTULLI_USER_AGENT", "plex-clean/"+version),
+
+		TautulliMaxConcurrency: getEnvInt("TAUTULLI_MAX_CONCURRENCY", 4),
+		TautulliSettleRetries:  getEnvNonNegativeInt("TAUTULLI_SETTLE_RETRIES", 0),
+		TautulliSettleDelay:    getEnvDuration("TAUTULLI_SETTLE_DELAY", time.Second),
+		TautulliBasePath:       getEnv("TAUTULLI_BASE_PATH", defaultTautulliBasePath),
+
+		TautulliKeyParams:         tautulliKeyParams,
+		TautulliMediaType:         getEnv("TAUTULLI_MEDIA_TYPE", ""),
+		TautulliUserID:            getEnv("TAUTULLI_USER_ID", ""),
+		TautulliTranscodeDecision: getEnv("TAUTULLI_TRANSCODE_DECISION", ""),
+
+		EmptyDataBehavior:   getEnvChoice("EMPTY_DATA_BEHAVIOR", EmptyDataSkip, EmptyDataRetry, EmptyDataFail),
+		EmptyDataRetries:    getEnvNonNegativeInt("EMPTY_DATA_RETRIES", 3),
+		EmptyDataRetryDelay: getEnvDuration("EMPTY_DATA_RETRY_DELAY", 2*time.Second),
+
+		OutputBackend:  getEnvChoice("OUTPUT_BACKEND", OutputBackendFile, OutputBackendS3),
+		S3Bucket:       getEnv("S3_BUCKET", ""),
+		S3Prefix:       getEnv("S3_PREFIX", ""),
+		S3Endpoint:     getEnv("S3_ENDPOINT", ""),
+		S3Region:       getEnv("AWS_REGION", getEnv("AWS_DEFAULT_REGION", "us-east-1")),
+		S3AccessKey:    getEnv("AWS_ACCESS_KEY_ID", ""),
+		S3SecretKey:    getEnv("AWS_SECRET_ACCESS_KEY", ""),
+		S3SessionToken: getEnv("AWS_SESSION_TOKEN", ""),
+
+		FailOnWriteError: getEnv("FAIL_ON_WRITE_ERROR", "false") == "true",
+
+		OnConflict:                getEnvChoice("ON_CONFLICT", OnConflictOverwrite, OnConflictSkip, OnConflictSuffix),
+		OutputExtension:           outputExtension,
+		OutputFormat:              getEnvChoice("OUTPUT_FORMAT", OutputFormatJSON, OutputFormatNFO),
+		OutputSchemaVersion:       outputSchemaVersion,
+		OutputCompress:            getEnvChoice("OUTPUT_COMPRESS", OutputCompressNone, OutputCompressGzip),
+		FilenameTemplate:          getEnv("FILENAME_TEMPLATE", ""),
+		FilenameTemplates:         getEnvPrefixed("FILENAME_TEMPLATE_"),
+		TitleNormalizeRegex:       titleNormalizeRegex,
+		IgnoreTitleRegex:          ignoreTitleRegex,
+		TitleNormalizeReplacement: getEnv("TITLE_NORMALIZE_REPLACEMENT", "$1"),
+		FilenameCase:              getEnvChoice("FILENAME_CASE", FilenameCasePreserve, FilenameCaseLower, FilenameCaseUpper),
+		FilenameSpaceReplacement:  getEnv("FILENAME_SPACE_REPLACEMENT", ""),
+		SeasonPadWidth:            getEnvNonNegativeInt("SEASON_PAD_WIDTH", 0),
+		EpisodePadWidth:           getEnvNonNegativeInt("EPISODE_PAD_WIDTH", 0),
+		MaxFilenameBytes:          getEnvInt("MAX_FILENAME_BYTES", defaultMaxFilenameBytes),
+
+		WebhookBasicUser: getEnv("WEBHOOK_BASIC_USER", ""),
+		WebhookBasicPass: getEnv("WEBHOOK_BASIC_PASS", ""),
+
+		AllowedIPs:        allowedIPs,
+		TrustForwardedFor: getEnv("TRUST_FORWARDED_FOR", "false") == "true",
+
+		MultipartMaxMemory: int64(multipartMaxMemory),
+		MaxBodyBytes:       int64(getEnvNonNegativeInt("MAX_BODY_BYTES", defaultMaxBodyBytes)),
+
+		PlexEvents:             getEnvList("PLEX_EVENTS", PlexEventStop),
+		PlexStopEvent:          getEnv("PLEX_STOP_EVENT", PlexEventStop),
+		PlexSkipTautulliMovies: getEnv("PLEX_SKIP_TAUTULLI_MOVIES", "false") == "true",
+		AllowedMediaTypes:      getEnvList("ALLOWED_MEDIA_TYPES", strings.Join(defaultAllowedMediaTypes, ",")),
+		NewMediaDir:            getEnvPath("NEW_MEDIA_DIR", ""),
+
+		PartialDir:        getEnvPath("PARTIAL_DIR", ""),
+		PartialMinPercent: getEnvInt("PARTIAL_MIN_PERCENT", 50),
+		PartialMaxPercent: getEnvInt("PARTIAL_MAX_PERCENT", 90),
+
+		JellyfinEvents:    getEnvList("JELLYFIN_EVENTS", JellyfinEventPlaybackStop),
+		JellyfinStopEvent: getEnv("JELLYFIN_STOP_EVENT", JellyfinEventPlaybackStop),
+		JellyseerrEvents:  getEnvList("JELLYSEERR_EVENTS", ""),
+
+		JellyfinCompletionPercent: getEnvNonNegativeInt("JELLYFIN_COMPLETION_PERCENT", 0),
+		JellyfinMusicEnabled:      getEnv("JELLYFIN_MUSIC_ENABLED", "false") == "true",
+		MusicOutputDir:            getEnvPath("MUSIC_OUTPUT_DIR", ""),
+
+		DedupTTL:      getEnvDuration("DEDUP_TTL", 24*time.Hour),
+		DedupFile:     getEnvPath("DEDUP_FILE", ""),
+		DedupWebhooks: getEnv("DEDUP_WEBHOOKS", "false") == "true",
+		PollEnabled:   getEnv("POLL_ENABLED", "false") == "true",
+		PollInterval:  getEnvDuration("POLL_INTERVAL", 5*time.Minute),
+		PollLength:    getEnvInt("POLL_LENGTH", 25),
+
+		Backfill:       getEnv("BACKFILL", "false") == "true",
+		BackfillLength: getEnvInt("BACKFILL_LENGTH", 100),
+		BackfillDays:   getEnvNonNegativeInt("BACKFILL_DAYS", 0),
+
+		ForwardURL:     getEnv("FORWARD_URL", ""),
+		ForwardMethod:  strings.ToUpper(getEnv("FORWARD_METHOD", http.MethodPost)),
+		ForwardHeaders: parseForwardHeaders(getEnv("FORWARD_HEADERS", "")),
+
+		PostWriteCmd:     getEnv("POST_WRITE_CMD", ""),
+		PostWriteTimeout: getEnvDuration("POST_WRITE_TIMEOUT", 10*time.Second),
+
+		IncludeProviderIDs: getEnv("INCLUDE_PROVIDER_IDS", "false") == "true",
+		IncludeRawMetadata: getEnv("INCLUDE_RAW_METADATA", "false") == "true",
+		IncludePlexHeaders: getEnv("INCLUDE_PLEX_HEADERS", "false") == "true",
+		IncludeID:          getEnv("INCLUDE_ID", "false") == "true",
+		TMDBAPIKey:         getEnv("TMDB_API_KEY", ""),
+		TMDBURL:            getEnv("TMDB_URL", defaultTMDBURL),
+		TMDBTimeout:        getEnvDuration("TMDB_TIMEOUT", 5*time.Second),
+		IncludeDuration:    getEnv("INCLUDE_DURATION", "false") == "true",
+
+		JellyfinURL:               getEnv("JELLYFIN_URL", ""),
+		JellyfinToken:             getEnv("JELLYFIN_TOKEN", ""),
+		JellyfinSeriesPlaceholder: getEnv("JELLYFIN_SERIES_PLACEHOLDER", ""),
+
+		LogFile:           getEnvPath("LOG_FILE", ""),
+		LogMaxSize:        getEnvNonNegativeInt("LOG_MAX_SIZE", 10),
+		LogStdoutDisabled: getEnv("LOG_STDOUT", "true") == "false",
+
+		Location: loadLocation(getEnv("TIMEZONE", getEnv("TZ", ""))),
+	}, nil
+}
+
+// loadLocation loads the named timezone, falling back to UTC when unset or invalid
+func loadLocation(name string) *time.Location {
+	if name == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Printf("Warning: invalid timezone %s, using UTC: %v", name, err)
+		return time.UTC
+	}
+	return loc
+}
 
-			// Jellyfin webhooks are typically sent as application/json
-			if strings.Contains(contentType, "application/json") {
-				if config.Debug {
-					log.Printf("Detected Jellyfin webhook based on Content-Type")
-				}
-				handleJellyfinWebhook(w, r, config)
-				return
-			}
+// getEnvInt gets an integer environment variable or returns a default value if unset or invalid
+func getEnvInt(key string, defaultValue int) int {
+	valueStr := getEnv(key, strconv.Itoa(defaultValue))
+	value, err := strconv.Atoi(valueStr)
+	if err != nil {
+		log.Printf("Invalid %s value: %s, using default %d", key, valueStr, defaultValue)
+		return defaultValue
+	}
+	return value
+}
 
-			// If we can't determine the type, return an error
-			log.Printf("Unable to determine webhook type from request")
-			http.Error(w, "Unable to determine webhook type", http.StatusBadRequest)
-			return
+// getEnvList gets a comma-separated environment variable as a list of trimmed, non-empty values
+func getEnvList(key, defaultValue string) []string {
+	var values []string
+	for _, value := range strings.Split(getEnv(key, defaultValue), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
 		}
+	}
+	return values
+}
 
-		// For any other path, return 404
-		http.NotFound(w, r)
-	})
+// getEnvPrefixed gets all environment variables starting with prefix, keyed by the rest of their
+// name normalized with envSuffix. Environment variables take precedence over CONFIG_FILE.
+func getEnvPrefixed(prefix string) map[string]string {
+	values := make(map[string]string)
+	for key, value := range fileConfig {
+		if suffix, ok := strings.CutPrefix(key, prefix); ok && suffix != "" && value != "" {
+			values[envSuffix(suffix)] = value
+		}
+	}
+	for _, entry := range os.Environ() {
+		key, value, _ := strings.Cut(entry, "=")
+		if suffix, ok := strings.CutPrefix(key, prefix); ok && suffix != "" && value != "" {
+			values[envSuffix(suffix)] = value
+		}
+	}
+	return values
+}
 
-	// Start server
-	log.Printf("Server running on port %d", config.Port)
-	log.Printf("Plex webhook support is enabled")
-	log.Printf("Jellyfin webhook support is enabled")
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", config.Port), nil))
+// getEnvChoice gets an environment variable that must be one of the given values, or returns the
+// default value (the first choice) if unset or invalid
+func getEnvChoice(key string, defaultValue string, choices ...string) string {
+	value := getEnv(key, defaultValue)
+	if value == defaultValue || slices.Contains(choices, value) {
+		return value
+	}
+	log.Printf("Invalid %s value: %s, using default %s", key, value, defaultValue)
+	return defaultValue
 }
 
-// handlePlexWebhook processes Plex webhook requests
-func handlePlexWebhook(w http.ResponseWriter, r *http.Request, config Config) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// getEnvNonNegativeInt gets an integer environment variable that must not be negative, or returns
+// a default value if unset or invalid
+func getEnvNonNegativeInt(key string, defaultValue int) int {
+	value := getEnvInt(key, defaultValue)
+	if value < 0 {
+		log.Printf("Invalid %s value: %d, must not be negative, using default %d", key, value, defaultValue)
+		return defaultValue
 	}
+	return value
+}
 
-	// Parse multipart form
-	err := r.ParseMultipartForm(10 << 20) // 10 MB max memory
+// getEnvDuration gets a duration environment variable (e.g. "10s") or returns a default value if unset or invalid
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	valueStr := getEnv(key, defaultValue.String())
+	value, err := time.ParseDuration(valueStr)
 	if err != nil {
-		log.Printf("Error parsing multipart form: %v", err)
-		http.Error(w, "Error parsing form", http.StatusBadRequest)
-		return
+		log.Printf("Invalid %s value: %s, using default %s", key, valueStr, defaultValue)
+		return defaultValue
 	}
+	return value
+}
 
-	// Get payload from form
-	payloadStr := r.FormValue("payload")
-	if payloadStr == "" {
-		log.Printf("No payload found in request")
-		http.Error(w, "No payload found", http.StatusBadRequest)
-		return
+// timezoneLogWriter prefixes each log line with a timestamp in the configured timezone. It is shared
+// by the standard logger and the request loggers, so each line is written in a single call.
+type timezoneLogWriter struct {
+	mu  sync.Mutex
+	out io.Writer
+	loc *time.Location
+}
+
+func (w *timezoneLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	line := now().In(w.loc).AppendFormat(make([]byte, 0, 20+len(p)), "2006/01/02 15:04:05 ")
+	if _, err := w.out.Write(append(line, p...)); err != nil {
+		return 0, err
 	}
+	return len(p), nil
+}
 
-	// Parse payload
-	var payload PlexWebhookPayload
-	if err := json.Unmarshal([]byte(payloadStr), &payload); err != nil {
-		log.Printf("Error unmarshaling Plex payload: %v", err)
-		http.Error(w, "Error parsing payload", http.StatusBadRequest)
-		return
+// getEnv gets an environment variable, then the CONFIG_FILE value, or returns a default value
+func getEnv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		value = fileConfig[key]
+	}
+	if value == "" {
+		return defaultValue
 	}
+	return value
+}
 
-	// Check if this is a media.stop event
-	if payload.Event != "media.stop" {
-		if config.Debug {
-			log.Printf("Ignoring Plex event: %s", payload.Event)
-		}
-		w.WriteHeader(http.StatusOK)
-		_, err = w.Write([]byte("OK"))
+// getEnvPath gets a path setting like getEnv, expanding $VAR and ${VAR} references in it
+func getEnvPath(key, defaultValue string) string {
+	return os.ExpandEnv(getEnv(key, defaultValue))
+}
+
+func fetchMetadata(ctx context.Context, path string, config Config) (_ []MediaData, err error) {
+	logger := requestLogger(ctx)
+
+	defer func() {
 		if err != nil {
-			log.Printf("Error writing response: %v", err)
+			stats.TautulliErrors.Add(1)
 		}
-		return
+	}()
+
+	if path == "" {
+		return nil, nil
 	}
 
-	// Check if metadata is present
-	if payload.Metadata.Key == "" {
+	// Extract the key from the path
+	key := extractKeyFromPath(path)
+	if key == "" {
 		if config.Debug {
-			log.Printf("Invalid Plex request, No metadata found")
+			logger.Printf("Could not extract key from path: %s", path)
 		}
-		w.WriteHeader(http.StatusOK)
-		_, err = w.Write([]byte("OK"))
-		if err != nil {
-			log.Printf("Error writing response: %v", err)
-		}
-		return
+		return nil, nil
 	}
 
-	// Fetch metadata from Tautulli
-	mediaData, err := fetchMetadata(payload.Metadata.Key, config)
-	if err != nil {
-		log.Printf("Error fetching metadata from Tautulli: %v", err)
-		http.Error(w, "Error fetching metadata", http.StatusInternalServerError)
-		return
+	// Rows found by a parent or grandparent key carry the rating key of the episode itself
+	settleKey := key
+	if !slices.Equal(config.tautulliKeyParams(), []string{TautulliKeyRating}) {
+		settleKey = ""
 	}
 
-	if len(mediaData) == 0 {
+	// Plex may send the webhook before Tautulli has logged the play, in which case the latest row
+	// is an older play. Re-query until the row belongs to this item and is marked watched, holding a
+	// Tautulli slot only while a query is in flight.
+	for attempt := 0; ; attempt++ {
+		rows, err := fetchHistoryLimited(ctx, key, config)
+		if err != nil || attempt >= config.TautulliSettleRetries || historySettled(rows, settleKey) {
+			return rows, err
+		}
 		if config.Debug {
-			log.Printf("No entries found in Tautulli for metadata key: %s", payload.Metadata.Key)
+			logger.Printf("Tautulli history for key %s not settled yet, retrying in %s", key, config.TautulliSettleDelay)
 		}
-		w.WriteHeader(http.StatusOK)
-		_, err = w.Write([]byte("OK"))
-		if err != nil {
-			log.Printf("Error writing response: %v", err)
+		if err := sleepContext(ctx, config.TautulliSettleDelay); err != nil {
+			return nil, err
 		}
-		return
-	} else if config.Debug {
-		log.Printf("Found %d entries for %s", len(mediaData), payload.Metadata.Key)
 	}
+}
+
+// historySettled reports whether the latest history row belongs to the rating key and is watched.
+// Rows without a rating key, or any row when key is empty, are assumed to match.
+func historySettled(rows []MediaData, key string) bool {
+	if len(rows) == 0 {
+		return false
+	}
+	row := rows[0]
+	if key != "" && row.RatingKey != 0 && strconv.Itoa(int(row.RatingKey)) != key {
+		return false
+	}
+	return row.WatchedStatus >= 1.0
+}
 
-	// Process media data
-	for _, data := range mediaData {
-		// Convert ParentMediaIndex and MediaIndex to integers
-		parentMediaIndex, err := data.ParentMediaIndex.Int64()
-		if err != nil {
-			log.Printf("Error converting ParentMediaIndex to int: %v", err)
-			continue
+// fetchHistory requests the most recent Tautulli history row for a key, passing it as each of the
+// configured key parameters in turn until one returns rows
+func fetchHistory(ctx context.Context, key string, config Config) ([]MediaData, error) {
+	logger := requestLogger(ctx)
+
+	for _, param := range config.tautulliKeyParams() {
+		rows, err := queryHistory(ctx, param, key, config)
+		if err != nil || len(rows) > 0 {
+			return rows, err
 		}
-		mediaIndex, err := data.MediaIndex.Int64()
-		if err != nil {
-			log.Printf("Error converting MediaIndex to int: %v", err)
-			continue
+		if config.Debug {
+			logger.Printf("No Tautulli history for %s=%s", param, key)
 		}
+	}
+	return []MediaData{}, nil
+}
 
-		if data.WatchedStatus >= 1.0 {
-			filename := fmt.Sprintf("%s - S%dE%d.json", data.FullTitle, parentMediaIndex, mediaIndex)
-			log.Printf("Media marked as watched by Plex, writing to file %s", filename)
-
-			// Create the output directory if it doesn't exist
-			if err := os.MkdirAll(config.OutputDir, 0755); err != nil {
-				log.Printf("Error creating output directory: %v", err)
-				continue
-			}
+// queryHistory requests the most recent Tautulli history row with the key passed as param
+func queryHistory(ctx context.Context, param, key string, config Config) ([]MediaData, error) {
+	logger := requestLogger(ctx)
 
-			// Write the data to a file
-			jsonData, err := json.MarshalIndent(data, "", "  ")
-			if err != nil {
-				log.Printf("Error marshaling JSON: %v", err)
-				continue
-			}
+	// Construct the URL
+	params := url.Values{}
+	params.Set("cmd", "get_history")
+	params.Set(param, key)
+	params.Set("order_column", "started")
+	params.Set("order", "desc")
+	params.Set("length", "1")
+	config.addHistoryFilters(params)
 
-			outputPath := filepath.Join(config.OutputDir, filename)
-			if err := os.WriteFile(outputPath, jsonData, 0644); err != nil {
-				log.Printf("Error writing file: %v", err)
-			}
-		} else if config.Debug {
-			log.Printf("Media not marked as watched by Plex, ignoring")
+	var tautulliResp TautulliResponse
+	var shapeErr *json.UnmarshalTypeError
+	if err := tautulliRequest(ctx, config, params, &tautulliResp); err != nil {
+		// In some error conditions Tautulli returns an object or a string in place of the
+		// history list. The remaining fields are still decoded, so keep going and check them.
+		if !errors.As(err, &shapeErr) || (shapeErr.Field != "response.data" && shapeErr.Field != "response.data.data") {
+			return nil, err
 		}
 	}
 
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write([]byte("OK"))
-	if err != nil {
-		log.Printf("Error writing response: %v", err)
+	// Tautulli reports API errors such as an invalid API key with HTTP 200 and result "error"
+	if tautulliResp.Response.Result == "error" {
+		return nil, fetchError(FetchErrorAPI, fmt.Errorf("tautulli API error: %s", tautulliResp.Response.Message))
 	}
-}
 
-// handleJellyfinWebhook processes Jellyfin webhook requests
-func handleJellyfinWebhook(w http.ResponseWriter, r *http.Request, config Config) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	if shapeErr != nil {
+		logger.Printf("Unexpected Tautulli response shape for key %s (%s is a %s), treating as no data", key, shapeErr.Field, shapeErr.Value)
+		return []MediaData{}, nil
 	}
 
-	// Read the request body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("Error reading Jellyfin request body: %v", err)
-		http.Error(w, "Error reading request body", http.StatusBadRequest)
-		return
+	// Return the data
+	if tautulliResp.Response.Data.Data == nil {
+		return []MediaData{}, nil
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			log.Printf("Error closing Jellyfin request body: %v", err)
-		}
-	}(r.Body)
+	return tautulliResp.Response.Data.Data, nil
+}
 
-	// Parse the JSON payload
-	var payload JellyfinWebhookPayload
-	if err := json.Unmarshal(body, &payload); err != nil {
-		log.Printf("Error unmarshaling Jellyfin payload: %v", err)
-		http.Error(w, "Error parsing payload", http.StatusBadRequest)
-		return
-	}
+// tautulliRequest performs a Tautulli API request and decodes the response into v as it is read,
+// without holding a copy of the raw body
+func tautulliRequest(ctx context.Context, config Config, params url.Values, v any) error {
+	logger := requestLogger(ctx)
 
-	// Check if this is a playback stop event with completion
-	if payload.Event != "playback.stop" && payload.NotificationType != "PlaybackStop" {
-		if config.Debug {
-			log.Printf("Ignoring Jellyfin event: %s/%s", payload.Event, payload.NotificationType)
+	// Make the request
+	resp, err := tautulliGet(ctx, config, tautulliURL(config, params))
+	if err != nil {
+		return fetchError(FetchErrorNetwork, fmt.Errorf("error making HTTP request: %w", err))
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			logger.Printf("Error closing response body: %v", closeErr)
 		}
-		w.WriteHeader(http.StatusOK)
-		_, err = w.Write([]byte("OK"))
-		if err != nil {
-			log.Printf("Error writing response: %v", err)
+	}()
+
+	// Check for non-200 status code
+	if resp.StatusCode != http.StatusOK {
+		return &FetchError{
+			Category:   FetchErrorHTTPStatus,
+			StatusCode: resp.StatusCode,
+			Err:        fmt.Errorf("received non-200 response: %d %s", resp.StatusCode, http.StatusText(resp.StatusCode)),
 		}
-		return
 	}
 
-	// Check if the media was played to completion
-	if !payload.MediaStatus.PlayedToCompletion {
-		if config.Debug {
-			log.Printf("Jellyfin media not played to completion, ignoring")
-		}
-		w.WriteHeader(http.StatusOK)
-		_, err = w.Write([]byte("OK"))
-		if err != nil {
-			log.Printf("Error writing response: %v", err)
-		}
-		return
+	// An auth proxy in front of Tautulli answers unauthenticated requests with a login page
+	body := bufio.NewReader(resp.Body)
+	if !looksLikeJSON(resp.Header.Get("Content-Type"), body) {
+		return fetchError(FetchErrorDecode, fmt.Errorf("%w (content type %q)", errTautulliNotJSON, resp.Header.Get("Content-Type")))
 	}
 
-	// For episodes, use series name, season, and episode
-	if payload.ItemType == "Episode" && payload.SeriesName != "" {
-		// Create a MediaData object to maintain consistency with Plex
-		mediaData := MediaData{
-			FullTitle:        payload.SeriesName + " - " + payload.Title,
-			ParentMediaIndex: json.Number(strconv.Itoa(payload.SeasonNumber)),
-			MediaIndex:       json.Number(strconv.Itoa(payload.EpisodeNumber)),
-			WatchedStatus:    1.0, // Marked as watched
-			PercentComplete:  100, // Assuming 100% complete
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return fetchError(FetchErrorDecode, fmt.Errorf("error unmarshaling response: %w", err))
 		}
+		return fetchError(FetchErrorNetwork, fmt.Errorf("error reading response body: %w", err))
+	}
+	return nil
+}
 
-		filename := fmt.Sprintf("%s - S%dE%d.json", payload.SeriesName, payload.SeasonNumber, payload.EpisodeNumber)
-		log.Printf("Media marked as watched by Jellyfin, writing to file %s", filename)
-
-		// Create the output directory if it doesn't exist
-		if err := os.MkdirAll(config.OutputDir, 0755); err != nil {
-			log.Printf("Error creating output directory: %v", err)
-			http.Error(w, "Error creating output directory", http.StatusInternalServerError)
-			return
-		}
+// errTautulliNotJSON is returned when Tautulli answers with something other than JSON, typically
+// the HTML login page of an auth proxy
+var errTautulliNotJSON = errors.New("tautulli returned non-JSON (auth proxy?)")
 
-		// Write the data to a file
-		jsonData, err := json.MarshalIndent(mediaData, "", "  ")
+// looksLikeJSON reports whether a response is JSON, judged by an HTML content type or a body that
+// does not start like a JSON object or array. Leading whitespace is consumed from body.
+func looksLikeJSON(contentType string, body *bufio.Reader) bool {
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "text/html" {
+		return false
+	}
+	for {
+		next, err := body.Peek(1)
 		if err != nil {
-			log.Printf("Error marshaling JSON: %v", err)
-			http.Error(w, "Error marshaling JSON", http.StatusInternalServerError)
-			return
-		}
-
-		outputPath := filepath.Join(config.OutputDir, filename)
-		if err := os.WriteFile(outputPath, jsonData, 0644); err != nil {
-			log.Printf("Error writing file: %v", err)
-			http.Error(w, "Error writing file", http.StatusInternalServerError)
-			return
-		}
-	} else if payload.ItemType == "Movie" {
-		// Handle movies
-		mediaData := MediaData{
-			FullTitle:        payload.Title,
-			ParentMediaIndex: json.Number("0"), // No season for movies
-			MediaIndex:       json.Number("0"), // No episode for movies
-			WatchedStatus:    1.0,              // Marked as watched
-			PercentComplete:  100,              // Assuming 100% complete
+			return false
 		}
-
-		filename := fmt.Sprintf("%s.json", payload.Title)
-		log.Printf("Movie marked as watched by Jellyfin, writing to file %s", filename)
-
-		// Create the output directory if it doesn't exist
-		if err := os.MkdirAll(config.OutputDir, 0755); err != nil {
-			log.Printf("Error creating output directory: %v", err)
-			http.Error(w, "Error creating output directory", http.StatusInternalServerError)
-			return
+		switch next[0] {
+		case ' ', '\t', '\r', '\n':
+			if _, err := body.Discard(1); err != nil {
+				return false
+			}
+		default:
+			return next[0] == '{' || next[0] == '['
 		}
+	}
+}
 
-		// Write the data to a file
-		jsonData, err := json.MarshalIndent(mediaData, "", "  ")
+// fetchLibraryMetadata fetches the metadata of a single library item from Tautulli. Unlike
+// fetchMetadata it does not depend on any play history, so it works for newly added media.
+func fetchLibraryMetadata(ctx context.Context, path string, config Config) (_ *MediaData, err error) {
+	defer func() {
 		if err != nil {
-			log.Printf("Error marshaling JSON: %v", err)
-			http.Error(w, "Error marshaling JSON", http.StatusInternalServerError)
-			return
+			stats.TautulliErrors.Add(1)
 		}
+	}()
 
-		outputPath := filepath.Join(config.OutputDir, filename)
-		if err := os.WriteFile(outputPath, jsonData, 0644); err != nil {
-			log.Printf("Error writing file: %v", err)
-			http.Error(w, "Error writing file", http.StatusInternalServerError)
-			return
-		}
-	} else {
+	key := extractKeyFromPath(path)
+	if key == "" {
 		if config.Debug {
-			log.Printf("Unsupported Jellyfin item type: %s", payload.ItemType)
+			log.Printf("Could not extract key from path: %s", path)
 		}
+		return nil, nil
 	}
 
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write([]byte("OK"))
-	if err != nil {
-		log.Printf("Error writing response: %v", err)
+	params := url.Values{}
+	params.Set("cmd", "get_metadata")
+	params.Set("rating_key", key)
+
+	var metadataResp struct {
+		Response struct {
+			Result  string    `json:"result"`
+			Message string    `json:"message"`
+			Data    MediaData `json:"data"`
+		} `json:"response"`
+	}
+	if err := tautulliRequest(ctx, config, params, &metadataResp); err != nil {
+		return nil, err
 	}
+	if metadataResp.Response.Result == "error" {
+		return nil, fetchError(FetchErrorAPI, fmt.Errorf("tautulli API error: %s", metadataResp.Response.Message))
+	}
+	if metadataResp.Response.Data.FullTitle == "" {
+		return nil, nil
+	}
+	return &metadataResp.Response.Data, nil
 }
 
-// loadConfig loads configuration from environment variables
-func loadConfig() Config {
-	portStr := getEnv("PORT", "3333")
-	port, err := strconv.Atoi(portStr)
-	if err != nil {
-		log.Printf("Invalid PORT value: %s, using default 3333", portStr)
-		port = 3333
+// tautulliSemaphore limits the number of concurrent Tautulli requests, nil means unlimited
+var tautulliSemaphore chan struct{}
+
+// acquireTautulli waits for a free Tautulli request slot or until the context is cancelled
+func acquireTautulli(ctx context.Context) error {
+	if tautulliSemaphore == nil {
+		return nil
 	}
-	return Config{
-		Port:      port,
-		APIHost:   getEnv("API_HOST", ""),
-		APIKey:    getEnv("API_KEY", ""),
-		OutputDir: getEnv("OUTPUT_DIR", "/output"),
-		Debug:     getEnv("DEBUG", "false") == "true",
+	select {
+	case tautulliSemaphore <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-// getEnv gets an environment variable or returns a default value
-func getEnv(key, defaultValue string) string {
-	value := os.Getenv(key)
-	if value == "" {
-		return defaultValue
+// releaseTautulli frees a Tautulli request slot acquired with acquireTautulli
+func releaseTautulli() {
+	if tautulliSemaphore != nil {
+		<-tautulliSemaphore
 	}
-	return value
 }
 
-func fetchMetadata(path string, config Config) ([]MediaData, error) {
-	if path == "" {
-		return nil, nil
+// errNoTautulliSlot is returned when the context ends while waiting for a Tautulli request slot
+var errNoTautulliSlot = errors.New("gave up waiting for a Tautulli slot")
+
+// fetchHistoryLimited runs fetchHistory in a Tautulli request slot
+func fetchHistoryLimited(ctx context.Context, key string, config Config) ([]MediaData, error) {
+	if err := acquireTautulli(ctx); err != nil {
+		return nil, fmt.Errorf("%w: %w", errNoTautulliSlot, err)
 	}
+	defer releaseTautulli()
+	return fetchHistory(ctx, key, config)
+}
 
-	// Extract the key from the path
-	key := extractKeyFromPath(path)
-	if key == "" {
-		if config.Debug {
-			log.Printf("Could not extract key from path: %s", path)
-		}
-		return nil, nil
+// sleepContext waits for d or until the context is cancelled, returning the context's error then
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	// Construct the URL
-	url := fmt.Sprintf("http://%s/api/v2?apikey=%s&cmd=get_history&rating_key=%s&order_column=started&order=desc&length=1",
-		config.APIHost, config.APIKey, key)
+// tautulliClient returns an HTTP client for Tautulli requests honoring the configured timeout
+func tautulliClient(config Config) *http.Client {
+	return &http.Client{Timeout: config.TautulliTimeout}
+}
 
-	// Make the request
-	resp, err := http.Get(url)
+// tautulliGet performs a GET request against Tautulli with the configured User-Agent. The request is
+// cancelled with ctx, e.g. when the webhook that needs it times out.
+func tautulliGet(ctx context.Context, config Config, requestURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if config.TautulliUserAgent != "" {
+		req.Header.Set("User-Agent", config.TautulliUserAgent)
+	}
+	return tautulliClient(config).Do(req)
+}
+
+// checkTautulli calls Tautulli's arnold command to verify that API_HOST and API_KEY are usable.
+// It returns the HTTP status code of the response, or 0 if no response was received.
+func checkTautulli(config Config) (int, error) {
+	params := url.Values{}
+	params.Set("cmd", "arnold")
+
+	resp, err := tautulliGet(context.Background(), config, tautulliURL(config, params))
 	if err != nil {
-		return nil, fmt.Errorf("error making HTTP request: %w", err)
+		return 0, fmt.Errorf("error making HTTP request: %w", err)
 	}
 	defer func() {
 		if closeErr := resp.Body.Close(); closeErr != nil {
@@ -438,54 +2861,83 @@ func fetchMetadata(path string, config Config) ([]MediaData, error) {
 		}
 	}()
 
-	// Check for non-200 status code
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("received non-200 response: %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+		return resp.StatusCode, fmt.Errorf("received non-200 response: %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
 	}
 
-	// Read the response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("error reading response body: %w", err)
+	var result struct {
+		Response struct {
+			Result  string `json:"result"`
+			Message string `json:"message"`
+		} `json:"response"`
 	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return resp.StatusCode, fmt.Errorf("error unmarshaling response: %w", err)
+	}
+	if result.Response.Result != "success" {
+		return resp.StatusCode, fmt.Errorf("tautulli returned result %q: %s", result.Response.Result, result.Response.Message)
+	}
+	return resp.StatusCode, nil
+}
 
-	// Preprocess the JSON to handle various edge cases in the response
-	// This is necessary because the Tautulli API sometimes returns empty strings for numeric fields,
-	// which causes the JSON unmarshaler to fail. We use regular expressions to handle different
-	// spacing patterns in the JSON and replace empty strings with appropriate values.
-	bodyStr := string(body)
-
-	// Use regular expressions to handle different spacing patterns
-	// Replace empty strings with "0" for json.Number fields
-	// The \s* in the regex matches any amount of whitespace, making it flexible with spacing
-	parentMediaIndexRegex := regexp.MustCompile(`"parent_media_index"\s*:\s*""`)
-	bodyStr = parentMediaIndexRegex.ReplaceAllString(bodyStr, `"parent_media_index":"0"`)
-
-	mediaIndexRegex := regexp.MustCompile(`"media_index"\s*:\s*""`)
-	bodyStr = mediaIndexRegex.ReplaceAllString(bodyStr, `"media_index":"0"`)
-
-	// Handle cases for float64 and int fields
-	// Empty strings in these fields would also cause unmarshaling errors
-	watchedStatusRegex := regexp.MustCompile(`"watched_status"\s*:\s*""`)
-	bodyStr = watchedStatusRegex.ReplaceAllString(bodyStr, `"watched_status":0`)
+// tautulliURL builds a Tautulli API URL with all query parameters properly escaped
+func tautulliURL(config Config, params url.Values) string {
+	query := url.Values{}
+	for k, v := range params {
+		query[k] = v
+	}
+	query.Set("apikey", config.APIKey)
 
-	percentCompleteRegex := regexp.MustCompile(`"percent_complete"\s*:\s*""`)
-	bodyStr = percentCompleteRegex.ReplaceAllString(bodyStr, `"percent_complete":0`)
+	// API_HOST may carry a path prefix of its own, join both without doubling slashes
+	host, prefix, _ := strings.Cut(strings.TrimSuffix(config.APIHost, "/"), "/")
+	u := url.URL{
+		Scheme:   "http",
+		Host:     bracketIPv6Host(host),
+		Path:     path.Join("/", prefix, config.tautulliBasePath()),
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
 
-	// Parse the response
-	var tautulliResp TautulliResponse
-	if err := json.Unmarshal([]byte(bodyStr), &tautulliResp); err != nil {
-		return nil, fmt.Errorf("error unmarshaling response: %w", err)
+// bracketIPv6Host brackets an IPv6 address in a host such as "fe80::1:8181", where a trailing
+// numeric group is taken as the port if the rest is still a valid address. Hostnames, IPv4
+// addresses and already bracketed hosts are returned unchanged.
+func bracketIPv6Host(host string) string {
+	if strings.HasPrefix(host, "[") || strings.Count(host, ":") < 2 {
+		return host
 	}
+	if addr, port, ok := cutLast(host, ":"); ok && isDigits(port) {
+		if _, err := netip.ParseAddr(addr); err == nil && strings.Contains(addr, ":") {
+			return net.JoinHostPort(addr, port)
+		}
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return "[" + host + "]"
+	}
+	return host
+}
 
-	// Return the data
-	if tautulliResp.Response.Data.Data == nil {
-		return []MediaData{}, nil
+// cutLast slices s around the last instance of sep
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
 	}
-	return tautulliResp.Response.Data.Data, nil
+	return s, "", false
 }
 
 func extractKeyFromPath(path string) string {
+	// Strip any scheme, host and query string, e.g. from http://plex:32400/library/metadata/12345?includeChildren=1
+	if u, err := url.Parse(path); err == nil {
+		path = u.Path
+	} else {
+		path, _, _ = strings.Cut(path, "?")
+	}
+
+	// Plex appends these suffixes when referring to an item's children
+	path = strings.TrimSuffix(path, "/")
+	path = strings.TrimSuffix(path, "/children")
+	path = strings.TrimSuffix(path, "/allLeaves")
+
 	// Look for "/library/metadata/" and extract the numeric key
 	const prefix = "/library/metadata/"
 	if idx := strings.Index(path, prefix); idx != -1 { // Fixed to use strings.Index
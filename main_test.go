@@ -1,14 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"maps"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 func TestGetEnv(t *testing.T) {
@@ -86,6 +100,66 @@ func TestLoadConfig(t *testing.T) {
 	}
 }
 
+func TestLoadConfigExpandsPaths(t *testing.T) {
+	t.Setenv("DATA", "/srv/data")
+	t.Setenv("OUTPUT_DIR", "${DATA}/watched")
+	t.Setenv("PARTIAL_DIR", "$DATA/partial")
+	t.Setenv("LOG_FILE", "$DATA/plex-clean.log")
+
+	config := loadConfig()
+
+	testCases := []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		{name: "OUTPUT_DIR", value: config.OutputDir, expected: "/srv/data/watched"},
+		{name: "PARTIAL_DIR", value: config.PartialDir, expected: "/srv/data/partial"},
+		{name: "LOG_FILE", value: config.LogFile, expected: "/srv/data/plex-clean.log"},
+	}
+	for _, tc := range testCases {
+		if tc.value != tc.expected {
+			t.Errorf("%s = %q, expected %q", tc.name, tc.value, tc.expected)
+		}
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		server := newServer(loadConfig(), http.NotFoundHandler())
+		if server.ReadTimeout != 30*time.Second {
+			t.Errorf("ReadTimeout = %v, expected 30s", server.ReadTimeout)
+		}
+		if server.WriteTimeout != 2*time.Minute {
+			t.Errorf("WriteTimeout = %v, expected 2m", server.WriteTimeout)
+		}
+		if server.IdleTimeout != 2*time.Minute {
+			t.Errorf("IdleTimeout = %v, expected 2m", server.IdleTimeout)
+		}
+	})
+
+	t.Run("Configured", func(t *testing.T) {
+		t.Setenv("PORT", "9090")
+		t.Setenv("SERVER_READ_TIMEOUT", "5s")
+		t.Setenv("SERVER_WRITE_TIMEOUT", "10s")
+		t.Setenv("SERVER_IDLE_TIMEOUT", "0")
+
+		server := newServer(loadConfig(), http.NotFoundHandler())
+		if server.Addr != ":9090" {
+			t.Errorf("Addr = %q, expected %q", server.Addr, ":9090")
+		}
+		if server.ReadTimeout != 5*time.Second {
+			t.Errorf("ReadTimeout = %v, expected 5s", server.ReadTimeout)
+		}
+		if server.WriteTimeout != 10*time.Second {
+			t.Errorf("WriteTimeout = %v, expected 10s", server.WriteTimeout)
+		}
+		if server.IdleTimeout != 0 {
+			t.Errorf("IdleTimeout = %v, expected 0", server.IdleTimeout)
+		}
+	})
+}
+
 func TestFetchMetadata(t *testing.T) {
 	// This test verifies that the fetchMetadata function correctly handles various edge cases
 	// in the JSON response from the Tautulli API, including:
@@ -245,7 +319,7 @@ func TestFetchMetadata(t *testing.T) {
 	}
 
 	// Test with a valid path
-	mediaData, err := fetchMetadata("/library/metadata/12345", config)
+	mediaData, err := fetchMetadata(t.Context(), "/library/metadata/12345", config)
 	if err != nil {
 		t.Errorf("fetchMetadata returned error: %v", err)
 	}
@@ -257,7 +331,7 @@ func TestFetchMetadata(t *testing.T) {
 	}
 
 	// Test with an empty path
-	mediaData, err = fetchMetadata("", config)
+	mediaData, err = fetchMetadata(t.Context(), "", config)
 	if err != nil {
 		t.Errorf("fetchMetadata returned error: %v", err)
 	}
@@ -266,7 +340,7 @@ func TestFetchMetadata(t *testing.T) {
 	}
 
 	// Test with a path that doesn't contain "/library/metadata/"
-	mediaData, err = fetchMetadata("/some/other/path", config)
+	mediaData, err = fetchMetadata(t.Context(), "/some/other/path", config)
 	if err != nil {
 		t.Errorf("fetchMetadata returned error: %v", err)
 	}
@@ -275,7 +349,7 @@ func TestFetchMetadata(t *testing.T) {
 	}
 
 	// Test with a path that would return empty strings for number fields
-	mediaData, err = fetchMetadata("/library/metadata/67890", config)
+	mediaData, err = fetchMetadata(t.Context(), "/library/metadata/67890", config)
 	if err != nil {
 		t.Errorf("fetchMetadata returned error: %v", err)
 	}
@@ -304,7 +378,7 @@ func TestFetchMetadata(t *testing.T) {
 	}
 
 	// Test with a path that would return empty strings for other numeric fields (WatchedStatus, PercentComplete)
-	mediaData, err = fetchMetadata("/library/metadata/11111", config)
+	mediaData, err = fetchMetadata(t.Context(), "/library/metadata/11111", config)
 	if err != nil {
 		t.Errorf("fetchMetadata returned error: %v", err)
 	}
@@ -340,7 +414,7 @@ func TestFetchMetadata(t *testing.T) {
 	}
 
 	// Test with a path that would return null values in JSON fields
-	mediaData, err = fetchMetadata("/library/metadata/22222", config)
+	mediaData, err = fetchMetadata(t.Context(), "/library/metadata/22222", config)
 	if err != nil {
 		t.Errorf("fetchMetadata returned error: %v", err)
 	}
@@ -369,7 +443,7 @@ func TestFetchMetadata(t *testing.T) {
 	}
 
 	// Test with a path that would return missing fields in JSON response
-	mediaData, err = fetchMetadata("/library/metadata/33333", config)
+	mediaData, err = fetchMetadata(t.Context(), "/library/metadata/33333", config)
 	if err != nil {
 		t.Errorf("fetchMetadata returned error: %v", err)
 	}
@@ -396,7 +470,7 @@ func TestFetchMetadata(t *testing.T) {
 	}
 
 	// Test with a path that would return different spacing patterns in JSON
-	mediaData, err = fetchMetadata("/library/metadata/44444", config)
+	mediaData, err = fetchMetadata(t.Context(), "/library/metadata/44444", config)
 	if err != nil {
 		t.Errorf("fetchMetadata returned error: %v", err)
 	}
@@ -431,7 +505,7 @@ func TestFetchMetadata(t *testing.T) {
 	}
 
 	// Test with a path that would return malformed JSON response
-	mediaData, err = fetchMetadata("/library/metadata/55555", config)
+	mediaData, err = fetchMetadata(t.Context(), "/library/metadata/55555", config)
 	if err == nil {
 		t.Errorf("fetchMetadata did not return an error for malformed JSON")
 	} else {
@@ -442,6 +516,115 @@ func TestFetchMetadata(t *testing.T) {
 	}
 }
 
+func TestFetchMetadataEscapesQueryParams(t *testing.T) {
+	// An API key with reserved characters must not break the URL or inject extra params
+	apiKey := "abc+def&cmd=delete_history"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if got := query.Get("apikey"); got != apiKey {
+			t.Errorf("apikey = %q, expected %q", got, apiKey)
+		}
+		if got := query["cmd"]; len(got) != 1 || got[0] != "get_history" {
+			t.Errorf("cmd = %v, expected [get_history]", got)
+		}
+		if got := query.Get("rating_key"); got != "12345" {
+			t.Errorf("rating_key = %q, expected 12345", got)
+		}
+
+		response := TautulliResponse{}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			t.Errorf("Error encoding response: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	config := Config{
+		APIHost: strings.TrimPrefix(server.URL, "http://"),
+		APIKey:  apiKey,
+	}
+
+	if _, err := fetchMetadata(t.Context(), "/library/metadata/12345", config); err != nil {
+		t.Errorf("fetchMetadata returned error: %v", err)
+	}
+}
+
+func TestFetchMetadataHistoryFilters(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		expected := map[string]string{
+			"media_type":         "episode",
+			"user_id":            "42",
+			"transcode_decision": "direct play",
+			"rating_key":         "12345",
+		}
+		for name, value := range expected {
+			if got := query.Get(name); got != value {
+				t.Errorf("%s = %q, expected %q", name, got, value)
+			}
+		}
+		if !strings.Contains(r.URL.RawQuery, "transcode_decision=direct+play") {
+			t.Errorf("query = %q, expected an encoded transcode_decision", r.URL.RawQuery)
+		}
+
+		response := TautulliResponse{}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			t.Errorf("Error encoding response: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	config := Config{
+		APIHost:                   strings.TrimPrefix(server.URL, "http://"),
+		APIKey:                    "test-key",
+		TautulliMediaType:         "episode",
+		TautulliUserID:            "42",
+		TautulliTranscodeDecision: "direct play",
+	}
+
+	if _, err := fetchMetadata(t.Context(), "/library/metadata/12345", config); err != nil {
+		t.Errorf("fetchMetadata returned error: %v", err)
+	}
+}
+
+func TestFetchMetadataKeyParamFallback(t *testing.T) {
+	var queried []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		response := TautulliResponse{}
+		for _, param := range []string{"rating_key", "parent_rating_key", "grandparent_rating_key"} {
+			if query.Get(param) == "12345" {
+				queried = append(queried, param)
+				if param == "grandparent_rating_key" {
+					response.Response.Data.Data = []MediaData{{FullTitle: "Grandparent Match", WatchedStatus: 1.0}}
+				}
+			}
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			t.Errorf("Error encoding response: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	config := Config{
+		APIHost:           strings.TrimPrefix(server.URL, "http://"),
+		APIKey:            "test-key",
+		TautulliKeyParams: []string{"rating_key", "parent_rating_key", "grandparent_rating_key"},
+	}
+
+	rows, err := fetchMetadata(t.Context(), "/library/metadata/12345", config)
+	if err != nil {
+		t.Fatalf("fetchMetadata returned error: %v", err)
+	}
+	expected := []string{"rating_key", "parent_rating_key", "grandparent_rating_key"}
+	if !slices.Equal(queried, expected) {
+		t.Errorf("queried = %v, expected %v", queried, expected)
+	}
+	if len(rows) != 1 || rows[0].FullTitle != "Grandparent Match" {
+		t.Errorf("rows = %v, expected the grandparent match", rows)
+	}
+}
+
 func TestJellyfinWebhookHandler(t *testing.T) {
 	// Create a temporary directory for output
 	tempDir, err := os.MkdirTemp("", "test-jellyfin-output")
@@ -651,6 +834,9 @@ func TestJellyfinWebhookHandler(t *testing.T) {
 				if fileData.PercentComplete != 100 {
 					t.Errorf("fileData.PercentComplete = %d, expected 100", fileData.PercentComplete)
 				}
+				if fileData.Source != SourceJellyfin {
+					t.Errorf("fileData.Source = %q, expected %q", fileData.Source, SourceJellyfin)
+				}
 			}
 		})
 	}
@@ -713,9 +899,7 @@ func TestWebhookHandler(t *testing.T) {
 	// Create a test request with a valid payload
 	payload := PlexWebhookPayload{
 		Event: "media.stop",
-		Metadata: struct {
-			Key string `json:"key"`
-		}{
+		Metadata: PlexMetadata{
 			Key: "/library/metadata/12345",
 		},
 	}
@@ -754,7 +938,7 @@ func TestWebhookHandler(t *testing.T) {
 
 		// Fetch metadata
 		config := loadConfig()
-		mediaData, err := fetchMetadata(p.Metadata.Key, config)
+		mediaData, err := fetchMetadata(t.Context(), p.Metadata.Key, config)
 		if err != nil {
 			t.Fatalf("Error fetching metadata: %v", err)
 		}
@@ -831,3 +1015,3082 @@ func TestWebhookHandler(t *testing.T) {
 		t.Errorf("fileData.PercentComplete = %d, expected 98", fileData.PercentComplete)
 	}
 }
+
+// newPlexRequest builds a multipart Plex webhook request carrying the given payload
+func newPlexRequest(t *testing.T, path string, payload PlexWebhookPayload) *http.Request {
+	t.Helper()
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("Error marshaling payload: %v", err)
+	}
+	body := strings.NewReader("--X\r\nContent-Disposition: form-data; name=\"payload\"\r\n\r\n" + string(payloadBytes) + "\r\n--X--\r\n")
+	req := httptest.NewRequest("POST", path, body)
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=X")
+	return req
+}
+
+// newTautulliServer starts a mock Tautulli server that always returns the given rows
+func newTautulliServer(t *testing.T, rows []MediaData) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := TautulliResponse{}
+		response.Response.Data.Data = rows
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			t.Errorf("Error encoding response: %v", err)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPlexMinPercentComplete(t *testing.T) {
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{
+			FullTitle:        "Test Show",
+			ParentMediaIndex: json.Number("1"),
+			MediaIndex:       json.Number("2"),
+			WatchedStatus:    1.0,
+			PercentComplete:  85,
+		},
+	})
+
+	testCases := []struct {
+		name        string
+		minPercent  int
+		shouldExist bool
+	}{
+		{name: "At threshold", minPercent: 85, shouldExist: true},
+		{name: "Below threshold", minPercent: 90, shouldExist: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{
+				APIHost:            strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:             "test-key",
+				OutputDir:          t.TempDir(),
+				MinPercentComplete: tc.minPercent,
+			}
+
+			req := newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event:    "media.stop",
+				Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+			})
+			rr := httptest.NewRecorder()
+			handlePlexWebhook(rr, req, config)
+
+			if rr.Code != http.StatusOK {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+
+			_, err := os.Stat(filepath.Join(config.OutputDir, "Test Show - S1E2.json"))
+			if fileExists := err == nil; fileExists != tc.shouldExist {
+				t.Errorf("file exists = %v, expected %v", fileExists, tc.shouldExist)
+			}
+		})
+	}
+}
+
+func TestCheckTautulli(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cmd := r.URL.Query().Get("cmd"); cmd != "arnold" {
+			t.Errorf("cmd = %q, expected arnold", cmd)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("apikey") != "good-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"response": {"result": "error", "message": "Invalid apikey", "data": {}}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"response": {"result": "success", "message": null, "data": "I'll be back"}}`))
+	}))
+	defer server.Close()
+
+	config := Config{
+		APIHost:         strings.TrimPrefix(server.URL, "http://"),
+		APIKey:          "good-key",
+		TautulliTimeout: 5 * time.Second,
+	}
+
+	// Test a successful check
+	status, err := checkTautulli(config)
+	if err != nil {
+		t.Errorf("checkTautulli returned error: %v", err)
+	}
+	if status != http.StatusOK {
+		t.Errorf("checkTautulli returned status %d, expected %d", status, http.StatusOK)
+	}
+
+	// Test an authentication failure
+	config.APIKey = "bad-key"
+	status, err = checkTautulli(config)
+	if err == nil {
+		t.Errorf("checkTautulli did not return an error for an invalid API key")
+	}
+	if status != http.StatusUnauthorized {
+		t.Errorf("checkTautulli returned status %d, expected %d", status, http.StatusUnauthorized)
+	}
+}
+
+// newJellyfinRequest builds a JSON Jellyfin webhook request with the given raw body
+func newJellyfinRequest(path, body string) *http.Request {
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// captureLog redirects the standard logger into a buffer for the duration of the test
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	previous := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() {
+		log.SetOutput(previous)
+	})
+	return &buf
+}
+
+func TestJellyfinSeasonItemType(t *testing.T) {
+	logs := captureLog(t)
+	config := Config{OutputDir: t.TempDir()}
+
+	req := newJellyfinRequest("/jellyfin", `{
+		"NotificationType": "PlaybackStop",
+		"ItemType": "Season",
+		"Name": "Season 1",
+		"SeriesName": "Test Series",
+		"MediaStatus": {"PlayedToCompletion": true}
+	}`)
+	rr := httptest.NewRecorder()
+	handleJellyfinWebhook(rr, req, config)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	files, err := os.ReadDir(config.OutputDir)
+	if err != nil {
+		t.Fatalf("Error reading output dir: %v", err)
+	}
+	if len(files) != 0 {
+		t.Errorf("Expected no files to be written for a Season, found %d", len(files))
+	}
+
+	if !strings.Contains(logs.String(), `Jellyfin Season "Season 1" marked as played`) {
+		t.Errorf("Expected a warning about the Season item, got logs: %s", logs.String())
+	}
+}
+
+func TestWriteMediaDataOnConflict(t *testing.T) {
+	data := MediaData{
+		FullTitle:        "Test Show",
+		ParentMediaIndex: json.Number("1"),
+		MediaIndex:       json.Number("2"),
+		WatchedStatus:    1.0,
+		PercentComplete:  100,
+	}
+	const filename = "Test Show - S1E2.json"
+	const existingContent = "existing"
+
+	testCases := []struct {
+		name             string
+		onConflict       string
+		expectedPath     string
+		expectedExisting string
+	}{
+		{name: "Overwrite", onConflict: OnConflictOverwrite, expectedPath: filename},
+		{name: "Default overwrites", onConflict: "", expectedPath: filename},
+		{name: "Skip", onConflict: OnConflictSkip, expectedPath: "", expectedExisting: existingContent},
+		{name: "Suffix", onConflict: OnConflictSuffix, expectedPath: "Test Show - S1E2 (1).json", expectedExisting: existingContent},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{OutputDir: t.TempDir(), OnConflict: tc.onConflict}
+			existingPath := filepath.Join(config.OutputDir, filename)
+			if err := os.WriteFile(existingPath, []byte(existingContent), 0644); err != nil {
+				t.Fatalf("Error writing existing file: %v", err)
+			}
+
+			outputPath, err := writeMediaData(t.Context(), config, config.OutputDir, filename, data)
+			if err != nil {
+				t.Fatalf("writeMediaData returned error: %v", err)
+			}
+
+			expectedPath := ""
+			if tc.expectedPath != "" {
+				expectedPath = filepath.Join(config.OutputDir, tc.expectedPath)
+			}
+			if outputPath != expectedPath {
+				t.Errorf("writeMediaData returned path %q, expected %q", outputPath, expectedPath)
+			}
+
+			if tc.expectedExisting != "" {
+				content, err := os.ReadFile(existingPath)
+				if err != nil {
+					t.Fatalf("Error reading existing file: %v", err)
+				}
+				if string(content) != tc.expectedExisting {
+					t.Errorf("existing file content = %q, expected %q", content, tc.expectedExisting)
+				}
+			}
+
+			if outputPath != "" {
+				content, err := os.ReadFile(outputPath)
+				if err != nil {
+					t.Fatalf("Error reading output file: %v", err)
+				}
+				var fileData MediaData
+				if err := json.Unmarshal(content, &fileData); err != nil {
+					t.Errorf("Error unmarshaling output file: %v", err)
+				}
+			}
+		})
+	}
+
+	// A second suffix write picks the next free number
+	config := Config{OutputDir: t.TempDir(), OnConflict: OnConflictSuffix}
+	for i := 0; i < 3; i++ {
+		if _, err := writeMediaData(t.Context(), config, config.OutputDir, filename, data); err != nil {
+			t.Fatalf("writeMediaData returned error: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(config.OutputDir, "Test Show - S1E2 (2).json")); err != nil {
+		t.Errorf("Expected suffixed file (2) to exist: %v", err)
+	}
+}
+
+func TestJellyfinStringSeasonEpisodeNumbers(t *testing.T) {
+	testCases := []struct {
+		name    string
+		season  string
+		episode string
+	}{
+		{name: "Numeric", season: `1`, episode: `2`},
+		{name: "Zero-padded strings", season: `"01"`, episode: `"02"`},
+		{name: "Plain strings", season: `"1"`, episode: `"2"`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{OutputDir: t.TempDir()}
+			req := newJellyfinRequest("/jellyfin", `{
+				"NotificationType": "PlaybackStop",
+				"ItemType": "Episode",
+				"Name": "Test Episode",
+				"SeriesName": "Test Series",
+				"SeasonNumber": `+tc.season+`,
+				"EpisodeNumber": `+tc.episode+`,
+				"MediaStatus": {"PlayedToCompletion": true}
+			}`)
+			rr := httptest.NewRecorder()
+			handleJellyfinWebhook(rr, req, config)
+
+			if rr.Code != http.StatusOK {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			if _, err := os.Stat(filepath.Join(config.OutputDir, "Test Series - S1E2.json")); err != nil {
+				t.Errorf("Expected file to be written: %v", err)
+			}
+		})
+	}
+}
+
+func TestFlexibleIntUnmarshal(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected FlexibleInt
+		wantErr  bool
+	}{
+		{input: `3`, expected: 3},
+		{input: `"03"`, expected: 3},
+		{input: `""`, expected: 0},
+		{input: `null`, expected: 0},
+		{input: `98.5`, expected: 99},
+		{input: `"97.2"`, expected: 97},
+		{input: `"abc"`, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		var value FlexibleInt
+		err := json.Unmarshal([]byte(tc.input), &value)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Unmarshal(%s) error = %v, wantErr %v", tc.input, err, tc.wantErr)
+			continue
+		}
+		if !tc.wantErr && value != tc.expected {
+			t.Errorf("Unmarshal(%s) = %d, expected %d", tc.input, value, tc.expected)
+		}
+	}
+}
+
+func TestPlexWebhookRecordsSource(t *testing.T) {
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{
+			FullTitle:        "Test Show",
+			ParentMediaIndex: json.Number("1"),
+			MediaIndex:       json.Number("2"),
+			WatchedStatus:    1.0,
+			PercentComplete:  98,
+		},
+	})
+	config := Config{
+		APIHost:   strings.TrimPrefix(tautulliServer.URL, "http://"),
+		APIKey:    "test-key",
+		OutputDir: t.TempDir(),
+	}
+
+	req := newPlexRequest(t, "/plex", PlexWebhookPayload{
+		Event:    "media.stop",
+		Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+	})
+	rr := httptest.NewRecorder()
+	handlePlexWebhook(rr, req, config)
+
+	fileContent, err := os.ReadFile(filepath.Join(config.OutputDir, "Test Show - S1E2.json"))
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	var fileData MediaData
+	if err := json.Unmarshal(fileContent, &fileData); err != nil {
+		t.Fatalf("Error unmarshaling file content: %v", err)
+	}
+	if fileData.Source != SourcePlex {
+		t.Errorf("fileData.Source = %q, expected %q", fileData.Source, SourcePlex)
+	}
+}
+
+// setNow replaces the package clock with a fixed time for the duration of the test
+func setNow(t *testing.T, fixed time.Time) {
+	t.Helper()
+	previous := now
+	now = func() time.Time { return fixed }
+	t.Cleanup(func() {
+		now = previous
+	})
+}
+
+func TestWatchedAtTimestamp(t *testing.T) {
+	setNow(t, time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC))
+
+	// Jellyfin writes use the injected clock
+	config := Config{OutputDir: t.TempDir()}
+	rr := httptest.NewRecorder()
+	handleJellyfinWebhook(rr, newJellyfinRequest("/jellyfin", `{
+		"NotificationType": "PlaybackStop",
+		"ItemType": "Movie",
+		"Name": "Test Movie",
+		"MediaStatus": {"PlayedToCompletion": true}
+	}`), config)
+
+	fileContent, err := os.ReadFile(filepath.Join(config.OutputDir, "Test Movie.json"))
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	var fileData MediaData
+	if err := json.Unmarshal(fileContent, &fileData); err != nil {
+		t.Fatalf("Error unmarshaling file content: %v", err)
+	}
+	if fileData.WatchedAt != "2024-03-01T12:30:00Z" {
+		t.Errorf("fileData.WatchedAt = %q, expected 2024-03-01T12:30:00Z", fileData.WatchedAt)
+	}
+
+	// Tautulli's stopped and date epochs take precedence over the clock
+	if got := watchedAt(MediaData{Stopped: 1700000000, Date: 1600000000}, nil); got != "2023-11-14T22:13:20Z" {
+		t.Errorf("watchedAt with stopped = %q, expected 2023-11-14T22:13:20Z", got)
+	}
+	if got := watchedAt(MediaData{Date: 1600000000}, nil); got != "2020-09-13T12:26:40Z" {
+		t.Errorf("watchedAt with date = %q, expected 2020-09-13T12:26:40Z", got)
+	}
+}
+
+func TestJellyfinMultiEpisode(t *testing.T) {
+	config := Config{OutputDir: t.TempDir()}
+	rr := httptest.NewRecorder()
+	handleJellyfinWebhook(rr, newJellyfinRequest("/jellyfin", `{
+		"NotificationType": "PlaybackStop",
+		"ItemType": "Episode",
+		"Name": "Double Episode",
+		"SeriesName": "Test Series",
+		"SeasonNumber": 1,
+		"EpisodeNumber": 2,
+		"IndexNumberEnd": 3,
+		"MediaStatus": {"PlayedToCompletion": true}
+	}`), config)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	files, err := os.ReadDir(config.OutputDir)
+	if err != nil {
+		t.Fatalf("Error reading output dir: %v", err)
+	}
+	if len(files) != 2 {
+		t.Errorf("Expected 2 files to be written, found %d", len(files))
+	}
+	for _, filename := range []string{"Test Series - S1E2.json", "Test Series - S1E3.json"} {
+		if _, err := os.Stat(filepath.Join(config.OutputDir, filename)); err != nil {
+			t.Errorf("Expected file %s to exist: %v", filename, err)
+		}
+	}
+
+	// A span of more than 10 episodes is rejected instead of fanning out into one file per episode
+	config = Config{OutputDir: t.TempDir()}
+	rr = httptest.NewRecorder()
+	handleJellyfinWebhook(rr, newJellyfinRequest("/jellyfin", `{
+		"NotificationType": "PlaybackStop",
+		"ItemType": "Episode",
+		"Name": "Broken Episode",
+		"SeriesName": "Test Series",
+		"SeasonNumber": 1,
+		"EpisodeNumber": 1,
+		"IndexNumberEnd": 1000000,
+		"MediaStatus": {"PlayedToCompletion": true}
+	}`), config)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if files, _ := os.ReadDir(config.OutputDir); len(files) != 0 {
+		t.Errorf("Expected no files for an oversized episode span, found %d", len(files))
+	}
+}
+
+func TestJellyfinEpisodeSpanValid(t *testing.T) {
+	testCases := []struct {
+		episode, end FlexibleInt
+		expected     bool
+	}{
+		{episode: 2, end: 0, expected: true},
+		{episode: 2, end: 11, expected: true},
+		{episode: 2, end: 12, expected: false},
+		{episode: 5, end: 3, expected: true},
+	}
+
+	for _, tc := range testCases {
+		payload := JellyfinWebhookPayload{EpisodeNumber: tc.episode, IndexNumberEnd: tc.end}
+		if got := payload.episodeSpanValid(); got != tc.expected {
+			t.Errorf("episodeSpanValid(%d-%d) = %v, expected %v", tc.episode, tc.end, got, tc.expected)
+		}
+	}
+}
+
+func TestExtractKeyFromPath(t *testing.T) {
+	testCases := []struct {
+		path     string
+		expected string
+	}{
+		{path: "/library/metadata/12345", expected: "12345"},
+		{path: "12345", expected: ""},
+		{path: "/some/path/67890", expected: "67890"},
+		{path: "/some/other/path", expected: ""},
+		{path: "http://plex:32400/library/metadata/12345?includeChildren=1", expected: "12345"},
+		{path: "/library/metadata/12345?includeChildren=1", expected: "12345"},
+		{path: "/library/metadata/12345/children", expected: "12345"},
+		{path: "/library/metadata/12345/allLeaves", expected: "12345"},
+	}
+
+	for _, tc := range testCases {
+		if got := extractKeyFromPath(tc.path); got != tc.expected {
+			t.Errorf("extractKeyFromPath(%q) = %q, expected %q", tc.path, got, tc.expected)
+		}
+	}
+}
+
+func TestFetchMetadataUserAgent(t *testing.T) {
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		if err := json.NewEncoder(w).Encode(TautulliResponse{}); err != nil {
+			t.Errorf("Error encoding response: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	// The default comes from loadConfig
+	config := loadConfig()
+	config.APIHost = strings.TrimPrefix(server.URL, "http://")
+	if _, err := fetchMetadata(t.Context(), "/library/metadata/12345", config); err != nil {
+		t.Fatalf("fetchMetadata returned error: %v", err)
+	}
+	if userAgent != "plex-clean/"+version {
+		t.Errorf("User-Agent = %q, expected %q", userAgent, "plex-clean/"+version)
+	}
+
+	// A configured value overrides the default
+	config.TautulliUserAgent = "custom-agent/1.0"
+	if _, err := fetchMetadata(t.Context(), "/library/metadata/12345", config); err != nil {
+		t.Fatalf("fetchMetadata returned error: %v", err)
+	}
+	if userAgent != "custom-agent/1.0" {
+		t.Errorf("User-Agent = %q, expected custom-agent/1.0", userAgent)
+	}
+}
+
+func TestPlexRateEvent(t *testing.T) {
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{
+			FullTitle:        "Test Show",
+			ParentMediaIndex: json.Number("1"),
+			MediaIndex:       json.Number("2"),
+			WatchedStatus:    1.0,
+			PercentComplete:  98,
+		},
+	})
+	config := Config{
+		APIHost:    strings.TrimPrefix(tautulliServer.URL, "http://"),
+		APIKey:     "test-key",
+		OutputDir:  t.TempDir(),
+		PlexEvents: []string{PlexEventStop, PlexEventRate},
+	}
+
+	req := newPlexRequest(t, "/plex", PlexWebhookPayload{
+		Event:    PlexEventRate,
+		Metadata: PlexMetadata{Key: "/library/metadata/12345", Rating: 8},
+	})
+	rr := httptest.NewRecorder()
+	handlePlexWebhook(rr, req, config)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	fileContent, err := os.ReadFile(filepath.Join(config.OutputDir, "Test Show - S1E2 - rated.json"))
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	var fileData MediaData
+	if err := json.Unmarshal(fileContent, &fileData); err != nil {
+		t.Fatalf("Error unmarshaling file content: %v", err)
+	}
+	if fileData.Rating != 8 {
+		t.Errorf("fileData.Rating = %v, expected 8", fileData.Rating)
+	}
+
+	// Rate events are ignored unless enabled
+	config.OutputDir = t.TempDir()
+	config.PlexEvents = nil
+	rr = httptest.NewRecorder()
+	handlePlexWebhook(rr, newPlexRequest(t, "/plex", PlexWebhookPayload{
+		Event:    PlexEventRate,
+		Metadata: PlexMetadata{Key: "/library/metadata/12345", Rating: 8},
+	}), config)
+	if files, _ := os.ReadDir(config.OutputDir); len(files) != 0 {
+		t.Errorf("Expected no files when media.rate is not enabled, found %d", len(files))
+	}
+}
+
+func TestTautulliConcurrencyLimit(t *testing.T) {
+	const limit = 2
+	previous := tautulliSemaphore
+	tautulliSemaphore = make(chan struct{}, limit)
+	defer func() {
+		tautulliSemaphore = previous
+	}()
+
+	var inFlight, maxInFlight atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			observed := maxInFlight.Load()
+			if current <= observed || maxInFlight.CompareAndSwap(observed, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		if err := json.NewEncoder(w).Encode(TautulliResponse{}); err != nil {
+			t.Errorf("Error encoding response: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	config := Config{
+		APIHost:   strings.TrimPrefix(server.URL, "http://"),
+		APIKey:    "test-key",
+		OutputDir: t.TempDir(),
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			handlePlexWebhook(rr, newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event:    "media.stop",
+				Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+			}), config)
+		}()
+	}
+	wg.Wait()
+
+	if got := maxInFlight.Load(); got > limit {
+		t.Errorf("Tautulli saw %d concurrent requests, expected at most %d", got, limit)
+	}
+	if got := maxInFlight.Load(); got == 0 {
+		t.Errorf("Tautulli saw no requests")
+	}
+}
+
+func TestTautulliSlotFreeDuringRetryDelay(t *testing.T) {
+	previous := tautulliSemaphore
+	tautulliSemaphore = make(chan struct{}, 1)
+	defer func() {
+		tautulliSemaphore = previous
+	}()
+
+	queried := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewEncoder(w).Encode(TautulliResponse{}); err != nil {
+			t.Errorf("Error encoding response: %v", err)
+		}
+		queried <- struct{}{}
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name   string
+		config Config
+	}{
+		{name: "Empty data retry", config: Config{
+			EmptyDataBehavior:   EmptyDataRetry,
+			EmptyDataRetries:    1,
+			EmptyDataRetryDelay: 300 * time.Millisecond,
+		}},
+		{name: "Settle retry", config: Config{
+			TautulliSettleRetries: 1,
+			TautulliSettleDelay:   300 * time.Millisecond,
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := tc.config
+			config.APIHost = strings.TrimPrefix(server.URL, "http://")
+			config.APIKey = "test-key"
+			config.OutputDir = t.TempDir()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				handlePlexWebhook(httptest.NewRecorder(), newPlexRequest(t, "/plex", PlexWebhookPayload{
+					Event:    PlexEventStop,
+					Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+				}), config)
+			}()
+
+			// While the webhook waits to query again, other requests can use the only slot
+			<-queried
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			if err := acquireTautulli(ctx); err != nil {
+				t.Errorf("acquireTautulli() during the retry delay error = %v, expected a free slot", err)
+			} else {
+				releaseTautulli()
+			}
+			<-done
+			if retries := len(queried); retries != 1 {
+				t.Errorf("Tautulli queries after the first = %d, expected 1 retry", retries)
+			}
+			for len(queried) > 0 {
+				<-queried
+			}
+		})
+	}
+}
+
+func TestAcquireTautulliRespectsCancellation(t *testing.T) {
+	previous := tautulliSemaphore
+	tautulliSemaphore = make(chan struct{}, 1)
+	defer func() {
+		tautulliSemaphore = previous
+	}()
+
+	if err := acquireTautulli(context.Background()); err != nil {
+		t.Fatalf("acquireTautulli returned error: %v", err)
+	}
+	defer releaseTautulli()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := acquireTautulli(ctx); err == nil {
+		t.Errorf("acquireTautulli did not return an error for a cancelled context")
+	}
+}
+
+func TestOutputExtension(t *testing.T) {
+	config := Config{OutputDir: t.TempDir(), OutputExtension: ".watched.json", OnConflict: OnConflictSuffix}
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		handleJellyfinWebhook(rr, newJellyfinRequest("/jellyfin", `{
+			"NotificationType": "PlaybackStop",
+			"ItemType": "Episode",
+			"Name": "Test Episode",
+			"SeriesName": "Test Series",
+			"SeasonNumber": 1,
+			"EpisodeNumber": 2,
+			"MediaStatus": {"PlayedToCompletion": true}
+		}`), config)
+	}
+
+	for _, filename := range []string{"Test Series - S1E2.watched.json", "Test Series - S1E2 (1).watched.json"} {
+		if _, err := os.Stat(filepath.Join(config.OutputDir, filename)); err != nil {
+			t.Errorf("Expected file %s to exist: %v", filename, err)
+		}
+	}
+
+	// Extensions without a leading dot fall back to the default
+	if err := os.Setenv("OUTPUT_EXTENSION", "txt"); err != nil {
+		t.Fatalf("Failed to set environment variable OUTPUT_EXTENSION: %v", err)
+	}
+	defer func() {
+		if err := os.Unsetenv("OUTPUT_EXTENSION"); err != nil {
+			t.Logf("Failed to unset environment variable OUTPUT_EXTENSION: %v", err)
+		}
+	}()
+	if ext := loadConfig().OutputExtension; ext != ".json" {
+		t.Errorf("config.OutputExtension = %q, expected .json", ext)
+	}
+}
+
+func TestFetchMetadataUnexpectedDataShape(t *testing.T) {
+	testCases := []struct {
+		name string
+		body string
+	}{
+		{name: "Data is an empty object", body: `{"response": {"result": "success", "data": {}}}`},
+		{name: "Data is a string", body: `{"response": {"result": "success", "data": "error message"}}`},
+		{name: "Inner data is a string", body: `{"response": {"result": "success", "data": {"data": "error message"}}}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(tc.body))
+			}))
+			defer server.Close()
+
+			config := Config{APIHost: strings.TrimPrefix(server.URL, "http://"), APIKey: "test-key"}
+			mediaData, err := fetchMetadata(t.Context(), "/library/metadata/12345", config)
+			if err != nil {
+				t.Errorf("fetchMetadata returned error: %v", err)
+			}
+			if mediaData == nil || len(mediaData) != 0 {
+				t.Errorf("fetchMetadata returned %v, expected an empty slice", mediaData)
+			}
+		})
+	}
+}
+
+func TestFetchMetadataHTMLResponse(t *testing.T) {
+	testCases := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{name: "HTML content type", contentType: "text/html; charset=utf-8", body: `<!DOCTYPE html><html><body>Sign in</body></html>`},
+		{name: "HTML without content type", contentType: "", body: "\n<html><head><title>Login</title></head></html>"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tc.contentType)
+				_, _ = w.Write([]byte(tc.body))
+			}))
+			defer server.Close()
+
+			config := Config{APIHost: strings.TrimPrefix(server.URL, "http://"), APIKey: "test-key"}
+			_, err := fetchMetadata(t.Context(), "/library/metadata/12345", config)
+			if !errors.Is(err, errTautulliNotJSON) {
+				t.Fatalf("fetchMetadata() error = %v, expected %v", err, errTautulliNotJSON)
+			}
+			if !strings.Contains(err.Error(), "non-JSON (auth proxy?)") {
+				t.Errorf("error = %q, expected a hint at an auth proxy", err)
+			}
+		})
+	}
+}
+
+func TestFetchMetadataAPIError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"response": {"result": "error", "message": "Invalid apikey", "data": {}}}`))
+	}))
+	defer server.Close()
+
+	config := Config{APIHost: strings.TrimPrefix(server.URL, "http://"), APIKey: "wrong-key"}
+	_, err := fetchMetadata(t.Context(), "/library/metadata/12345", config)
+	if err == nil {
+		t.Fatalf("fetchMetadata did not return an error for an API error result")
+	}
+	if !strings.Contains(err.Error(), "Invalid apikey") {
+		t.Errorf("Expected error message to contain 'Invalid apikey', got: %v", err)
+	}
+}
+
+func TestTimezone(t *testing.T) {
+	setNow(t, time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC))
+	loc := loadLocation("America/New_York")
+
+	config := Config{OutputDir: t.TempDir(), Location: loc}
+	rr := httptest.NewRecorder()
+	handleJellyfinWebhook(rr, newJellyfinRequest("/jellyfin", `{
+		"NotificationType": "PlaybackStop",
+		"ItemType": "Movie",
+		"Name": "Test Movie",
+		"MediaStatus": {"PlayedToCompletion": true}
+	}`), config)
+
+	fileContent, err := os.ReadFile(filepath.Join(config.OutputDir, "Test Movie.json"))
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	var fileData MediaData
+	if err := json.Unmarshal(fileContent, &fileData); err != nil {
+		t.Fatalf("Error unmarshaling file content: %v", err)
+	}
+	if fileData.WatchedAt != "2024-03-01T07:30:00-05:00" {
+		t.Errorf("fileData.WatchedAt = %q, expected 2024-03-01T07:30:00-05:00", fileData.WatchedAt)
+	}
+
+	// Log lines are stamped in the configured zone
+	var buf bytes.Buffer
+	writer := &timezoneLogWriter{out: &buf, loc: loc}
+	if _, err := writer.Write([]byte("hello\n")); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	if buf.String() != "2024/03/01 07:30:00 hello\n" {
+		t.Errorf("log line = %q, expected %q", buf.String(), "2024/03/01 07:30:00 hello\n")
+	}
+
+	// Invalid and empty zones fall back to UTC
+	if got := loadLocation("Not/AZone"); got != time.UTC {
+		t.Errorf("loadLocation(invalid) = %v, expected UTC", got)
+	}
+	if got := loadLocation(""); got != time.UTC {
+		t.Errorf("loadLocation(empty) = %v, expected UTC", got)
+	}
+}
+
+func TestTimezoneLogWriterConcurrent(t *testing.T) {
+	var buf bytes.Buffer
+	writer := &timezoneLogWriter{out: &buf, loc: time.UTC}
+	loggers := []*log.Logger{
+		log.New(writer, "", 0),
+		log.New(writer, "request_id=a ", log.Lmsgprefix),
+		log.New(writer, "request_id=b ", log.Lmsgprefix),
+	}
+
+	var wg sync.WaitGroup
+	for _, logger := range loggers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				logger.Printf("message")
+			}
+		}()
+	}
+	wg.Wait()
+
+	line := regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} (request_id=[ab] )?message$`)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 300 {
+		t.Fatalf("lines = %d, expected 300", len(lines))
+	}
+	for _, l := range lines {
+		if !line.MatchString(l) {
+			t.Fatalf("log line = %q, expected a timestamp followed by a whole message", l)
+		}
+	}
+}
+
+func TestPlexSkipZeroIndex(t *testing.T) {
+	testCases := []struct {
+		name         string
+		row          MediaData
+		expectedFile string
+		shouldExist  bool
+	}{
+		{
+			name: "Zero-index episode",
+			row: MediaData{
+				FullTitle:        "Unmatched Show",
+				ParentMediaIndex: json.Number("0"),
+				MediaIndex:       json.Number("0"),
+				WatchedStatus:    1.0,
+				MediaType:        "episode",
+			},
+			expectedFile: "Unmatched Show - S0E0.json",
+			shouldExist:  false,
+		},
+		{
+			name: "Movie",
+			row: MediaData{
+				FullTitle:        "Test Movie",
+				ParentMediaIndex: json.Number("0"),
+				MediaIndex:       json.Number("0"),
+				WatchedStatus:    1.0,
+				MediaType:        "movie",
+			},
+			expectedFile: "Test Movie - S0E0.json",
+			shouldExist:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tautulliServer := newTautulliServer(t, []MediaData{tc.row})
+			config := Config{
+				APIHost:       strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:        "test-key",
+				OutputDir:     t.TempDir(),
+				SkipZeroIndex: true,
+			}
+
+			rr := httptest.NewRecorder()
+			handlePlexWebhook(rr, newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event:    "media.stop",
+				Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+			}), config)
+
+			_, err := os.Stat(filepath.Join(config.OutputDir, tc.expectedFile))
+			if fileExists := err == nil; fileExists != tc.shouldExist {
+				t.Errorf("file exists = %v, expected %v", fileExists, tc.shouldExist)
+			}
+		})
+	}
+}
+
+func TestPlexLibraryNewEvent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cmd := r.URL.Query().Get("cmd"); cmd != "get_metadata" {
+			t.Errorf("cmd = %q, expected get_metadata", cmd)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"response": {"result": "success", "data": {
+			"full_title": "New Show - Pilot",
+			"parent_media_index": "1",
+			"media_index": "1",
+			"media_type": "episode"
+		}}}`))
+	}))
+	defer server.Close()
+
+	config := Config{
+		APIHost:     strings.TrimPrefix(server.URL, "http://"),
+		APIKey:      "test-key",
+		OutputDir:   t.TempDir(),
+		NewMediaDir: filepath.Join(t.TempDir(), "new-media"),
+		PlexEvents:  []string{PlexEventStop, PlexEventLibraryNew},
+	}
+
+	rr := httptest.NewRecorder()
+	handlePlexWebhook(rr, newPlexRequest(t, "/plex", PlexWebhookPayload{
+		Event:    PlexEventLibraryNew,
+		Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+	}), config)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	fileContent, err := os.ReadFile(filepath.Join(config.NewMediaDir, "New Show - Pilot - S1E1.json"))
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	var fileData MediaData
+	if err := json.Unmarshal(fileContent, &fileData); err != nil {
+		t.Fatalf("Error unmarshaling file content: %v", err)
+	}
+	if fileData.WatchedStatus != 0 {
+		t.Errorf("fileData.WatchedStatus = %f, expected 0", fileData.WatchedStatus)
+	}
+
+	// Nothing lands in the watched output directory
+	if files, _ := os.ReadDir(config.OutputDir); len(files) != 0 {
+		t.Errorf("Expected no files in the output directory, found %d", len(files))
+	}
+}
+
+func TestPlexWebhookDeliveryStyles(t *testing.T) {
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{
+			FullTitle:        "Test Show",
+			ParentMediaIndex: json.Number("1"),
+			MediaIndex:       json.Number("2"),
+			WatchedStatus:    1.0,
+			PercentComplete:  98,
+		},
+	})
+	payload := PlexWebhookPayload{
+		Event:    "media.stop",
+		Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("Error marshaling payload: %v", err)
+	}
+
+	rawJSON := httptest.NewRequest("POST", "/plex", bytes.NewReader(payloadBytes))
+	rawJSON.Header.Set("Content-Type", "application/json")
+
+	testCases := []struct {
+		name string
+		req  *http.Request
+	}{
+		{name: "Multipart", req: newPlexRequest(t, "/plex", payload)},
+		{name: "Raw JSON", req: rawJSON},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{
+				APIHost:   strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:    "test-key",
+				OutputDir: t.TempDir(),
+			}
+			rr := httptest.NewRecorder()
+			handlePlexWebhook(rr, tc.req, config)
+
+			if rr.Code != http.StatusOK {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			if _, err := os.Stat(filepath.Join(config.OutputDir, "Test Show - S1E2.json")); err != nil {
+				t.Errorf("Expected file to be written: %v", err)
+			}
+		})
+	}
+}
+
+func TestIncludeRawMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"response": {"result": "success", "data": {"data": [{
+			"full_title": "Raw Show",
+			"parent_media_index": "1",
+			"media_index": "2",
+			"watched_status": 1,
+			"percent_complete": 100,
+			"user": "alice",
+			"player": "Living Room"
+		}]}}}`))
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name       string
+		includeRaw bool
+	}{
+		{name: "Enabled", includeRaw: true},
+		{name: "Disabled", includeRaw: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{
+				APIHost:            strings.TrimPrefix(server.URL, "http://"),
+				APIKey:             "test-key",
+				OutputDir:          t.TempDir(),
+				IncludeRawMetadata: tc.includeRaw,
+			}
+
+			rr := httptest.NewRecorder()
+			handlePlexWebhook(rr, newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event:    PlexEventStop,
+				Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+			}), config)
+
+			fileContent, err := os.ReadFile(filepath.Join(config.OutputDir, "Raw Show - S1E2.json"))
+			if err != nil {
+				t.Fatalf("Error reading file: %v", err)
+			}
+			var fileData struct {
+				FullTitle string         `json:"full_title"`
+				Raw       map[string]any `json:"raw"`
+			}
+			if err := json.Unmarshal(fileContent, &fileData); err != nil {
+				t.Fatalf("Error unmarshaling file content: %v", err)
+			}
+
+			if fileData.FullTitle != "Raw Show" {
+				t.Errorf("full_title = %q, expected %q", fileData.FullTitle, "Raw Show")
+			}
+			if !tc.includeRaw {
+				if fileData.Raw != nil {
+					t.Errorf("raw = %v, expected it to be omitted", fileData.Raw)
+				}
+				return
+			}
+			if fileData.Raw["user"] != "alice" || fileData.Raw["player"] != "Living Room" {
+				t.Errorf("raw = %v, expected the extra Tautulli fields", fileData.Raw)
+			}
+		})
+	}
+}
+
+func TestFilenameTemplate(t *testing.T) {
+	episode := MediaData{
+		FullTitle:        "Breaking Bad - Pilot",
+		GrandparentTitle: "Breaking Bad",
+		ParentTitle:      "Season 1",
+		Title:            "Pilot",
+		ParentMediaIndex: json.Number("1"),
+		MediaIndex:       json.Number("1"),
+		WatchedStatus:    1.0,
+	}
+	legacy := episode
+	legacy.GrandparentTitle, legacy.ParentTitle, legacy.Title = "", "", ""
+	traversal := episode
+	traversal.GrandparentTitle, traversal.Title = "../../escaped", `AC\DC`
+
+	testCases := []struct {
+		name     string
+		template string
+		row      MediaData
+		expected string
+	}{
+		{name: "No template", template: "", row: episode, expected: "Breaking Bad - Pilot - S1E1.json"},
+		{name: "Series only", template: "{grandparent_title} - S{season}E{episode}", row: episode, expected: "Breaking Bad - S1E1.json"},
+		{name: "All fields", template: "{grandparent_title}/{parent_title}/{episode} {title}", row: episode, expected: "Breaking Bad/Season 1/1 Pilot.json"},
+		{name: "Falls back to full_title", template: "{grandparent_title} - S{season}E{episode}", row: legacy, expected: "Breaking Bad - Pilot - S1E1.json"},
+		{name: "Paths in titles", template: "{grandparent_title}/{parent_title}/{episode} {title}", row: traversal, expected: "escaped/Season 1/1 ACDC.json"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tautulliServer := newTautulliServer(t, []MediaData{tc.row})
+			config := Config{
+				APIHost:          strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:           "test-key",
+				OutputDir:        t.TempDir(),
+				FilenameTemplate: tc.template,
+			}
+
+			rr := httptest.NewRecorder()
+			handlePlexWebhook(rr, newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event:    PlexEventStop,
+				Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+			}), config)
+
+			fileContent, err := os.ReadFile(filepath.Join(config.OutputDir, tc.expected))
+			if err != nil {
+				t.Fatalf("Error reading file: %v", err)
+			}
+			var fileData MediaData
+			if err := json.Unmarshal(fileContent, &fileData); err != nil {
+				t.Fatalf("Error unmarshaling file content: %v", err)
+			}
+			if fileData.Title != tc.row.Title {
+				t.Errorf("title = %q, expected %q", fileData.Title, tc.row.Title)
+			}
+		})
+	}
+}
+
+func TestFilenameTemplatePerLibrary(t *testing.T) {
+	t.Setenv("FILENAME_TEMPLATE", "{grandparent_title} - S{season}E{episode}")
+	t.Setenv("FILENAME_TEMPLATE_TV_SHOWS", "{grandparent_title} {season}x{episode}")
+	t.Setenv("FILENAME_TEMPLATE_ANIME_JP", "{grandparent_title} - {episode}")
+
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{FullTitle: "Breaking Bad - Pilot", GrandparentTitle: "Breaking Bad", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("1"), WatchedStatus: 1.0, LibraryName: "TV Shows"},
+		{FullTitle: "One Piece - Romance Dawn", GrandparentTitle: "One Piece", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("1"), WatchedStatus: 1.0, LibraryName: "Anime (JP)"},
+		{FullTitle: "Planet Earth - From Pole to Pole", GrandparentTitle: "Planet Earth", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("1"), WatchedStatus: 1.0, LibraryName: "Documentaries"},
+	})
+	config := loadConfig()
+	config.APIHost = strings.TrimPrefix(tautulliServer.URL, "http://")
+	config.APIKey = "test-key"
+	config.OutputDir = t.TempDir()
+
+	rr := httptest.NewRecorder()
+	handlePlexWebhook(rr, newPlexRequest(t, "/plex", PlexWebhookPayload{
+		Event:    PlexEventStop,
+		Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+	}), config)
+
+	testCases := []struct {
+		name     string
+		expected string
+	}{
+		{name: "TV Shows override", expected: "Breaking Bad 1x1.json"},
+		{name: "Anime (JP) override", expected: "One Piece - 1.json"},
+		{name: "Global template for other libraries", expected: "Planet Earth - S1E1.json"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := os.Stat(filepath.Join(config.OutputDir, tc.expected)); err != nil {
+				t.Errorf("Expected %s to be written: %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestFilenameTemplateWebhookLibrary(t *testing.T) {
+	t.Setenv("FILENAME_TEMPLATE_TV_SHOWS", "{grandparent_title} {season}x{episode}")
+
+	// A real get_history row, which has no library_name
+	fixture, err := os.ReadFile("tautulli_example.json")
+	if err != nil {
+		t.Fatalf("Error reading fixture: %v", err)
+	}
+	var row MediaData
+	if err := json.Unmarshal(fixture, &row); err != nil {
+		t.Fatalf("Error unmarshaling fixture: %v", err)
+	}
+	if row.LibraryName != "" {
+		t.Fatalf("fixture library_name = %q, expected none", row.LibraryName)
+	}
+
+	tautulliServer := newTautulliServer(t, []MediaData{row})
+	config := loadConfig()
+	config.APIHost = strings.TrimPrefix(tautulliServer.URL, "http://")
+	config.APIKey = "test-key"
+	config.OutputDir = t.TempDir()
+
+	rr := httptest.NewRecorder()
+	handlePlexWebhook(rr, newPlexRequest(t, "/plex", PlexWebhookPayload{
+		Event:    PlexEventStop,
+		Metadata: PlexMetadata{Key: "/library/metadata/12046", LibrarySectionTitle: "TV Shows"},
+	}), config)
+
+	fileContent, err := os.ReadFile(filepath.Join(config.OutputDir, "Legion 1x6.json"))
+	if err != nil {
+		t.Fatalf("Expected the library template of the webhook's section to be used: %v", err)
+	}
+	var fileData MediaData
+	if err := json.Unmarshal(fileContent, &fileData); err != nil {
+		t.Fatalf("Error unmarshaling file content: %v", err)
+	}
+	if fileData.LibraryName != "TV Shows" {
+		t.Errorf("library_name = %q, expected %q", fileData.LibraryName, "TV Shows")
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	data := MediaData{
+		RatingKey:        12345,
+		FullTitle:        "Test Show",
+		GrandparentTitle: "Test Show",
+		ParentMediaIndex: json.Number("1"),
+		MediaIndex:       json.Number("2"),
+		WatchedStatus:    1.0,
+		PercentComplete:  100,
+		MediaType:        "episode",
+	}
+
+	testCases := []struct {
+		name            string
+		schemaVersion   int
+		expectedVersion float64
+		expectedKeys    []string
+	}{
+		{name: "Default is current", schemaVersion: 0, expectedVersion: SchemaVersionCurrent,
+			expectedKeys: []string{"schema_version", "rating_key", "full_title", "grandparent_title", "parent_media_index", "media_index", "watched_status", "percent_complete", "media_type", "source"}},
+		{name: "Legacy", schemaVersion: SchemaVersionLegacy, expectedVersion: SchemaVersionLegacy,
+			expectedKeys: []string{"schema_version", "full_title", "parent_media_index", "media_index", "watched_status", "percent_complete"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{OutputDir: t.TempDir(), OutputSchemaVersion: tc.schemaVersion}
+			row := data
+			row.Source = SourcePlex
+			outputPath, err := writeMediaData(t.Context(), config, config.OutputDir, "Test Show - S1E2.json", row)
+			if err != nil {
+				t.Fatalf("writeMediaData() error = %v", err)
+			}
+
+			content, err := os.ReadFile(outputPath)
+			if err != nil {
+				t.Fatalf("Error reading file: %v", err)
+			}
+			var fields map[string]any
+			if err := json.Unmarshal(content, &fields); err != nil {
+				t.Fatalf("Error unmarshaling file content: %v", err)
+			}
+			if fields["schema_version"] != tc.expectedVersion {
+				t.Errorf("schema_version = %v, expected %v", fields["schema_version"], tc.expectedVersion)
+			}
+			keys := slices.Collect(maps.Keys(fields))
+			slices.Sort(keys)
+			expected := slices.Clone(tc.expectedKeys)
+			slices.Sort(expected)
+			if !slices.Equal(keys, expected) {
+				t.Errorf("keys = %v, expected %v", keys, expected)
+			}
+		})
+	}
+
+	// OUTPUT_SCHEMA_VERSION falls back to the current version when out of range
+	t.Setenv("OUTPUT_SCHEMA_VERSION", "7")
+	if got := loadConfig().schemaVersion(); got != SchemaVersionCurrent {
+		t.Errorf("schemaVersion() = %d, expected %d", got, SchemaVersionCurrent)
+	}
+}
+
+func TestTruncateFilename(t *testing.T) {
+	longTitle := strings.Repeat("Überlanger Serientitel ", 20)
+
+	first := Config{MaxFilenameBytes: 100}.outputFilename(longTitle + "A - S1E2")
+	second := Config{MaxFilenameBytes: 100}.outputFilename(longTitle + "B - S1E2")
+	for _, filename := range []string{first, second} {
+		if len(filename) > 100 {
+			t.Errorf("len(%q) = %d, expected at most 100", filename, len(filename))
+		}
+		if !strings.HasSuffix(filename, " - S1E2.json") {
+			t.Errorf("filename %q lost the episode suffix or extension", filename)
+		}
+		if !utf8.ValidString(filename) {
+			t.Errorf("filename %q is not valid UTF-8", filename)
+		}
+	}
+	if first == second {
+		t.Errorf("truncated filenames collide: %q", first)
+	}
+
+	if filename := (Config{}).outputFilename(longTitle + " - S1E2"); len(filename) > defaultMaxFilenameBytes {
+		t.Errorf("len(filename) = %d, expected at most %d by default", len(filename), defaultMaxFilenameBytes)
+	}
+	if filename := (Config{}).outputFilename("Short Show - S1E2"); filename != "Short Show - S1E2.json" {
+		t.Errorf("filename = %q, expected short names to be unchanged", filename)
+	}
+}
+
+func TestJellyfinUserDataSaved(t *testing.T) {
+	const markPlayed = `{
+		"NotificationType": "UserDataSaved",
+		"SaveReason": "TogglePlayed",
+		"Played": true,
+		"ItemType": "Episode",
+		"Name": "Pilot",
+		"SeriesName": "Marked Series",
+		"SeasonNumber": 1,
+		"EpisodeNumber": 1
+	}`
+
+	testCases := []struct {
+		name        string
+		events      []string
+		body        string
+		shouldExist bool
+	}{
+		{name: "Enabled", events: []string{JellyfinEventPlaybackStop, JellyfinEventUserDataSaved}, body: markPlayed, shouldExist: true},
+		{name: "Not enabled by default", events: nil, body: markPlayed, shouldExist: false},
+		{name: "Marked unplayed", events: []string{JellyfinEventUserDataSaved}, body: strings.Replace(markPlayed, `"Played": true`, `"Played": false`, 1), shouldExist: false},
+		{name: "Playback finished", events: []string{JellyfinEventUserDataSaved}, body: strings.Replace(markPlayed, "TogglePlayed", "PlaybackFinished", 1), shouldExist: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{OutputDir: t.TempDir(), JellyfinEvents: tc.events}
+
+			rr := httptest.NewRecorder()
+			handleJellyfinWebhook(rr, newJellyfinRequest("/jellyfin", tc.body), config)
+
+			if rr.Code != http.StatusOK {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			_, err := os.Stat(filepath.Join(config.OutputDir, "Marked Series - S1E1.json"))
+			if fileExists := err == nil; fileExists != tc.shouldExist {
+				t.Errorf("file exists = %v, expected %v", fileExists, tc.shouldExist)
+			}
+		})
+	}
+}
+
+func TestPlexPartiallyWatched(t *testing.T) {
+	testCases := []struct {
+		name            string
+		watchedStatus   float64
+		percentComplete FlexibleInt
+		expectedDir     string
+	}{
+		{name: "Abandoned at 70%", watchedStatus: 0, percentComplete: 70, expectedDir: "partial"},
+		{name: "Completed", watchedStatus: 1.0, percentComplete: 100, expectedDir: "output"},
+		{name: "Barely started", watchedStatus: 0, percentComplete: 10, expectedDir: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tautulliServer := newTautulliServer(t, []MediaData{
+				{
+					FullTitle:        "Partial Show",
+					ParentMediaIndex: json.Number("2"),
+					MediaIndex:       json.Number("5"),
+					WatchedStatus:    tc.watchedStatus,
+					PercentComplete:  tc.percentComplete,
+				},
+			})
+			root := t.TempDir()
+			config := Config{
+				APIHost:           strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:            "test-key",
+				OutputDir:         filepath.Join(root, "output"),
+				PartialDir:        filepath.Join(root, "partial"),
+				PartialMinPercent: 50,
+				PartialMaxPercent: 90,
+			}
+
+			rr := httptest.NewRecorder()
+			handlePlexWebhook(rr, newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event:    PlexEventStop,
+				Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+			}), config)
+
+			for _, dir := range []string{"output", "partial"} {
+				fileContent, err := os.ReadFile(filepath.Join(root, dir, "Partial Show - S2E5.json"))
+				if fileExists := err == nil; fileExists != (dir == tc.expectedDir) {
+					t.Errorf("file in %s exists = %v, expected %v", dir, fileExists, dir == tc.expectedDir)
+					continue
+				}
+				if err != nil {
+					continue
+				}
+				var fileData MediaData
+				if err := json.Unmarshal(fileContent, &fileData); err != nil {
+					t.Fatalf("Error unmarshaling file content: %v", err)
+				}
+				if fileData.PercentComplete != tc.percentComplete {
+					t.Errorf("percent_complete = %d, expected %d", fileData.PercentComplete, tc.percentComplete)
+				}
+			}
+		})
+	}
+}
+
+func TestTautulliBasePath(t *testing.T) {
+	testCases := []struct {
+		name         string
+		hostSuffix   string
+		basePath     string
+		expectedPath string
+	}{
+		{name: "Default", basePath: "", expectedPath: "/api/v2"},
+		{name: "Subpath", basePath: "/tautulli/api/v2", expectedPath: "/tautulli/api/v2"},
+		{name: "Slashes", basePath: "tautulli/api/v2/", expectedPath: "/tautulli/api/v2"},
+		{name: "Prefix in API_HOST", hostSuffix: "/tautulli/", basePath: "/api/v2", expectedPath: "/tautulli/api/v2"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var requestedPath string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requestedPath = r.URL.Path
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"response": {"result": "success", "data": {"data": []}}}`))
+			}))
+			defer server.Close()
+
+			config := Config{
+				APIHost:          strings.TrimPrefix(server.URL, "http://") + tc.hostSuffix,
+				APIKey:           "test-key",
+				TautulliBasePath: tc.basePath,
+			}
+			if _, err := fetchMetadata(t.Context(), "/library/metadata/12345", config); err != nil {
+				t.Fatalf("fetchMetadata() error = %v", err)
+			}
+			if requestedPath != tc.expectedPath {
+				t.Errorf("request path = %q, expected %q", requestedPath, tc.expectedPath)
+			}
+		})
+	}
+}
+
+func TestMultipartMaxMemory(t *testing.T) {
+	newPosterRequest := func() *http.Request {
+		body := "--X\r\nContent-Disposition: form-data; name=\"payload\"\r\n\r\n" +
+			`{"event": "media.stop", "Metadata": {"key": "/library/metadata/12345"}}` +
+			"\r\n--X\r\nContent-Disposition: form-data; name=\"thumb\"; filename=\"poster.jpg\"\r\nContent-Type: image/jpeg\r\n\r\n" +
+			strings.Repeat("x", 4096) + "\r\n--X--\r\n"
+		req := httptest.NewRequest("POST", "/plex", strings.NewReader(body))
+		req.Header.Set("Content-Type", "multipart/form-data; boundary=X")
+		return req
+	}
+
+	testCases := []struct {
+		name           string
+		maxMemory      int64
+		expectedOnDisk bool
+	}{
+		{name: "Default keeps the poster in memory", maxMemory: 0, expectedOnDisk: false},
+		{name: "Small limit spills the poster to disk", maxMemory: 1024, expectedOnDisk: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newPosterRequest()
+			payload, err := readPlexPayload(req, Config{MultipartMaxMemory: tc.maxMemory}.multipartMaxMemory())
+			if err != nil {
+				t.Fatalf("readPlexPayload() error = %v", err)
+			}
+			t.Cleanup(func() {
+				_ = req.MultipartForm.RemoveAll()
+			})
+			if !strings.Contains(payload, "media.stop") {
+				t.Errorf("payload = %q, expected the Plex event", payload)
+			}
+
+			poster, err := req.MultipartForm.File["thumb"][0].Open()
+			if err != nil {
+				t.Fatalf("Error opening poster: %v", err)
+			}
+			defer poster.Close()
+			if _, onDisk := poster.(*os.File); onDisk != tc.expectedOnDisk {
+				t.Errorf("poster on disk = %v, expected %v", onDisk, tc.expectedOnDisk)
+			}
+		})
+	}
+}
+
+func TestTitleNormalizeRegexDefault(t *testing.T) {
+	testCases := []struct {
+		name     string
+		set      bool
+		value    string
+		expected string
+	}{
+		{name: "Unset uses the default", expected: defaultTitleNormalizeRegex},
+		{name: "Empty disables normalization", set: true, value: "", expected: ""},
+		{name: "Custom pattern", set: true, value: `^(.+?):`, expected: `^(.+?):`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("TITLE_NORMALIZE_REGEX", tc.value)
+			if !tc.set {
+				os.Unsetenv("TITLE_NORMALIZE_REGEX")
+			}
+			config, err := readConfig()
+			if err != nil {
+				t.Fatalf("readConfig() error = %v", err)
+			}
+			var got string
+			if config.TitleNormalizeRegex != nil {
+				got = config.TitleNormalizeRegex.String()
+			}
+			if got != tc.expected {
+				t.Errorf("TitleNormalizeRegex = %q, expected %q", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestNormalizeTitle(t *testing.T) {
+	config := Config{
+		TitleNormalizeRegex:       regexp.MustCompile(defaultTitleNormalizeRegex),
+		TitleNormalizeReplacement: "$1",
+	}
+
+	testCases := []struct {
+		name     string
+		data     MediaData
+		expected string
+	}{
+		{name: "Series - Title", data: MediaData{FullTitle: "Test Show - Pilot", MediaType: "episode"}, expected: "Test Show"},
+		{name: "Series - SxxExx - Title", data: MediaData{FullTitle: "Test Show - S01E02 - Pilot", MediaType: "episode"}, expected: "Test Show"},
+		{name: "Title containing dashes", data: MediaData{FullTitle: "Test Show - Part 1 - Part 2", MediaType: "episode"}, expected: "Test Show"},
+		{name: "Movies are untouched", data: MediaData{FullTitle: "Mission: Impossible - Fallout", MediaType: "movie"}, expected: "Mission: Impossible - Fallout"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := config.normalizeTitle(tc.data); got != tc.expected {
+				t.Errorf("normalizeTitle(%q) = %q, expected %q", tc.data.FullTitle, got, tc.expected)
+			}
+		})
+	}
+
+	if got := (Config{}).normalizeTitle(MediaData{FullTitle: "Test Show - Pilot", MediaType: "episode"}); got != "Test Show - Pilot" {
+		t.Errorf("normalizeTitle without a regex = %q, expected the title unchanged", got)
+	}
+}
+
+func TestNormalizeTitleFilenames(t *testing.T) {
+	for _, fullTitle := range []string{"Test Show - Pilot", "Test Show - S01E02 - Pilot"} {
+		t.Run(fullTitle, func(t *testing.T) {
+			tautulliServer := newTautulliServer(t, []MediaData{
+				{
+					FullTitle:        fullTitle,
+					ParentMediaIndex: json.Number("1"),
+					MediaIndex:       json.Number("2"),
+					WatchedStatus:    1.0,
+					MediaType:        "episode",
+				},
+			})
+			config := Config{
+				APIHost:                   strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:                    "test-key",
+				OutputDir:                 t.TempDir(),
+				TitleNormalizeRegex:       regexp.MustCompile(defaultTitleNormalizeRegex),
+				TitleNormalizeReplacement: "$1",
+			}
+
+			rr := httptest.NewRecorder()
+			handlePlexWebhook(rr, newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event:    PlexEventStop,
+				Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+			}), config)
+
+			if _, err := os.Stat(filepath.Join(config.OutputDir, "Test Show - S1E2.json")); err != nil {
+				t.Errorf("expected normalized filename: %v", err)
+			}
+		})
+	}
+}
+
+func TestFailOnWriteError(t *testing.T) {
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{
+			FullTitle:        "Lost Show",
+			ParentMediaIndex: json.Number("1"),
+			MediaIndex:       json.Number("1"),
+			WatchedStatus:    1.0,
+		},
+	})
+
+	// A regular file in place of the output directory makes every write fail, even as root
+	blocker := filepath.Join(t.TempDir(), "blocker")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatalf("Error creating blocker file: %v", err)
+	}
+
+	testCases := []struct {
+		name             string
+		failOnWriteError bool
+		expectedStatus   int
+	}{
+		{name: "Default acknowledges", failOnWriteError: false, expectedStatus: http.StatusOK},
+		{name: "Enabled asks for a retry", failOnWriteError: true, expectedStatus: http.StatusInternalServerError},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			captureLog(t)
+			config := Config{
+				APIHost:          strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:           "test-key",
+				OutputDir:        filepath.Join(blocker, "output"),
+				FailOnWriteError: tc.failOnWriteError,
+			}
+
+			rr := httptest.NewRecorder()
+			handlePlexWebhook(rr, newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event:    PlexEventStop,
+				Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+			}), config)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("status = %d, expected %d", rr.Code, tc.expectedStatus)
+			}
+		})
+	}
+}
+
+func TestPlexResumeRemovesPartial(t *testing.T) {
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{
+			RatingKey:        12345,
+			FullTitle:        "Resumed Show",
+			ParentMediaIndex: json.Number("1"),
+			MediaIndex:       json.Number("4"),
+			PercentComplete:  70,
+		},
+	})
+
+	// Neither the legacy schema nor NFO files carry the rating key, so after a restart only JSON
+	// records can be matched
+	testCases := []struct {
+		name    string
+		config  Config
+		event   string
+		restart bool
+	}{
+		{name: "Default", config: Config{}, event: PlexEventResume},
+		{name: "Legacy schema", config: Config{OutputSchemaVersion: SchemaVersionLegacy}, event: PlexEventResume},
+		{name: "NFO", config: Config{OutputFormat: OutputFormatNFO}, event: PlexEventResume},
+		{name: "Gzip", config: Config{OutputCompress: OutputCompressGzip}, event: PlexEventResume},
+		{name: "Play", config: Config{}, event: PlexEventPlay},
+		{name: "After restart", config: Config{}, event: PlexEventPlay, restart: true},
+		{name: "Gzip after restart", config: Config{OutputCompress: OutputCompressGzip}, event: PlexEventResume, restart: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			previous := partials
+			partials = newPartialIndex()
+			t.Cleanup(func() {
+				partials = previous
+			})
+
+			config := tc.config
+			config.APIHost = strings.TrimPrefix(tautulliServer.URL, "http://")
+			config.APIKey = "test-key"
+			config.OutputDir = t.TempDir()
+			config.PartialDir = t.TempDir()
+			config.PartialMinPercent = 50
+			config.PartialMaxPercent = 90
+			other := filepath.Join(config.PartialDir, "Other Show - S1E1"+config.outputExtension())
+			if err := os.WriteFile(other, []byte(`{"rating_key": 999, "full_title": "Other Show"}`), 0644); err != nil {
+				t.Fatalf("Error writing other partial: %v", err)
+			}
+
+			rr := httptest.NewRecorder()
+			handlePlexWebhook(rr, newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event:    PlexEventStop,
+				Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+			}), config)
+			partial := filepath.Join(config.PartialDir, "Resumed Show - S1E4"+config.outputExtension())
+			if _, err := os.Stat(partial); err != nil {
+				t.Fatalf("expected partial record to be written: %v", err)
+			}
+			if tc.restart {
+				partials = newPartialIndex()
+			}
+
+			rr = httptest.NewRecorder()
+			handlePlexWebhook(rr, newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event:    tc.event,
+				Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+			}), config)
+
+			if rr.Code != http.StatusOK {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			if _, err := os.Stat(partial); !os.IsNotExist(err) {
+				t.Errorf("expected partial record to be removed after resume")
+			}
+			if _, err := os.Stat(other); err != nil {
+				t.Errorf("expected partial record of another item to be kept: %v", err)
+			}
+		})
+	}
+}
+
+func TestPartialIndexForgetsWatched(t *testing.T) {
+	previous := partials
+	partials = newPartialIndex()
+	t.Cleanup(func() {
+		partials = previous
+	})
+
+	config := Config{OutputDir: t.TempDir(), PartialDir: t.TempDir()}
+	data := MediaData{RatingKey: 12345, FullTitle: "Finished Show", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("4")}
+	if _, err := writeMediaData(t.Context(), config, config.PartialDir, "Finished Show - S1E4.json", data); err != nil {
+		t.Fatalf("writeMediaData() error = %v", err)
+	}
+	if _, err := writeMediaData(t.Context(), config, config.OutputDir, "Finished Show - S1E4.json", data); err != nil {
+		t.Fatalf("writeMediaData() error = %v", err)
+	}
+	if paths, ok := partials.take("12345"); ok {
+		t.Errorf("partials = %v, expected the entry to be dropped once written as watched", paths)
+	}
+}
+
+func TestPlexWatchMode(t *testing.T) {
+	testCases := []struct {
+		name          string
+		mode          string
+		watchedStatus float64
+		shouldExist   bool
+	}{
+		{name: "Status mode trusts watched_status", mode: PlexWatchModeStatus, watchedStatus: 1.0, shouldExist: true},
+		{name: "Percent mode below threshold", mode: PlexWatchModePercent, watchedStatus: 1.0, shouldExist: false},
+		{name: "Status mode without watched_status", mode: PlexWatchModeStatus, watchedStatus: 0, shouldExist: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tautulliServer := newTautulliServer(t, []MediaData{
+				{
+					FullTitle:        "Threshold Show",
+					ParentMediaIndex: json.Number("1"),
+					MediaIndex:       json.Number("3"),
+					WatchedStatus:    tc.watchedStatus,
+					PercentComplete:  92,
+				},
+			})
+			config := Config{
+				APIHost:            strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:             "test-key",
+				OutputDir:          t.TempDir(),
+				PlexWatchMode:      tc.mode,
+				PlexWatchedPercent: 95,
+			}
+
+			rr := httptest.NewRecorder()
+			handlePlexWebhook(rr, newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event:    PlexEventStop,
+				Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+			}), config)
+
+			_, err := os.Stat(filepath.Join(config.OutputDir, "Threshold Show - S1E3.json"))
+			if fileExists := err == nil; fileExists != tc.shouldExist {
+				t.Errorf("file exists = %v, expected %v", fileExists, tc.shouldExist)
+			}
+		})
+	}
+
+	percentMode := Config{PlexWatchMode: PlexWatchModePercent, PlexWatchedPercent: 95}
+	if !percentMode.plexWatched(MediaData{PercentComplete: 96}) {
+		t.Errorf("plexWatched(96%%) = false, expected true in percent mode without watched_status")
+	}
+}
+
+func TestIgnoredEventResponse(t *testing.T) {
+	testCases := []struct {
+		name         string
+		accept       string
+		expectedBody string
+	}{
+		{name: "JSON", accept: "application/json", expectedBody: `{"status":"ignored","reason":"event not subscribed"}`},
+		{name: "Plain", accept: "", expectedBody: "OK"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event:    "media.play",
+				Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+			})
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			rr := httptest.NewRecorder()
+			handlePlexWebhook(rr, req, Config{OutputDir: t.TempDir()})
+
+			if rr.Code != http.StatusOK {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			if body := strings.TrimSpace(rr.Body.String()); body != tc.expectedBody {
+				t.Errorf("body = %q, expected %q", body, tc.expectedBody)
+			}
+		})
+	}
+
+	// Rows skipped after the Tautulli lookup are reported too
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{FullTitle: "Stopped Show", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("2"), PercentComplete: 40},
+	})
+	req := newPlexRequest(t, "/plex", PlexWebhookPayload{
+		Event:    PlexEventStop,
+		Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+	})
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	handlePlexWebhook(rr, req, Config{APIHost: strings.TrimPrefix(tautulliServer.URL, "http://"), APIKey: "test-key", OutputDir: t.TempDir()})
+	if body := strings.TrimSpace(rr.Body.String()); body != `{"status":"ignored","reason":"not watched"}` {
+		t.Errorf("Plex body = %q, expected the not watched response", body)
+	}
+
+	// Jellyfin answers ignored events the same way
+	req = newJellyfinRequest("/jellyfin", `{"NotificationType": "PlaybackStart"}`)
+	req.Header.Set("Accept", "application/json")
+	rr = httptest.NewRecorder()
+	handleJellyfinWebhook(rr, req, Config{OutputDir: t.TempDir()})
+	if body := strings.TrimSpace(rr.Body.String()); body != `{"status":"ignored","reason":"event not subscribed"}` {
+		t.Errorf("Jellyfin body = %q, expected the ignored response", body)
+	}
+}
+
+func TestPadWidth(t *testing.T) {
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{
+			FullTitle:        "Padded Show",
+			ParentMediaIndex: json.Number("1"),
+			MediaIndex:       json.Number("2"),
+			WatchedStatus:    1.0,
+		},
+	})
+
+	testCases := []struct {
+		name             string
+		seasonWidth      int
+		episodeWidth     int
+		expectedPlex     string
+		expectedJellyfin string
+	}{
+		{name: "No padding", seasonWidth: 0, episodeWidth: 0, expectedPlex: "Padded Show - S1E2.json", expectedJellyfin: "Padded Series - S1E2.json"},
+		{name: "Width 2", seasonWidth: 2, episodeWidth: 2, expectedPlex: "Padded Show - S01E02.json", expectedJellyfin: "Padded Series - S01E02.json"},
+		{name: "Mixed widths", seasonWidth: 0, episodeWidth: 3, expectedPlex: "Padded Show - S1E002.json", expectedJellyfin: "Padded Series - S1E002.json"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{
+				APIHost:         strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:          "test-key",
+				OutputDir:       t.TempDir(),
+				SeasonPadWidth:  tc.seasonWidth,
+				EpisodePadWidth: tc.episodeWidth,
+			}
+
+			handlePlexWebhook(httptest.NewRecorder(), newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event:    PlexEventStop,
+				Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+			}), config)
+			handleJellyfinWebhook(httptest.NewRecorder(), newJellyfinRequest("/jellyfin", `{
+				"NotificationType": "PlaybackStop",
+				"ItemType": "Episode",
+				"Name": "Second",
+				"SeriesName": "Padded Series",
+				"SeasonNumber": 1,
+				"EpisodeNumber": 2,
+				"MediaStatus": {"PlayedToCompletion": true}
+			}`), config)
+
+			for _, expected := range []string{tc.expectedPlex, tc.expectedJellyfin} {
+				if _, err := os.Stat(filepath.Join(config.OutputDir, expected)); err != nil {
+					t.Errorf("expected %s to be written: %v", expected, err)
+				}
+			}
+		})
+	}
+}
+
+func TestFilenameCase(t *testing.T) {
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{
+			FullTitle:        "The Mixed Case Show",
+			ParentMediaIndex: json.Number("1"),
+			MediaIndex:       json.Number("2"),
+			WatchedStatus:    1.0,
+		},
+	})
+
+	testCases := []struct {
+		name             string
+		filenameCase     string
+		spaceReplacement string
+		expectedPlex     string
+		expectedJellyfin string
+	}{
+		{name: "Preserve", filenameCase: FilenameCasePreserve, expectedPlex: "The Mixed Case Show - S1E2.json", expectedJellyfin: "Mixed Case Movie.json"},
+		{name: "Lower with underscores", filenameCase: FilenameCaseLower, spaceReplacement: "_", expectedPlex: "the_mixed_case_show_-_s1e2.json", expectedJellyfin: "mixed_case_movie.json"},
+		{name: "Upper", filenameCase: FilenameCaseUpper, expectedPlex: "THE MIXED CASE SHOW - S1E2.json", expectedJellyfin: "MIXED CASE MOVIE.json"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{
+				APIHost:                  strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:                   "test-key",
+				OutputDir:                t.TempDir(),
+				FilenameCase:             tc.filenameCase,
+				FilenameSpaceReplacement: tc.spaceReplacement,
+			}
+
+			handlePlexWebhook(httptest.NewRecorder(), newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event:    PlexEventStop,
+				Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+			}), config)
+			handleJellyfinWebhook(httptest.NewRecorder(), newJellyfinRequest("/jellyfin", `{
+				"NotificationType": "PlaybackStop",
+				"ItemType": "Movie",
+				"Name": "Mixed Case Movie",
+				"MediaStatus": {"PlayedToCompletion": true}
+			}`), config)
+
+			for _, expected := range []string{tc.expectedPlex, tc.expectedJellyfin} {
+				if _, err := os.Stat(filepath.Join(config.OutputDir, expected)); err != nil {
+					t.Errorf("expected %s to be written: %v", expected, err)
+				}
+			}
+		})
+	}
+
+	// The extension is never changed
+	if filename := (Config{OutputExtension: ".JSON", FilenameCase: FilenameCaseLower}).outputFilename("Show - S1E2"); filename != "show - s1e2.JSON" {
+		t.Errorf("filename = %q, expected the extension to keep its case", filename)
+	}
+}
+
+func TestJellyfinProviderIDs(t *testing.T) {
+	const body = `{
+		"NotificationType": "PlaybackStop",
+		"ItemType": "Episode",
+		"Name": "Pilot",
+		"SeriesName": "Provider Series",
+		"SeasonNumber": 1,
+		"EpisodeNumber": 1,
+		"Provider_tvdb": "349232",
+		"Provider_imdb": "tt0959621",
+		"Provider_tmdb": "",
+		"MediaStatus": {"PlayedToCompletion": true}
+	}`
+
+	testCases := []struct {
+		name     string
+		include  bool
+		expected map[string]string
+	}{
+		{name: "Enabled", include: true, expected: map[string]string{"tvdb": "349232", "imdb": "tt0959621"}},
+		{name: "Disabled", include: false, expected: nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{OutputDir: t.TempDir(), IncludeProviderIDs: tc.include}
+			handleJellyfinWebhook(httptest.NewRecorder(), newJellyfinRequest("/jellyfin", body), config)
+
+			fileContent, err := os.ReadFile(filepath.Join(config.OutputDir, "Provider Series - S1E1.json"))
+			if err != nil {
+				t.Fatalf("Error reading file: %v", err)
+			}
+			var fileData MediaData
+			if err := json.Unmarshal(fileContent, &fileData); err != nil {
+				t.Fatalf("Error unmarshaling file content: %v", err)
+			}
+			if !maps.Equal(fileData.ProviderIDs, tc.expected) {
+				t.Errorf("provider_ids = %v, expected %v", fileData.ProviderIDs, tc.expected)
+			}
+		})
+	}
+}
+
+func TestTautulliSettleRetries(t *testing.T) {
+	testCases := []struct {
+		name            string
+		retries         int
+		expectedQueries int
+		expectedTitle   string
+	}{
+		{name: "Retries until the play is logged", retries: 3, expectedQueries: 2, expectedTitle: "Settled Show"},
+		{name: "Disabled by default", retries: 0, expectedQueries: 1, expectedTitle: "Older Play"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var queries atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				row := MediaData{RatingKey: 999, FullTitle: "Older Play", PercentComplete: 40}
+				if queries.Add(1) > 1 {
+					row = MediaData{RatingKey: 12345, FullTitle: "Settled Show", WatchedStatus: 1.0, PercentComplete: 100}
+				}
+				response := TautulliResponse{}
+				response.Response.Data.Data = []MediaData{row}
+				if err := json.NewEncoder(w).Encode(response); err != nil {
+					t.Errorf("Error encoding response: %v", err)
+				}
+			}))
+			defer server.Close()
+
+			config := Config{
+				APIHost:               strings.TrimPrefix(server.URL, "http://"),
+				APIKey:                "test-key",
+				TautulliSettleRetries: tc.retries,
+				TautulliSettleDelay:   time.Millisecond,
+			}
+			rows, err := fetchMetadata(t.Context(), "/library/metadata/12345", config)
+			if err != nil {
+				t.Fatalf("fetchMetadata() error = %v", err)
+			}
+
+			if got := int(queries.Load()); got != tc.expectedQueries {
+				t.Errorf("queries = %d, expected %d", got, tc.expectedQueries)
+			}
+			if len(rows) != 1 || rows[0].FullTitle != tc.expectedTitle {
+				t.Errorf("rows = %v, expected %s", rows, tc.expectedTitle)
+			}
+		})
+	}
+}
+
+func TestIncludePlexHeaders(t *testing.T) {
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{FullTitle: "Header Show", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("2"), WatchedStatus: 1.0, PercentComplete: 100},
+	})
+
+	testCases := []struct {
+		name     string
+		include  bool
+		headers  map[string]string
+		expected *PlexClient
+	}{
+		{
+			name:     "Enabled",
+			include:  true,
+			headers:  map[string]string{"X-Plex-Account-ID": "1", "X-Plex-Product": "Plex Web", "X-Plex-Device-Name": "Living Room"},
+			expected: &PlexClient{AccountID: "1", Player: "Plex Web", Device: "Living Room"},
+		},
+		{name: "Headers missing", include: true, headers: nil, expected: nil},
+		{name: "Disabled", include: false, headers: map[string]string{"X-Plex-Account-ID": "1"}, expected: nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{
+				APIHost:            strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:             "test-key",
+				OutputDir:          t.TempDir(),
+				IncludePlexHeaders: tc.include,
+			}
+
+			req := newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event:    "media.stop",
+				Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+			})
+			for name, value := range tc.headers {
+				req.Header.Set(name, value)
+			}
+			handlePlexWebhook(httptest.NewRecorder(), req, config)
+
+			fileContent, err := os.ReadFile(filepath.Join(config.OutputDir, "Header Show - S1E2.json"))
+			if err != nil {
+				t.Fatalf("Error reading file: %v", err)
+			}
+			var fileData MediaData
+			if err := json.Unmarshal(fileContent, &fileData); err != nil {
+				t.Fatalf("Error unmarshaling file content: %v", err)
+			}
+			if !reflect.DeepEqual(fileData.PlexClient, tc.expected) {
+				t.Errorf("plex_client = %+v, expected %+v", fileData.PlexClient, tc.expected)
+			}
+		})
+	}
+}
+
+func TestEmptyDataBehavior(t *testing.T) {
+	testCases := []struct {
+		name            string
+		behavior        string
+		expectedStatus  int
+		expectedQueries int
+		shouldExist     bool
+	}{
+		{name: "Skip", behavior: EmptyDataSkip, expectedStatus: http.StatusOK, expectedQueries: 1, shouldExist: false},
+		{name: "Retry", behavior: EmptyDataRetry, expectedStatus: http.StatusOK, expectedQueries: 2, shouldExist: true},
+		{name: "Fail", behavior: EmptyDataFail, expectedStatus: http.StatusInternalServerError, expectedQueries: 1, shouldExist: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var queries atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				response := TautulliResponse{}
+				if queries.Add(1) > 1 {
+					response.Response.Data.Data = []MediaData{
+						{FullTitle: "Late Show", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("2"), WatchedStatus: 1.0, PercentComplete: 100},
+					}
+				}
+				if err := json.NewEncoder(w).Encode(response); err != nil {
+					t.Errorf("Error encoding response: %v", err)
+				}
+			}))
+			defer server.Close()
+
+			config := Config{
+				APIHost:             strings.TrimPrefix(server.URL, "http://"),
+				APIKey:              "test-key",
+				OutputDir:           t.TempDir(),
+				EmptyDataBehavior:   tc.behavior,
+				EmptyDataRetries:    3,
+				EmptyDataRetryDelay: time.Millisecond,
+			}
+
+			req := newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event:    "media.stop",
+				Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+			})
+			rr := httptest.NewRecorder()
+			handlePlexWebhook(rr, req, config)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("status = %d, expected %d", rr.Code, tc.expectedStatus)
+			}
+			if got := int(queries.Load()); got != tc.expectedQueries {
+				t.Errorf("queries = %d, expected %d", got, tc.expectedQueries)
+			}
+			_, err := os.Stat(filepath.Join(config.OutputDir, "Late Show - S1E2.json"))
+			if fileExists := err == nil; fileExists != tc.shouldExist {
+				t.Errorf("file exists = %v, expected %v", fileExists, tc.shouldExist)
+			}
+		})
+	}
+}
+
+func TestFloatPercentComplete(t *testing.T) {
+	body := []byte(`{"response": {"result": "success", "data": {"data": [
+		{"full_title": "Float Show", "parent_media_index": "1", "media_index": "2", "watched_status": 1, "percent_complete": 98.5},
+		{"full_title": "Empty Show", "parent_media_index": "1", "media_index": "2", "watched_status": 0, "percent_complete": ""}
+	]}}}`)
+
+	var response TautulliResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatalf("Error unmarshaling response: %v", err)
+	}
+	rows := response.Response.Data.Data
+	if len(rows) != 2 {
+		t.Fatalf("rows = %d, expected 2", len(rows))
+	}
+	if rows[0].PercentComplete != 99 {
+		t.Errorf("percent_complete = %d, expected 99", rows[0].PercentComplete)
+	}
+	if rows[1].PercentComplete != 0 {
+		t.Errorf("percent_complete = %d, expected 0", rows[1].PercentComplete)
+	}
+}
+
+// BenchmarkTautulliRequestLargeHistory decodes a large get_history response as it is streamed,
+// compared to the previous approach of reading the whole body and rewriting the empty numeric
+// fields with regular expressions before unmarshaling it
+func BenchmarkTautulliRequestLargeHistory(b *testing.B) {
+	var body bytes.Buffer
+	body.WriteString(`{"response": {"result": "success", "message": null, "data": {"data": [`)
+	for i := range 5000 {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		fmt.Fprintf(&body, `{"rating_key": %d, "full_title": "Show %d - Episode", "parent_media_index": "%d", "media_index": "", "watched_status": "", "percent_complete": 97, "media_type": "episode", "guid": "plex://episode/%d"}`, i, i, i%10, i)
+	}
+	body.WriteString(`]}}}`)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(body.Bytes()); err != nil {
+			b.Errorf("Error writing response: %v", err)
+		}
+	}))
+	defer server.Close()
+	config := Config{APIHost: strings.TrimPrefix(server.URL, "http://"), APIKey: "test-key"}
+	params := url.Values{"cmd": {"get_history"}}
+
+	b.Run("Streaming", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			var response TautulliResponse
+			if err := tautulliRequest(b.Context(), config, params, &response); err != nil {
+				b.Fatalf("tautulliRequest() error = %v", err)
+			}
+		}
+	})
+
+	b.Run("RegexNormalized", func(b *testing.B) {
+		emptyFields := []struct {
+			regex       *regexp.Regexp
+			replacement string
+		}{
+			{regexp.MustCompile(`"parent_media_index"\s*:\s*""`), `"parent_media_index":"0"`},
+			{regexp.MustCompile(`"media_index"\s*:\s*""`), `"media_index":"0"`},
+			{regexp.MustCompile(`"watched_status"\s*:\s*""`), `"watched_status":0`},
+		}
+		b.ReportAllocs()
+		for b.Loop() {
+			resp, err := tautulliGet(b.Context(), config, tautulliURL(config, params))
+			if err != nil {
+				b.Fatalf("tautulliGet() error = %v", err)
+			}
+			content, err := io.ReadAll(resp.Body)
+			if closeErr := resp.Body.Close(); closeErr != nil {
+				b.Fatalf("Error closing response body: %v", closeErr)
+			}
+			if err != nil {
+				b.Fatalf("Error reading response body: %v", err)
+			}
+			normalized := string(content)
+			for _, field := range emptyFields {
+				normalized = field.regex.ReplaceAllString(normalized, field.replacement)
+			}
+			var response TautulliResponse
+			if err := json.Unmarshal([]byte(normalized), &response); err != nil {
+				b.Fatalf("Error unmarshaling response: %v", err)
+			}
+		}
+	})
+}
+
+func TestJellyfinBatchPayload(t *testing.T) {
+	config := Config{OutputDir: t.TempDir()}
+
+	rr := httptest.NewRecorder()
+	handleJellyfinWebhook(rr, newJellyfinRequest("/jellyfin", `[
+		{
+			"NotificationType": "PlaybackStop",
+			"ItemType": "Episode",
+			"SeriesName": "Batch Series",
+			"SeasonNumber": 1,
+			"EpisodeNumber": 1,
+			"MediaStatus": {"PlayedToCompletion": true}
+		},
+		{
+			"NotificationType": "PlaybackStop",
+			"ItemType": "Episode",
+			"SeriesName": "Batch Series",
+			"SeasonNumber": 1,
+			"EpisodeNumber": 2,
+			"MediaStatus": {"PlayedToCompletion": true}
+		},
+		{
+			"NotificationType": "PlaybackStop",
+			"ItemType": "Episode",
+			"SeriesName": "Batch Series",
+			"SeasonNumber": 1,
+			"EpisodeNumber": 3,
+			"MediaStatus": {"PlayedToCompletion": false}
+		}
+	]`), config)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	for _, name := range []string{"Batch Series - S1E1.json", "Batch Series - S1E2.json"} {
+		if _, err := os.Stat(filepath.Join(config.OutputDir, name)); err != nil {
+			t.Errorf("Expected file %s to exist: %v", name, err)
+		}
+	}
+
+	var summary BatchResponse
+	if err := json.NewDecoder(rr.Body).Decode(&summary); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	expected := BatchResponse{Processed: 2, Ignored: 1}
+	if summary != expected {
+		t.Errorf("summary = %+v, expected %+v", summary, expected)
+	}
+}
+
+func TestMediaID(t *testing.T) {
+	base := MediaData{
+		FullTitle:        "Test Show - Pilot",
+		GrandparentTitle: "Test Show",
+		ParentMediaIndex: json.Number("1"),
+		MediaIndex:       json.Number("2"),
+		Source:           SourcePlex,
+		User:             "alice",
+	}
+
+	if mediaID(base) != mediaID(base) {
+		t.Errorf("mediaID is not deterministic")
+	}
+	if id := mediaID(base); len(id) != 40 {
+		t.Errorf("mediaID = %q, expected a SHA1 hex digest", id)
+	}
+
+	variants := map[string]func(*MediaData){
+		"source":  func(d *MediaData) { d.Source = SourceJellyfin },
+		"title":   func(d *MediaData) { d.GrandparentTitle = "Other Show" },
+		"season":  func(d *MediaData) { d.ParentMediaIndex = json.Number("2") },
+		"episode": func(d *MediaData) { d.MediaIndex = json.Number("3") },
+		"user":    func(d *MediaData) { d.User = "bob" },
+	}
+	for name, change := range variants {
+		t.Run(name, func(t *testing.T) {
+			other := base
+			change(&other)
+			if mediaID(other) == mediaID(base) {
+				t.Errorf("mediaID did not change with the %s", name)
+			}
+		})
+	}
+
+	// The id is only written when enabled
+	for _, include := range []bool{true, false} {
+		config := Config{OutputDir: t.TempDir(), IncludeID: include}
+		if _, err := writeMediaData(t.Context(), config, config.OutputDir, "Test Show - S1E2.json", base); err != nil {
+			t.Fatalf("writeMediaData() error = %v", err)
+		}
+		fileContent, err := os.ReadFile(filepath.Join(config.OutputDir, "Test Show - S1E2.json"))
+		if err != nil {
+			t.Fatalf("Error reading file: %v", err)
+		}
+		var fileData MediaData
+		if err := json.Unmarshal(fileContent, &fileData); err != nil {
+			t.Fatalf("Error unmarshaling file content: %v", err)
+		}
+		if hasID := fileData.ID != ""; hasID != include {
+			t.Errorf("id written = %v, expected %v", hasID, include)
+		}
+	}
+}
+
+func TestPerSourceOutputDir(t *testing.T) {
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{FullTitle: "Plex Show", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("2"), WatchedStatus: 1.0, PercentComplete: 100},
+	})
+	const jellyfinBody = `{
+		"NotificationType": "PlaybackStop",
+		"ItemType": "Episode",
+		"SeriesName": "Jellyfin Series",
+		"SeasonNumber": 1,
+		"EpisodeNumber": 1,
+		"MediaStatus": {"PlayedToCompletion": true}
+	}`
+
+	testCases := []struct {
+		name        string
+		plexDir     string
+		jellyfinDir string
+	}{
+		{name: "Separate directories", plexDir: "plex", jellyfinDir: "jellyfin"},
+		{name: "Only Plex overridden", plexDir: "plex", jellyfinDir: ""},
+		{name: "Shared directory", plexDir: "", jellyfinDir: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			config := Config{
+				APIHost:   strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:    "test-key",
+				OutputDir: root,
+			}
+			if tc.plexDir != "" {
+				config.PlexOutputDir = filepath.Join(root, tc.plexDir)
+			}
+			if tc.jellyfinDir != "" {
+				config.JellyfinOutputDir = filepath.Join(root, tc.jellyfinDir)
+			}
+
+			handlePlexWebhook(httptest.NewRecorder(), newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event:    "media.stop",
+				Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+			}), config)
+			handleJellyfinWebhook(httptest.NewRecorder(), newJellyfinRequest("/jellyfin", jellyfinBody), config)
+
+			if _, err := os.Stat(filepath.Join(root, tc.plexDir, "Plex Show - S1E2.json")); err != nil {
+				t.Errorf("Expected Plex file in %q: %v", tc.plexDir, err)
+			}
+			if _, err := os.Stat(filepath.Join(root, tc.jellyfinDir, "Jellyfin Series - S1E1.json")); err != nil {
+				t.Errorf("Expected Jellyfin file in %q: %v", tc.jellyfinDir, err)
+			}
+		})
+	}
+}
+
+func TestTautulliURLIPv6(t *testing.T) {
+	testCases := []struct {
+		apiHost      string
+		expectedHost string
+	}{
+		{apiHost: "fe80::1:8181", expectedHost: "[fe80::1]:8181"},
+		{apiHost: "[fe80::1]:8181", expectedHost: "[fe80::1]:8181"},
+		{apiHost: "::1", expectedHost: "[::1]"},
+		{apiHost: "2001:db8::10:8181/tautulli", expectedHost: "[2001:db8::10]:8181"},
+		{apiHost: "tautulli:8181", expectedHost: "tautulli:8181"},
+		{apiHost: "192.168.1.10:8181", expectedHost: "192.168.1.10:8181"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.apiHost, func(t *testing.T) {
+			requestURL := tautulliURL(Config{APIHost: tc.apiHost, APIKey: "test-key"}, url.Values{"cmd": {"arnold"}})
+			u, err := url.Parse(requestURL)
+			if err != nil {
+				t.Fatalf("tautulliURL() = %q is not a valid URL: %v", requestURL, err)
+			}
+			if u.Host != tc.expectedHost {
+				t.Errorf("host = %q, expected %q", u.Host, tc.expectedHost)
+			}
+			if u.Query().Get("cmd") != "arnold" {
+				t.Errorf("query = %q, expected cmd=arnold", u.RawQuery)
+			}
+		})
+	}
+}
+
+func TestPlexAccountTitle(t *testing.T) {
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{FullTitle: "Account Show", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("2"), WatchedStatus: 1.0, PercentComplete: 100, User: "tautulli-user"},
+	})
+
+	testCases := []struct {
+		name         string
+		account      PlexAccount
+		expectedUser string
+	}{
+		{name: "Account title", account: PlexAccount{ID: 1, Title: "alice"}, expectedUser: "alice"},
+		{name: "Falls back to Tautulli", account: PlexAccount{}, expectedUser: "tautulli-user"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{
+				APIHost:   strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:    "test-key",
+				OutputDir: t.TempDir(),
+			}
+			handlePlexWebhook(httptest.NewRecorder(), newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event:    "media.stop",
+				Account:  tc.account,
+				Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+			}), config)
+
+			fileContent, err := os.ReadFile(filepath.Join(config.OutputDir, "Account Show - S1E2.json"))
+			if err != nil {
+				t.Fatalf("Error reading file: %v", err)
+			}
+			var fileData MediaData
+			if err := json.Unmarshal(fileContent, &fileData); err != nil {
+				t.Fatalf("Error unmarshaling file content: %v", err)
+			}
+			if fileData.User != tc.expectedUser {
+				t.Errorf("user = %q, expected %q", fileData.User, tc.expectedUser)
+			}
+		})
+	}
+}
+
+func TestJellyfinCompletionPercent(t *testing.T) {
+	testCases := []struct {
+		name        string
+		threshold   int
+		position    int64
+		completed   bool
+		shouldExist bool
+	}{
+		{name: "99% under a 95% threshold", threshold: 95, position: 99, completed: false, shouldExist: true},
+		{name: "90% under a 95% threshold", threshold: 95, position: 90, completed: false, shouldExist: false},
+		{name: "Flag set below the threshold", threshold: 95, position: 50, completed: true, shouldExist: true},
+		{name: "Threshold disabled", threshold: 0, position: 99, completed: false, shouldExist: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{OutputDir: t.TempDir(), JellyfinCompletionPercent: tc.threshold}
+			body := fmt.Sprintf(`{
+				"NotificationType": "PlaybackStop",
+				"ItemType": "Episode",
+				"SeriesName": "Grace Series",
+				"SeasonNumber": 1,
+				"EpisodeNumber": 1,
+				"RunTimeTicks": 100000000,
+				"MediaStatus": {"PlayedToCompletion": %t, "PositionTicks": %d}
+			}`, tc.completed, tc.position*1000000)
+			handleJellyfinWebhook(httptest.NewRecorder(), newJellyfinRequest("/jellyfin", body), config)
+
+			_, err := os.Stat(filepath.Join(config.OutputDir, "Grace Series - S1E1.json"))
+			if fileExists := err == nil; fileExists != tc.shouldExist {
+				t.Errorf("file exists = %v, expected %v", fileExists, tc.shouldExist)
+			}
+		})
+	}
+}
+
+func TestPlexDebugAcceptGet(t *testing.T) {
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{
+			FullTitle:        "Test Show",
+			ParentMediaIndex: json.Number("1"),
+			MediaIndex:       json.Number("2"),
+			WatchedStatus:    1.0,
+			PercentComplete:  98,
+		},
+	})
+
+	testCases := []struct {
+		name           string
+		debugAcceptGet bool
+		expectedStatus int
+		shouldExist    bool
+	}{
+		{name: "Enabled", debugAcceptGet: true, expectedStatus: http.StatusOK, shouldExist: true},
+		{name: "Disabled", debugAcceptGet: false, expectedStatus: http.StatusMethodNotAllowed, shouldExist: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := captureLog(t)
+			config := Config{
+				APIHost:        strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:         "test-key",
+				OutputDir:      t.TempDir(),
+				DebugAcceptGet: tc.debugAcceptGet,
+			}
+
+			req := httptest.NewRequest("GET", "/plex?event=media.stop&key=/library/metadata/12345", nil)
+			rr := httptest.NewRecorder()
+			handlePlexWebhook(rr, req, config)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("status = %v, expected %v", rr.Code, tc.expectedStatus)
+			}
+			_, err := os.Stat(filepath.Join(config.OutputDir, "Test Show - S1E2.json"))
+			if fileExists := err == nil; fileExists != tc.shouldExist {
+				t.Errorf("file exists = %v, expected %v", fileExists, tc.shouldExist)
+			}
+			if logged := strings.Contains(logs.String(), "DEBUG_ACCEPT_GET"); logged != tc.debugAcceptGet {
+				t.Errorf("DEBUG_ACCEPT_GET warning logged = %v, expected %v", logged, tc.debugAcceptGet)
+			}
+		})
+	}
+}
+
+func TestPlexSkipTautulliMovies(t *testing.T) {
+	var tautulliCalls atomic.Int32
+	tautulliServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tautulliCalls.Add(1)
+		http.Error(w, "unexpected", http.StatusInternalServerError)
+	}))
+	defer tautulliServer.Close()
+
+	testCases := []struct {
+		name            string
+		viewOffset      FlexibleInt
+		viewCount       FlexibleInt
+		shouldExist     bool
+		expectedWatched int
+	}{
+		{name: "Played to the end", viewOffset: 0, viewCount: 1, shouldExist: true, expectedWatched: 6000},
+		{name: "Stopped at 90%", viewOffset: 5400000, viewCount: 0, shouldExist: true, expectedWatched: 5400},
+		{name: "Stopped at 50%", viewOffset: 3000000, viewCount: 0, shouldExist: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tautulliCalls.Store(0)
+			config := Config{
+				APIHost:                strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:                 "test-key",
+				OutputDir:              t.TempDir(),
+				PlexSkipTautulliMovies: true,
+				IncludeDuration:        true,
+			}
+
+			req := newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event: "media.stop",
+				Metadata: PlexMetadata{
+					Key:        "/library/metadata/12345",
+					Type:       "movie",
+					RatingKey:  12345,
+					Title:      "Test Movie",
+					Year:       2020,
+					GUIDs:      GUIDList{"imdb://tt1234567"},
+					Duration:   6000000,
+					ViewOffset: tc.viewOffset,
+					ViewCount:  tc.viewCount,
+				},
+			})
+			rr := httptest.NewRecorder()
+			handlePlexWebhook(rr, req, config)
+
+			if rr.Code != http.StatusOK {
+				t.Errorf("status = %v, expected %v", rr.Code, http.StatusOK)
+			}
+			if calls := tautulliCalls.Load(); calls != 0 {
+				t.Errorf("Tautulli calls = %d, expected 0", calls)
+			}
+
+			// Plex movies keep the season 0 episode 0 naming of Tautulli rows
+			fileContent, err := os.ReadFile(filepath.Join(config.OutputDir, "Test Movie - S0E0.json"))
+			if fileExists := err == nil; fileExists != tc.shouldExist {
+				t.Fatalf("file exists = %v, expected %v", fileExists, tc.shouldExist)
+			}
+			if !tc.shouldExist {
+				return
+			}
+			var fileData MediaData
+			if err := json.Unmarshal(fileContent, &fileData); err != nil {
+				t.Fatalf("Error unmarshaling file content: %v", err)
+			}
+			if fileData.FullTitle != "Test Movie" {
+				t.Errorf("fileData.FullTitle = %q, expected %q", fileData.FullTitle, "Test Movie")
+			}
+			if fileData.MediaType != "movie" {
+				t.Errorf("fileData.MediaType = %q, expected %q", fileData.MediaType, "movie")
+			}
+			if fileData.WatchedStatus != 1.0 {
+				t.Errorf("fileData.WatchedStatus = %v, expected 1", fileData.WatchedStatus)
+			}
+			if fileData.Source != SourcePlex {
+				t.Errorf("fileData.Source = %q, expected %q", fileData.Source, SourcePlex)
+			}
+			if fileData.Year != 2020 {
+				t.Errorf("fileData.Year = %d, expected 2020 without TMDB_API_KEY", fileData.Year)
+			}
+			// The webhook only knows the movie's length, not Tautulli's time played
+			if fileData.Duration != 0 {
+				t.Errorf("fileData.Duration = %d, expected no time played", fileData.Duration)
+			}
+			if fileData.WatchedSeconds != tc.expectedWatched {
+				t.Errorf("fileData.WatchedSeconds = %d, expected %d", fileData.WatchedSeconds, tc.expectedWatched)
+			}
+		})
+	}
+}
+
+func TestJellyfinMusic(t *testing.T) {
+	const body = `{
+		"NotificationType": "PlaybackStop",
+		"ItemType": "Audio",
+		"Name": "Some Song",
+		"Artist": "Some Artist",
+		"Album": "Some Album",
+		"TrackNumber": "03",
+		"MediaStatus": {"PlayedToCompletion": true}
+	}`
+
+	t.Run("Enabled writes a track file", func(t *testing.T) {
+		config := Config{OutputDir: t.TempDir(), JellyfinMusicEnabled: true}
+		rr := httptest.NewRecorder()
+		handleJellyfinWebhook(rr, newJellyfinRequest("/jellyfin", body), config)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status = %v, expected %v", rr.Code, http.StatusOK)
+		}
+
+		content, err := os.ReadFile(filepath.Join(config.OutputDir, "music", "Some Artist - Some Album - Some Song.json"))
+		if err != nil {
+			t.Fatalf("Expected track file: %v", err)
+		}
+		var data MediaData
+		if err := json.Unmarshal(content, &data); err != nil {
+			t.Fatalf("Error decoding track file: %v", err)
+		}
+		if data.GrandparentTitle != "Some Artist" {
+			t.Errorf("artist = %q, expected %q", data.GrandparentTitle, "Some Artist")
+		}
+		if data.ParentTitle != "Some Album" {
+			t.Errorf("album = %q, expected %q", data.ParentTitle, "Some Album")
+		}
+		if data.Title != "Some Song" {
+			t.Errorf("track = %q, expected %q", data.Title, "Some Song")
+		}
+		if data.MediaIndex != "3" {
+			t.Errorf("track number = %q, expected %q", data.MediaIndex, "3")
+		}
+		if data.MediaType != "track" {
+			t.Errorf("media type = %q, expected %q", data.MediaType, "track")
+		}
+	})
+
+	t.Run("MUSIC_OUTPUT_DIR overrides the directory", func(t *testing.T) {
+		musicDir := t.TempDir()
+		config := Config{OutputDir: t.TempDir(), MusicOutputDir: musicDir, JellyfinMusicEnabled: true}
+		handleJellyfinWebhook(httptest.NewRecorder(), newJellyfinRequest("/jellyfin", body), config)
+
+		if _, err := os.Stat(filepath.Join(musicDir, "Some Artist - Some Album - Some Song.json")); err != nil {
+			t.Errorf("Expected track file in MUSIC_OUTPUT_DIR: %v", err)
+		}
+	})
+
+	t.Run("Albums skip NFO and TMDB", func(t *testing.T) {
+		tmdbServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("Unexpected TMDB request for music: %s", r.URL)
+		}))
+		defer tmdbServer.Close()
+		album := `{"NotificationType": "PlaybackStop", "ItemType": "MusicAlbum", "Name": "Some Album", "Artist": "Some Artist", "MediaStatus": {"PlayedToCompletion": true}}`
+		config := Config{
+			OutputDir: t.TempDir(), JellyfinMusicEnabled: true, OutputFormat: OutputFormatNFO,
+			TMDBAPIKey: "tmdb-key", TMDBURL: tmdbServer.URL, TMDBTimeout: time.Second,
+		}
+		handleJellyfinWebhook(httptest.NewRecorder(), newJellyfinRequest("/jellyfin", album), config)
+
+		content, err := os.ReadFile(filepath.Join(config.OutputDir, "music", "Some Artist - Some Album.json"))
+		if err != nil {
+			t.Fatalf("Expected album file: %v", err)
+		}
+		var data MediaData
+		if err := json.Unmarshal(content, &data); err != nil {
+			t.Fatalf("Error decoding album file: %v", err)
+		}
+		if data.MediaType != "album" || data.TMDBID != 0 {
+			t.Errorf("media type = %q, tmdb_id = %d, expected album without a TMDB ID", data.MediaType, data.TMDBID)
+		}
+	})
+
+	t.Run("Disabled ignores the item", func(t *testing.T) {
+		config := Config{OutputDir: t.TempDir()}
+		handleJellyfinWebhook(httptest.NewRecorder(), newJellyfinRequest("/jellyfin", body), config)
+
+		files, err := os.ReadDir(config.OutputDir)
+		if err != nil {
+			t.Fatalf("Error reading output dir: %v", err)
+		}
+		if len(files) != 0 {
+			t.Errorf("Expected no files with JELLYFIN_MUSIC_ENABLED unset, found %d", len(files))
+		}
+	})
+}
+
+func TestIgnoreTitleRegex(t *testing.T) {
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{FullTitle: "Sample Show - Pilot", GrandparentTitle: "Sample Show", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("2"), WatchedStatus: 1.0, PercentComplete: 100},
+	})
+	ignoreTitleRegex := regexp.MustCompile(`^(Sample|Test) `)
+
+	testCases := []struct {
+		name        string
+		source      string
+		title       string
+		file        string
+		shouldExist bool
+	}{
+		{name: "Plex matching title", source: SourcePlex, file: "Sample Show - S1E2.json", shouldExist: false},
+		{name: "Jellyfin matching series", source: SourceJellyfin, title: "Test Series", file: "Test Series - S1E1.json", shouldExist: false},
+		{name: "Jellyfin non-matching series", source: SourceJellyfin, title: "Real Series", file: "Real Series - S1E1.json", shouldExist: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{
+				APIHost:          strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:           "test-key",
+				OutputDir:        t.TempDir(),
+				IgnoreTitleRegex: ignoreTitleRegex,
+			}
+			recorder := httptest.NewRecorder()
+			if tc.source == SourcePlex {
+				handlePlexWebhook(recorder, newPlexRequest(t, "/plex", PlexWebhookPayload{
+					Event:    "media.stop",
+					Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+				}), config)
+			} else {
+				handleJellyfinWebhook(recorder, newJellyfinRequest("/jellyfin", fmt.Sprintf(`{
+					"NotificationType": "PlaybackStop",
+					"ItemType": "Episode",
+					"SeriesName": %q,
+					"SeasonNumber": 1,
+					"EpisodeNumber": 1,
+					"MediaStatus": {"PlayedToCompletion": true}
+				}`, tc.title)), config)
+			}
+
+			if recorder.Code != http.StatusOK {
+				t.Errorf("status = %d, expected %d", recorder.Code, http.StatusOK)
+			}
+			_, err := os.Stat(filepath.Join(config.OutputDir, tc.file))
+			if fileExists := err == nil; fileExists != tc.shouldExist {
+				t.Errorf("file exists = %v, expected %v", fileExists, tc.shouldExist)
+			}
+		})
+	}
+}
+
+func TestAllowedMediaTypes(t *testing.T) {
+	testCases := []struct {
+		name         string
+		allowed      []string
+		row          MediaData
+		expectedFile string
+		shouldExist  bool
+	}{
+		{
+			name:         "Track skipped by default",
+			row:          MediaData{MediaType: "track", FullTitle: "Some Song", ParentMediaIndex: json.Number("0"), MediaIndex: json.Number("0"), WatchedStatus: 1.0, PercentComplete: 100},
+			expectedFile: "Some Song - S0E0.json",
+			shouldExist:  false,
+		},
+		{
+			name:         "Episode written by default",
+			row:          MediaData{MediaType: "episode", FullTitle: "Some Show", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("2"), WatchedStatus: 1.0, PercentComplete: 100},
+			expectedFile: "Some Show - S1E2.json",
+			shouldExist:  true,
+		},
+		{
+			name:         "Track written when allowed",
+			allowed:      []string{"track"},
+			row:          MediaData{MediaType: "track", FullTitle: "Some Song", ParentMediaIndex: json.Number("0"), MediaIndex: json.Number("0"), WatchedStatus: 1.0, PercentComplete: 100},
+			expectedFile: "Some Song - S0E0.json",
+			shouldExist:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tautulliServer := newTautulliServer(t, []MediaData{tc.row})
+			config := Config{
+				APIHost:           strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:            "test-key",
+				OutputDir:         t.TempDir(),
+				AllowedMediaTypes: tc.allowed,
+			}
+			handlePlexWebhook(httptest.NewRecorder(), newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event:    "media.stop",
+				Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+			}), config)
+
+			_, err := os.Stat(filepath.Join(config.OutputDir, tc.expectedFile))
+			if fileExists := err == nil; fileExists != tc.shouldExist {
+				t.Errorf("file exists = %v, expected %v", fileExists, tc.shouldExist)
+			}
+		})
+	}
+}
+
+func TestIncludeDuration(t *testing.T) {
+	// Tautulli versions differ in whether numbers are sent as strings. The row is a 45 minute episode
+	// stopped at 95% after 2610 seconds of play time, including a short rewind.
+	tautulliServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"response": {"result": "success", "data": {"data": [
+			{"full_title": "Long Show", "parent_media_index": "1", "media_index": "2", "watched_status": 1,
+			 "percent_complete": 95, "duration": "2610", "view_offset": 2565000}
+		]}}}`)
+	}))
+	defer tautulliServer.Close()
+
+	testCases := []struct {
+		name             string
+		include          bool
+		expectedDuration int
+		expectedWatched  int
+	}{
+		{name: "Included", include: true, expectedDuration: 2610, expectedWatched: 2565},
+		{name: "Omitted by default", include: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{
+				APIHost:         strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:          "test-key",
+				OutputDir:       t.TempDir(),
+				IncludeDuration: tc.include,
+			}
+			handlePlexWebhook(httptest.NewRecorder(), newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event:    "media.stop",
+				Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+			}), config)
+
+			fileContent, err := os.ReadFile(filepath.Join(config.OutputDir, "Long Show - S1E2.json"))
+			if err != nil {
+				t.Fatalf("Error reading file: %v", err)
+			}
+			var fileData map[string]any
+			if err := json.Unmarshal(fileContent, &fileData); err != nil {
+				t.Fatalf("Error unmarshaling file content: %v", err)
+			}
+			duration, _ := fileData["duration"].(float64)
+			if int(duration) != tc.expectedDuration {
+				t.Errorf("duration = %v, expected %d", fileData["duration"], tc.expectedDuration)
+			}
+			watched, _ := fileData["watched_seconds"].(float64)
+			if int(watched) != tc.expectedWatched {
+				t.Errorf("watched_seconds = %v, expected %d", fileData["watched_seconds"], tc.expectedWatched)
+			}
+		})
+	}
+}
+
+func TestWatchedSeconds(t *testing.T) {
+	testCases := []struct {
+		name     string
+		data     MediaData
+		expected int
+	}{
+		{name: "From view offset", data: MediaData{Duration: 2610, PercentComplete: 95, ViewOffset: 2565000}, expected: 2565},
+		// The tautulli_example.json row: 11 seconds played of an episode resumed at 97%
+		{name: "From time played", data: MediaData{Duration: 11, PercentComplete: 97}, expected: 11},
+		{name: "Unknown", data: MediaData{PercentComplete: 50}, expected: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := watchedSeconds(tc.data); got != tc.expected {
+				t.Errorf("watchedSeconds() = %d, expected %d", got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestCustomStopEvents(t *testing.T) {
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{FullTitle: "Renamed Show", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("2"), WatchedStatus: 1.0, PercentComplete: 100},
+	})
+
+	testCases := []struct {
+		name        string
+		source      string
+		event       string
+		shouldExist bool
+	}{
+		{name: "Plex custom stop event", source: SourcePlex, event: "media.end", shouldExist: true},
+		{name: "Plex other event", source: SourcePlex, event: "media.pause", shouldExist: false},
+		{name: "Jellyfin custom stop event", source: SourceJellyfin, event: "PlaybackEnded", shouldExist: true},
+		{name: "Jellyfin other event", source: SourceJellyfin, event: "PlaybackStart", shouldExist: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{
+				APIHost:           strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:            "test-key",
+				OutputDir:         t.TempDir(),
+				PlexStopEvent:     "media.end",
+				JellyfinStopEvent: "PlaybackEnded",
+			}
+			file := "Renamed Show - S1E2.json"
+			if tc.source == SourcePlex {
+				handlePlexWebhook(httptest.NewRecorder(), newPlexRequest(t, "/plex", PlexWebhookPayload{
+					Event:    tc.event,
+					Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+				}), config)
+			} else {
+				file = "Renamed Series - S1E1.json"
+				handleJellyfinWebhook(httptest.NewRecorder(), newJellyfinRequest("/jellyfin", fmt.Sprintf(`{
+					"NotificationType": %q,
+					"ItemType": "Episode",
+					"SeriesName": "Renamed Series",
+					"SeasonNumber": 1,
+					"EpisodeNumber": 1,
+					"MediaStatus": {"PlayedToCompletion": true}
+				}`, tc.event)), config)
+			}
+
+			_, err := os.Stat(filepath.Join(config.OutputDir, file))
+			if fileExists := err == nil; fileExists != tc.shouldExist {
+				t.Errorf("file exists = %v, expected %v", fileExists, tc.shouldExist)
+			}
+		})
+	}
+}
+
+func TestTitleWhitespaceTrimmed(t *testing.T) {
+	tautulliServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"response": {"result": "success", "data": {"data": [
+			{"full_title": "\u00a0Padded Show \u00a0", "parent_media_index": "1", "media_index": "2", "watched_status": 1, "percent_complete": 100}
+		]}}}`)
+	}))
+	defer tautulliServer.Close()
+
+	testCases := []struct {
+		name         string
+		source       string
+		expectedFile string
+	}{
+		{name: "Plex", source: SourcePlex, expectedFile: "Padded Show - S1E2.json"},
+		{name: "Jellyfin", source: SourceJellyfin, expectedFile: "Padded Series - S1E1.json"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{
+				APIHost:   strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:    "test-key",
+				OutputDir: t.TempDir(),
+			}
+			if tc.source == SourcePlex {
+				handlePlexWebhook(httptest.NewRecorder(), newPlexRequest(t, "/plex", PlexWebhookPayload{
+					Event:    "media.stop",
+					Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+				}), config)
+			} else {
+				handleJellyfinWebhook(httptest.NewRecorder(), newJellyfinRequest("/jellyfin", `{
+					"NotificationType": "PlaybackStop",
+					"ItemType": "Episode",
+					"Name": " Pilot\u00a0",
+					"SeriesName": "Padded Series\u00a0 ",
+					"SeasonNumber": 1,
+					"EpisodeNumber": 1,
+					"MediaStatus": {"PlayedToCompletion": true}
+				}`), config)
+			}
+
+			entries, err := os.ReadDir(config.OutputDir)
+			if err != nil {
+				t.Fatalf("Error reading output dir: %v", err)
+			}
+			if len(entries) != 1 || entries[0].Name() != tc.expectedFile {
+				var names []string
+				for _, entry := range entries {
+					names = append(names, entry.Name())
+				}
+				t.Errorf("files = %q, expected [%q]", names, tc.expectedFile)
+			}
+		})
+	}
+}
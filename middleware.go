@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// maxLoggedBodyBytes bounds how much of a request body is logged in debug mode
+const maxLoggedBodyBytes = 4096
+
+// requestIDHeader carries the correlation ID of a request, honored when sent by the client
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the length of a client supplied request ID
+const maxRequestIDLength = 64
+
+// requestIDKey is the context key of the request ID
+type requestIDKey struct{}
+
+// requestID returns the correlation ID of the request the context belongs to
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLoggerKey is the context key of the request logger
+type requestLoggerKey struct{}
+
+// requestLogger returns the logger of the request the context belongs to, which prefixes every line
+// with the request ID. Outside a request, e.g. in the poller, it returns the standard logger.
+func requestLogger(ctx context.Context) *log.Logger {
+	if logger, ok := ctx.Value(requestLoggerKey{}).(*log.Logger); ok {
+		return logger
+	}
+	return log.Default()
+}
+
+// randReader is the source of random bytes, replaceable in tests
+var randReader io.Reader = rand.Reader
+
+// newRequestID returns a short random request ID
+func newRequestID() string {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(randReader, b); err != nil {
+		return "00000000"
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether a client supplied request ID is safe to log and echo
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// concurrencyRetryAfter is the Retry-After value, in seconds, of requests shed by limitConcurrency
+const concurrencyRetryAfter = "1"
+
+// limitConcurrency answers requests beyond limit in flight with 503 Service Unavailable and a
+// Retry-After header instead of queueing them. A limit of 0 disables it.
+func limitConcurrency(next http.Handler, limit int) http.Handler {
+	if limit <= 0 {
+		return next
+	}
+	semaphore := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case semaphore <- struct{}{}:
+			defer func() { <-semaphore }()
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", concurrencyRetryAfter)
+			http.Error(w, "Too many concurrent requests", http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// limitDuration answers requests whose handler runs longer than timeout with 503 Service
+// Unavailable. The request context is cancelled at the timeout, which stops a handler waiting for a
+// Tautulli slot, a pending Tautulli request or a retry delay. A timeout of 0 disables it.
+func limitDuration(next http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return next
+	}
+	return http.TimeoutHandler(next, timeout, "Request timed out")
+}
+
+// limitRequests applies MAX_CONCURRENT_REQUESTS and REQUEST_TIMEOUT. The concurrency limit sits
+// inside the timeout, so a handler that keeps running after its request timed out still holds its
+// slot until it returns.
+func limitRequests(next http.Handler, config Config) http.Handler {
+	return limitDuration(limitConcurrency(next, config.MaxConcurrentRequests), config.RequestTimeout)
+}
+
+// responseWriter wraps an http.ResponseWriter to capture the response status
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// prefixedBody is a request body whose beginning was already read, replayed ahead of the rest
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// logRequests logs the method, path, content type, status and duration of every request. In
+// debug mode the beginning of the request body is logged as well. Every request gets a correlation
+// ID, taken from X-Request-ID when present, that is logged, echoed in the response header and
+// available to handlers through requestID and requestLogger.
+func logRequests(next http.Handler, config Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := now()
+
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		ctx = context.WithValue(ctx, requestLoggerKey{}, log.New(log.Writer(), "request_id="+id+" ", log.Flags()|log.Lmsgprefix))
+		r = r.WithContext(ctx)
+
+		// Only the logged prefix is read here, before any limit or authentication applies; the
+		// handler reads it again followed by the rest of the body
+		if config.Debug && r.Body != nil {
+			logged, err := io.ReadAll(io.LimitReader(r.Body, maxLoggedBodyBytes))
+			if err != nil {
+				log.Printf("Error reading request body for logging: %v", err)
+			}
+			r.Body = prefixedBody{Reader: io.MultiReader(bytes.NewReader(logged), r.Body), Closer: r.Body}
+			log.Printf("Request body for %s %s request_id=%s: %s", r.Method, r.URL.Path, id, logged)
+		}
+
+		rw := &responseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+
+		status := rw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		log.Printf("%s %s content-type=%q status=%d duration=%s request_id=%s",
+			r.Method, r.URL.Path, r.Header.Get("Content-Type"), status, now().Sub(start), id)
+	})
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogRequestsRecordsStatus(t *testing.T) {
+	logs := captureLog(t)
+	handler := logRequests(newRouter(Config{OutputDir: t.TempDir()}), Config{})
+
+	testCases := []struct {
+		path           string
+		expectedStatus int
+	}{
+		{path: "/unknown", expectedStatus: http.StatusNotFound},
+		{path: "/version", expectedStatus: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		logs.Reset()
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", tc.path, nil))
+
+		if rr.Code != tc.expectedStatus {
+			t.Errorf("GET %s returned status %d, expected %d", tc.path, rr.Code, tc.expectedStatus)
+		}
+		expected := "GET " + tc.path + ` content-type="" status=` + strconv.Itoa(tc.expectedStatus)
+		if !strings.Contains(logs.String(), expected) {
+			t.Errorf("Expected log to contain %q, got: %s", expected, logs.String())
+		}
+	}
+}
+
+func TestLogRequestsDebugBody(t *testing.T) {
+	logs := captureLog(t)
+	config := Config{OutputDir: t.TempDir(), Debug: true}
+	handler := logRequests(newRouter(config), config)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newJellyfinRequest("/jellyfin", `{"NotificationType": "PlaybackStart"}`))
+
+	// The handler still sees the full body after it has been logged
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if !strings.Contains(logs.String(), `{"NotificationType": "PlaybackStart"}`) {
+		t.Errorf("Expected the request body to be logged, got: %s", logs.String())
+	}
+}
+
+func TestLogRequestsDebugBodyBounded(t *testing.T) {
+	captureLog(t)
+	full := strings.Repeat("x", 10*maxLoggedBodyBytes)
+
+	testCases := []struct {
+		name         string
+		readBody     bool
+		expectedRead int
+	}{
+		{name: "Rejected request", readBody: false, expectedRead: maxLoggedBodyBytes},
+		{name: "Handler reads the body", readBody: true, expectedRead: len(full)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var received string
+			handler := logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.readBody {
+					body, _ := io.ReadAll(r.Body)
+					received = string(body)
+				}
+			}), Config{Debug: true})
+
+			body := &countingReader{Reader: strings.NewReader(full)}
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/plex", body))
+
+			if body.read != tc.expectedRead {
+				t.Errorf("read = %d bytes, expected %d", body.read, tc.expectedRead)
+			}
+			if tc.readBody && received != full {
+				t.Errorf("handler received %d bytes, expected the full %d", len(received), len(full))
+			}
+		})
+	}
+}
+
+func TestLogRequestsRequestID(t *testing.T) {
+	logs := captureLog(t)
+	var seen string
+	handler := logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestID(r.Context())
+	}), Config{})
+
+	testCases := []struct {
+		name     string
+		incoming string
+		expected string
+	}{
+		{name: "Provided", incoming: "plex-retry-42", expected: "plex-retry-42"},
+		{name: "Generated", incoming: "", expected: ""},
+		{name: "Invalid is replaced", incoming: "bad id\nwith newline", expected: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logs.Reset()
+			req := httptest.NewRequest("POST", "/plex", nil)
+			if tc.incoming != "" {
+				req.Header.Set("X-Request-ID", tc.incoming)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			id := rr.Header().Get("X-Request-ID")
+			if tc.expected != "" && id != tc.expected {
+				t.Errorf("X-Request-ID = %q, expected %q", id, tc.expected)
+			}
+			if tc.expected == "" && (len(id) != 8 || id == tc.incoming) {
+				t.Errorf("X-Request-ID = %q, expected a generated ID", id)
+			}
+			if seen != id {
+				t.Errorf("handler saw request ID %q, expected %q", seen, id)
+			}
+			if !strings.Contains(logs.String(), "request_id="+id) {
+				t.Errorf("Expected log to contain the request ID, got: %s", logs.String())
+			}
+		})
+	}
+}
+
+func TestRequestLoggerInHandlers(t *testing.T) {
+	logs := captureLog(t)
+	handler := logRequests(newRouter(Config{OutputDir: t.TempDir(), Debug: true}), Config{})
+
+	req := newJellyfinRequest("/jellyfin", `{"NotificationType": "PlaybackStart"}`)
+	req.Header.Set("X-Request-ID", "jellyfin-7")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// The handler's own lines carry the request ID, not just the middleware's summary
+	if !strings.Contains(logs.String(), "request_id=jellyfin-7 Ignoring Jellyfin event") {
+		t.Errorf("Expected the handler log to carry the request ID, got: %s", logs.String())
+	}
+	// So do the lines of the helpers the handler calls
+	movie := `{"NotificationType": "PlaybackStop", "ItemType": "Movie", "Name": "Logged Movie", "MediaStatus": {"PlayedToCompletion": true}}`
+	skipping := logRequests(newRouter(Config{OutputDir: t.TempDir(), OnConflict: OnConflictSkip}), Config{})
+	for _, id := range []string{"movie-1", "movie-2"} {
+		req := newJellyfinRequest("/jellyfin", movie)
+		req.Header.Set("X-Request-ID", id)
+		skipping.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if !strings.Contains(logs.String(), "request_id=movie-2 File Logged Movie.json already exists") {
+		t.Errorf("Expected the write helper log to carry the request ID, got: %s", logs.String())
+	}
+
+	if logger := requestLogger(context.Background()); logger != log.Default() {
+		t.Errorf("requestLogger() outside a request = %v, expected the standard logger", logger)
+	}
+}
+
+func TestNewRequestIDRandReader(t *testing.T) {
+	previous := randReader
+	t.Cleanup(func() {
+		randReader = previous
+	})
+
+	randReader = bytes.NewReader([]byte{0xde, 0xad, 0xbe, 0xef})
+	if id := newRequestID(); id != "deadbeef" {
+		t.Errorf("newRequestID() = %q, expected %q", id, "deadbeef")
+	}
+
+	// An exhausted source falls back to a fixed ID instead of failing the request
+	if id := newRequestID(); id != "00000000" {
+		t.Errorf("newRequestID() = %q, expected %q", id, "00000000")
+	}
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := limitConcurrency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}), 2)
+
+	// Saturate the limit with requests that block until released
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+		}()
+		<-started
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, expected %d", rr.Code, http.StatusServiceUnavailable)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header on a shed request")
+	}
+
+	close(release)
+	wg.Wait()
+
+	// Freed slots accept requests again
+	go func() { <-started }()
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("status after release = %d, expected %d", rr.Code, http.StatusOK)
+	}
+}
+
+func TestLimitDuration(t *testing.T) {
+	handlerDone := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(handlerDone)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+			t.Error("Handler context was not cancelled at the timeout")
+		}
+	})
+
+	rr := httptest.NewRecorder()
+	limitDuration(slow, 20*time.Millisecond).ServeHTTP(rr, httptest.NewRequest("POST", "/plex", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, expected %d", rr.Code, http.StatusServiceUnavailable)
+	}
+	<-handlerDone
+}
+
+func TestLimitRequestsHoldsSlotAfterTimeout(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	handler := limitRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		close(finished)
+	}), Config{MaxConcurrentRequests: 1, RequestTimeout: 20 * time.Millisecond})
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, expected %d after the timeout", rr.Code, http.StatusServiceUnavailable)
+	}
+	<-started
+
+	// The timed out handler is still running, so there is no free slot
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/", nil))
+	if body := strings.TrimSpace(rr.Body.String()); body != "Too many concurrent requests" {
+		t.Errorf("body = %q, expected the concurrency limit to reject the request", body)
+	}
+	close(release)
+	<-finished
+}
+
+func TestLimitDurationTautulliSlot(t *testing.T) {
+	// All Tautulli slots are taken, so the webhook waits until the request times out
+	previous := tautulliSemaphore
+	tautulliSemaphore = make(chan struct{}, 1)
+	tautulliSemaphore <- struct{}{}
+	t.Cleanup(func() {
+		tautulliSemaphore = previous
+	})
+
+	config := Config{OutputDir: t.TempDir()}
+	handlerDone := make(chan struct{})
+	handler := limitDuration(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(handlerDone)
+		handlePlexWebhook(w, r, config)
+	}), 20*time.Millisecond)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newPlexRequest(t, "/plex", PlexWebhookPayload{
+		Event:    "media.stop",
+		Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+	}))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, expected %d", rr.Code, http.StatusServiceUnavailable)
+	}
+	select {
+	case <-handlerDone:
+	case <-time.After(time.Second):
+		t.Error("Handler kept waiting for a Tautulli slot after the timeout")
+	}
+}
+
+func TestLimitDurationCancelsTautulli(t *testing.T) {
+	// Tautulli never answers, and an empty history would be retried long after the timeout
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-stalled:
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(stalled) })
+
+	emptyServer := newTautulliServer(t, nil)
+	testCases := []struct {
+		name   string
+		config Config
+	}{
+		{name: "Pending request", config: Config{APIHost: strings.TrimPrefix(server.URL, "http://")}},
+		{name: "Retry delay", config: Config{
+			APIHost:             strings.TrimPrefix(emptyServer.URL, "http://"),
+			EmptyDataBehavior:   EmptyDataRetry,
+			EmptyDataRetries:    3,
+			EmptyDataRetryDelay: time.Minute,
+		}},
+		{name: "Settle delay", config: Config{
+			APIHost:               strings.TrimPrefix(emptyServer.URL, "http://"),
+			TautulliSettleRetries: 3,
+			TautulliSettleDelay:   time.Minute,
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.config.OutputDir = t.TempDir()
+			handlerDone := make(chan struct{})
+			handler := limitDuration(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer close(handlerDone)
+				handlePlexWebhook(w, r, tc.config)
+			}), 20*time.Millisecond)
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, newPlexRequest(t, "/plex", PlexWebhookPayload{
+				Event:    PlexEventStop,
+				Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+			}))
+			if rr.Code != http.StatusServiceUnavailable {
+				t.Errorf("status = %d, expected %d", rr.Code, http.StatusServiceUnavailable)
+			}
+			select {
+			case <-handlerDone:
+			case <-time.After(time.Second):
+				t.Error("Handler kept working on Tautulli after the timeout")
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+// nfoExtension is the output extension for OUTPUT_FORMAT=nfo
+const nfoExtension = ".nfo"
+
+// nfoTimeLayout is the format Kodi expects for <lastplayed>
+const nfoTimeLayout = "2006-01-02 15:04:05"
+
+// Values for Config.OutputFormat
+const (
+	OutputFormatJSON = "json"
+	OutputFormatNFO  = "nfo"
+)
+
+// nfoUniqueID is a provider ID in a Kodi NFO file
+type nfoUniqueID struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+// nfoEpisode is the Kodi <episodedetails> NFO of a TV episode
+type nfoEpisode struct {
+	XMLName    xml.Name      `xml:"episodedetails"`
+	Title      string        `xml:"title"`
+	ShowTitle  string        `xml:"showtitle,omitempty"`
+	Season     string        `xml:"season"`
+	Episode    string        `xml:"episode"`
+	PlayCount  int           `xml:"playcount"`
+	Watched    bool          `xml:"watched"`
+	LastPlayed string        `xml:"lastplayed,omitempty"`
+	UniqueIDs  []nfoUniqueID `xml:"uniqueid"`
+}
+
+// nfoMovie is the Kodi <movie> NFO of a movie
+type nfoMovie struct {
+	XMLName    xml.Name      `xml:"movie"`
+	Title      string        `xml:"title"`
+	PlayCount  int           `xml:"playcount"`
+	Watched    bool          `xml:"watched"`
+	LastPlayed string        `xml:"lastplayed,omitempty"`
+	UniqueIDs  []nfoUniqueID `xml:"uniqueid"`
+}
+
+// isEpisode reports whether the media data describes a TV episode rather than a movie or music
+func (m MediaData) isEpisode() bool {
+	switch m.MediaType {
+	case "episode":
+		return true
+	case "movie", "track", "album":
+		return false
+	}
+	return m.MediaIndex != "" && m.MediaIndex != "0"
+}
+
+// nfoLastPlayed converts the RFC3339 watched_at time to Kodi's format, keeping its local time.
+// Unparseable times are left out.
+func nfoLastPlayed(watchedAt string) string {
+	t, err := time.Parse(time.RFC3339, watchedAt)
+	if err != nil {
+		return ""
+	}
+	return t.Format(nfoTimeLayout)
+}
+
+// encodeNFO returns a minimal Kodi compatible NFO document for the media data
+func encodeNFO(data MediaData) ([]byte, error) {
+	var playCount int
+	if data.WatchedStatus >= 1.0 {
+		playCount = 1
+	}
+	var uniqueIDs []nfoUniqueID
+	for _, provider := range slices.Sorted(maps.Keys(data.ProviderIDs)) {
+		uniqueIDs = append(uniqueIDs, nfoUniqueID{Type: provider, Value: data.ProviderIDs[provider]})
+	}
+
+	var document any
+	if data.isEpisode() {
+		title := data.Title
+		if title == "" {
+			title = data.FullTitle
+		}
+		document = nfoEpisode{
+			Title:      title,
+			ShowTitle:  data.GrandparentTitle,
+			Season:     data.ParentMediaIndex.String(),
+			Episode:    data.MediaIndex.String(),
+			PlayCount:  playCount,
+			Watched:    playCount > 0,
+			LastPlayed: nfoLastPlayed(data.WatchedAt),
+			UniqueIDs:  uniqueIDs,
+		}
+	} else {
+		document = nfoMovie{
+			Title:      data.FullTitle,
+			PlayCount:  playCount,
+			Watched:    playCount > 0,
+			LastPlayed: nfoLastPlayed(data.WatchedAt),
+			UniqueIDs:  uniqueIDs,
+		}
+	}
+
+	content, err := xml.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling NFO: %w", err)
+	}
+	return append([]byte(xml.Header), append(content, '\n')...), nil
+}
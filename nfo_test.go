@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutputFormatNFO(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       Config
+		data         MediaData
+		expectedFile string
+		expectedRoot string
+		expected     nfoEpisode
+	}{
+		{
+			name:   "episode",
+			config: Config{OutputFormat: OutputFormatNFO, IncludeProviderIDs: true},
+			data: MediaData{
+				MediaType: "episode", FullTitle: "Show - Pilot", Title: "Pilot", GrandparentTitle: "Show",
+				ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("2"), WatchedStatus: 1.0,
+				ProviderIDs: map[string]string{"tvdb": "123", "imdb": "tt456"}, WatchedAt: "2024-05-01T21:30:15+02:00",
+			},
+			expectedFile: "Show - S1E2.nfo",
+			expectedRoot: "episodedetails",
+			expected: nfoEpisode{
+				Title: "Pilot", ShowTitle: "Show", Season: "1", Episode: "2", PlayCount: 1, Watched: true,
+				LastPlayed: "2024-05-01 21:30:15",
+			},
+		},
+		{
+			name:   "movie",
+			config: Config{OutputFormat: OutputFormatNFO, OutputExtension: ".watched.json"},
+			data: MediaData{
+				MediaType: "movie", FullTitle: "Some Movie",
+				ParentMediaIndex: json.Number("0"), MediaIndex: json.Number("0"), WatchedStatus: 1.0,
+				WatchedAt: "2024-05-01T19:30:15Z",
+			},
+			expectedFile: "Some Movie.watched.nfo",
+			expectedRoot: "movie",
+			expected:     nfoEpisode{Title: "Some Movie", PlayCount: 1, Watched: true, LastPlayed: "2024-05-01 19:30:15"},
+		},
+		{
+			name:   "unwatched Jellyfin episode",
+			config: Config{OutputFormat: OutputFormatNFO},
+			data: MediaData{
+				FullTitle: "Other Show", ParentMediaIndex: json.Number("3"), MediaIndex: json.Number("4"),
+			},
+			expectedFile: "Other Show - S3E4.nfo",
+			expectedRoot: "episodedetails",
+			expected:     nfoEpisode{Title: "Other Show", Season: "3", Episode: "4"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.OutputDir = t.TempDir()
+			baseName := tt.data.FullTitle
+			if tt.data.isEpisode() {
+				baseName = tt.data.GrandparentTitle
+				if baseName == "" {
+					baseName = tt.data.FullTitle
+				}
+				baseName += " - S" + tt.data.ParentMediaIndex.String() + "E" + tt.data.MediaIndex.String()
+			}
+			filename := tt.config.outputFilename(baseName)
+			if filename != tt.expectedFile {
+				t.Errorf("filename = %q, expected %q", filename, tt.expectedFile)
+			}
+			outputPath, err := writeMediaData(t.Context(), tt.config, tt.config.OutputDir, filename, tt.data)
+			if err != nil {
+				t.Fatalf("writeMediaData() error = %v", err)
+			}
+
+			content, err := os.ReadFile(outputPath)
+			if err != nil {
+				t.Fatalf("Error reading file: %v", err)
+			}
+			var document struct {
+				XMLName xml.Name
+				nfoEpisode
+			}
+			if err := xml.Unmarshal(content, &document); err != nil {
+				t.Fatalf("File is not well-formed XML: %v\n%s", err, content)
+			}
+			if document.XMLName.Local != tt.expectedRoot {
+				t.Errorf("root element = %q, expected %q", document.XMLName.Local, tt.expectedRoot)
+			}
+			got := document.nfoEpisode
+			if got.Title != tt.expected.Title || got.ShowTitle != tt.expected.ShowTitle ||
+				got.Season != tt.expected.Season || got.Episode != tt.expected.Episode ||
+				got.PlayCount != tt.expected.PlayCount || got.Watched != tt.expected.Watched ||
+				got.LastPlayed != tt.expected.LastPlayed {
+				t.Errorf("nfo = %+v, expected %+v", got, tt.expected)
+			}
+			if len(got.UniqueIDs) != len(tt.data.ProviderIDs) {
+				t.Errorf("uniqueid = %v, expected %v", got.UniqueIDs, tt.data.ProviderIDs)
+			}
+			for _, id := range got.UniqueIDs {
+				if tt.data.ProviderIDs[id.Type] != id.Value {
+					t.Errorf("uniqueid %s = %q, expected %q", id.Type, id.Value, tt.data.ProviderIDs[id.Type])
+				}
+			}
+			if filepath.Ext(outputPath) != nfoExtension {
+				t.Errorf("extension = %q, expected %q", filepath.Ext(outputPath), nfoExtension)
+			}
+		})
+	}
+}
+
+func TestIsEpisode(t *testing.T) {
+	testCases := []struct {
+		name     string
+		data     MediaData
+		expected bool
+	}{
+		{name: "Episode", data: MediaData{MediaType: "episode"}, expected: true},
+		{name: "Movie", data: MediaData{MediaType: "movie", MediaIndex: json.Number("2")}, expected: false},
+		{name: "Track", data: MediaData{MediaType: "track", MediaIndex: json.Number("3")}, expected: false},
+		{name: "Album", data: MediaData{MediaType: "album", MediaIndex: json.Number("0")}, expected: false},
+		{name: "Untyped with index", data: MediaData{MediaIndex: json.Number("4")}, expected: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.data.isEpisode(); got != tc.expected {
+				t.Errorf("isEpisode() = %v, expected %v", got, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// errWriterClosed is returned when writing to an OutputWriter that has been closed
+var errWriterClosed = errors.New("output writer is closed")
+
+// OutputWriter persists media data records. Backends that buffer writes must flush them in Close.
+type OutputWriter interface {
+	// Write stores the media data at the given path
+	Write(data MediaData, path string) error
+	// Close flushes any pending writes and releases resources. Writes after Close fail.
+	Close() error
+}
+
+// output is the active OutputWriter, replaced in main according to the configuration
+var output OutputWriter = &fileWriter{}
+
+// pathLockShards is the number of mutexes output paths are spread across
+const pathLockShards = 64
+
+// pathLocks serializes writes to the same output path, sharded by a hash of the path
+var pathLocks [pathLockShards]sync.Mutex
+
+// lockPath locks the shard of the given path and returns the function that unlocks it
+func lockPath(path string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	mu := &pathLocks[h.Sum32()%pathLockShards]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// fileWriter writes each record as an indented JSON file on the local filesystem
+type fileWriter struct {
+	mu     sync.RWMutex
+	closed bool
+}
+
+// Write writes the media data as JSON to path, creating the parent directory if needed. The file is
+// written to a temporary file first and renamed into place, so readers never see a partial file.
+func (f *fileWriter) Write(data MediaData, path string) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return errWriterClosed
+	}
+
+	// Create the output directory if it doesn't exist
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating output directory: %w", err)
+	}
+
+	content, err := encodeMediaData(data, path)
+	if err != nil {
+		return err
+	}
+
+	// Write the data to a temporary file and move it into place
+	tmp, err := os.CreateTemp(dir, ".plex-clean-*.tmp")
+	if err != nil {
+		return fmt.Errorf("error writing file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("error writing file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error writing file: %w", err)
+	}
+	return nil
+}
+
+// encodeMediaData returns the indented JSON of the media data, or a Kodi NFO document when path
+// ends in .nfo, gzip compressed when path ends in .gz
+func encodeMediaData(data MediaData, path string) ([]byte, error) {
+	var content []byte
+	var err error
+	if strings.HasSuffix(strings.TrimSuffix(path, gzipExtension), nfoExtension) {
+		content, err = encodeNFO(data)
+	} else if content, err = json.MarshalIndent(data, "", "  "); err != nil {
+		err = fmt.Errorf("error marshaling JSON: %w", err)
+	}
+	if err != nil || !strings.HasSuffix(path, gzipExtension) {
+		return content, err
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(content); err != nil {
+		return nil, fmt.Errorf("error compressing output: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("error compressing output: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeMediaData parses a file written by encodeMediaData
+func decodeMediaData(content []byte, path string) (MediaData, error) {
+	var data MediaData
+	if strings.HasSuffix(path, gzipExtension) {
+		gz, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return data, fmt.Errorf("error decompressing JSON: %w", err)
+		}
+		defer gz.Close()
+		if content, err = io.ReadAll(gz); err != nil {
+			return data, fmt.Errorf("error decompressing JSON: %w", err)
+		}
+	}
+	err := json.Unmarshal(content, &data)
+	return data, err
+}
+
+// Remove deletes the file at path
+func (f *fileWriter) Remove(path string) error {
+	return os.Remove(path)
+}
+
+// outputChecker is implemented by OutputWriters whose records are not local files, so that
+// ON_CONFLICT can see what they already hold
+type outputChecker interface {
+	// Exists reports whether a record is stored at the given path
+	Exists(path string) (bool, error)
+}
+
+// outputExists reports whether the active output backend holds a record at path, looking at the
+// local filesystem unless the backend implements outputChecker
+func outputExists(path string) (bool, error) {
+	if checker, ok := output.(outputChecker); ok {
+		return checker.Exists(path)
+	}
+	_, err := os.Stat(path)
+	return err == nil, nil
+}
+
+// Close waits for in-progress writes to finish and rejects any further writes
+func (f *fileWriter) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// checkOutputDir verifies that dir exists or can be created and that files can be written into it
+// by creating and removing a probe file
+func checkOutputDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating output directory: %w", err)
+	}
+	probe, err := os.CreateTemp(dir, ".plex-clean-probe-*")
+	if err != nil {
+		return fmt.Errorf("output directory %s is not writable: %w", dir, err)
+	}
+	probe.Close()
+	if err := os.Remove(probe.Name()); err != nil {
+		return fmt.Errorf("error removing probe file: %w", err)
+	}
+	return nil
+}
+
+// respondWriteError reports a failed write to the webhook sender. Permission errors will not go
+// away on retry, so they are acknowledged with 200 to stop the sender from retrying endlessly,
+// unless FAIL_ON_WRITE_ERROR asks for every failure to be retried.
+func respondWriteError(w http.ResponseWriter, r *http.Request, err error, config Config) {
+	logger := requestLogger(r.Context())
+
+	if errors.Is(err, fs.ErrPermission) && !config.FailOnWriteError {
+		logger.Printf("Error: output is not writable, dropping event: %v", err)
+		respondOK(w)
+		return
+	}
+	logger.Printf("Error writing media data: %v", err)
+	http.Error(w, "Error writing file", http.StatusInternalServerError)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFileWriterCloseFlushesPendingWrites(t *testing.T) {
+	dir := t.TempDir()
+	writer := &fileWriter{}
+
+	// Start a batch of writes and close the writer while they may still be in progress
+	var wg sync.WaitGroup
+	results := make([]error, 20)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := MediaData{FullTitle: fmt.Sprintf("Show %d", i), WatchedStatus: 1.0}
+			results[i] = writer.Write(data, filepath.Join(dir, "nested", fmt.Sprintf("%d.json", i)))
+		}(i)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	wg.Wait()
+
+	// Every write that was accepted must be fully on disk once Close has returned
+	for i, err := range results {
+		if errors.Is(err, errWriterClosed) {
+			continue
+		}
+		if err != nil {
+			t.Errorf("Write %d returned error: %v", i, err)
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, "nested", fmt.Sprintf("%d.json", i)))
+		if err != nil {
+			t.Errorf("Error reading file %d: %v", i, err)
+			continue
+		}
+		var fileData MediaData
+		if err := json.Unmarshal(content, &fileData); err != nil {
+			t.Errorf("File %d is not valid JSON: %v", i, err)
+		}
+	}
+
+	// Writes after Close are rejected
+	if err := writer.Write(MediaData{}, filepath.Join(dir, "late.json")); !errors.Is(err, errWriterClosed) {
+		t.Errorf("Write after Close returned %v, expected %v", err, errWriterClosed)
+	}
+}
+
+// permissionDeniedWriter simulates an output on a read-only mount
+type permissionDeniedWriter struct{}
+
+func (permissionDeniedWriter) Write(data MediaData, path string) error {
+	return &fs.PathError{Op: "open", Path: path, Err: fs.ErrPermission}
+}
+
+func (permissionDeniedWriter) Close() error { return nil }
+
+func TestOutputDirNotWritable(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatalf("Error making directory read-only: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = os.Chmod(dir, 0755)
+	})
+
+	t.Run("Startup check", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("directory permissions are not enforced for root")
+		}
+		if err := checkOutputDir(dir); err == nil {
+			t.Errorf("checkOutputDir() error = nil, expected an error for a read-only directory")
+		}
+	})
+
+	t.Run("Handler acknowledges permission errors", func(t *testing.T) {
+		previous := output
+		output = permissionDeniedWriter{}
+		t.Cleanup(func() {
+			output = previous
+		})
+		logs := captureLog(t)
+
+		req := newJellyfinRequest("/jellyfin", `{"NotificationType": "PlaybackStop", "MediaStatus": {"PlayedToCompletion": true}, "ItemType": "Movie", "Name": "Read Only Movie"}`)
+		rr := httptest.NewRecorder()
+		handleJellyfinWebhook(rr, req, Config{OutputDir: dir})
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("status = %d, expected %d", rr.Code, http.StatusOK)
+		}
+		if !strings.Contains(logs.String(), "not writable") {
+			t.Errorf("log = %q, expected it to mention the output is not writable", logs.String())
+		}
+	})
+}
+
+func TestCheckOutputDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "new")
+	if err := checkOutputDir(dir); err != nil {
+		t.Fatalf("checkOutputDir() error = %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Error reading directory: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("probe file was left behind: %v", entries)
+	}
+}
+
+func TestOutputCompressGzip(t *testing.T) {
+	config := Config{OutputDir: t.TempDir(), OutputCompress: OutputCompressGzip}
+	data := MediaData{FullTitle: "Compressed Show", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("2"), WatchedStatus: 1.0}
+
+	filename := config.outputFilename("Compressed Show - S1E2")
+	if filename != "Compressed Show - S1E2.json.gz" {
+		t.Errorf("filename = %q, expected %q", filename, "Compressed Show - S1E2.json.gz")
+	}
+	outputPath, err := writeMediaData(t.Context(), config, config.OutputDir, filename, data)
+	if err != nil {
+		t.Fatalf("writeMediaData() error = %v", err)
+	}
+
+	file, err := os.Open(outputPath)
+	if err != nil {
+		t.Fatalf("Error opening file: %v", err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("File is not valid gzip: %v", err)
+	}
+	var fileData MediaData
+	if err := json.NewDecoder(gz).Decode(&fileData); err != nil {
+		t.Fatalf("Error decoding compressed JSON: %v", err)
+	}
+	if fileData.FullTitle != data.FullTitle {
+		t.Errorf("full_title = %q, expected %q", fileData.FullTitle, data.FullTitle)
+	}
+
+	// No temporary files are left behind
+	entries, err := os.ReadDir(config.OutputDir)
+	if err != nil {
+		t.Fatalf("Error reading output dir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("files = %d, expected only the written file", len(entries))
+	}
+}
+
+func TestConcurrentWritesToSameFilename(t *testing.T) {
+	testCases := []struct {
+		name          string
+		onConflict    string
+		expectedFiles int
+	}{
+		{name: "Overwrite", onConflict: OnConflictOverwrite, expectedFiles: 1},
+		{name: "Suffix", onConflict: OnConflictSuffix, expectedFiles: 10},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{OutputDir: t.TempDir(), OnConflict: tc.onConflict}
+
+			var wg sync.WaitGroup
+			for i := range tc.expectedFiles {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					data := MediaData{FullTitle: fmt.Sprintf("Writer %d", i), WatchedStatus: 1.0}
+					if _, err := writeMediaData(t.Context(), config, config.OutputDir, "Race Show - S1E1.json", data); err != nil {
+						t.Errorf("writeMediaData() error = %v", err)
+					}
+				}(i)
+			}
+			if tc.onConflict == OnConflictOverwrite {
+				// Race a second writer against the first for the same path
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := writeMediaData(t.Context(), config, config.OutputDir, "Race Show - S1E1.json", MediaData{FullTitle: "Other Writer"}); err != nil {
+						t.Errorf("writeMediaData() error = %v", err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			entries, err := os.ReadDir(config.OutputDir)
+			if err != nil {
+				t.Fatalf("Error reading output dir: %v", err)
+			}
+			if len(entries) != tc.expectedFiles {
+				t.Errorf("files = %d, expected %d", len(entries), tc.expectedFiles)
+			}
+			for _, entry := range entries {
+				content, err := os.ReadFile(filepath.Join(config.OutputDir, entry.Name()))
+				if err != nil {
+					t.Fatalf("Error reading file: %v", err)
+				}
+				var fileData MediaData
+				if err := json.Unmarshal(content, &fileData); err != nil {
+					t.Errorf("File %s is not valid JSON: %v", entry.Name(), err)
+				}
+			}
+		})
+	}
+}
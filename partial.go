@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// partialIndex remembers the paths partial records were written to by rating key, so that a resume
+// can remove them whatever the output format, schema or backend
+type partialIndex struct {
+	mu    sync.Mutex
+	paths map[string][]string
+}
+
+// partials is the shared index of written partial records. It is kept in memory only, records
+// written before a restart are found by scanning PARTIAL_DIR instead.
+var partials = newPartialIndex()
+
+func newPartialIndex() *partialIndex {
+	return &partialIndex{paths: make(map[string][]string)}
+}
+
+// add records that a partial record of the rating key was written to path
+func (p *partialIndex) add(ratingKey FlexibleInt, path string) {
+	if ratingKey == 0 {
+		return
+	}
+	key := strconv.Itoa(int(ratingKey))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, existing := range p.paths[key] {
+		if existing == path {
+			return
+		}
+	}
+	p.paths[key] = append(p.paths[key], path)
+}
+
+// take returns and forgets the partial record paths of the rating key, and whether any were indexed
+func (p *partialIndex) take(ratingKey string) ([]string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	paths, ok := p.paths[ratingKey]
+	delete(p.paths, ratingKey)
+	return paths, ok
+}
+
+// forget drops the indexed partial records of the rating key, once it was written as watched
+func (p *partialIndex) forget(ratingKey FlexibleInt) {
+	if ratingKey == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.paths, strconv.Itoa(int(ratingKey)))
+}
+
+// scanPartialRecords returns the local records in PARTIAL_DIR that carry the rating key. Records
+// without one, in the legacy schema or NFO format, can't be matched.
+func scanPartialRecords(ctx context.Context, config Config, ratingKey string) []string {
+	logger := requestLogger(ctx)
+
+	paths, err := filepath.Glob(filepath.Join(config.PartialDir, "*"+config.outputExtension()))
+	if err != nil {
+		logger.Printf("Error listing partial records: %v", err)
+		return nil
+	}
+	var matches []string
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			logger.Printf("Error reading partial record %s: %v", path, err)
+			continue
+		}
+		data, err := decodeMediaData(content, path)
+		if err == nil && strconv.Itoa(int(data.RatingKey)) == ratingKey {
+			matches = append(matches, path)
+		}
+	}
+	return matches
+}
+
+// outputRemover is implemented by OutputWriters that can delete a record they wrote
+type outputRemover interface {
+	// Remove deletes the record at the given path
+	Remove(path string) error
+}
+
+// removePartialRecords deletes the partial records written for a Plex rating key. Records that are
+// not indexed, because they were written before a restart, are looked up in PARTIAL_DIR when the
+// output is local.
+func removePartialRecords(ctx context.Context, config Config, ratingKey string) {
+	logger := requestLogger(ctx)
+
+	if config.PartialDir == "" || ratingKey == "" {
+		return
+	}
+
+	remover, ok := output.(outputRemover)
+	if !ok {
+		logger.Printf("Output backend cannot remove records, keeping partial records of %s", ratingKey)
+		return
+	}
+	paths, ok := partials.take(ratingKey)
+	if _, remote := output.(outputChecker); !ok && !remote {
+		paths = scanPartialRecords(ctx, config, ratingKey)
+	}
+	for _, path := range paths {
+		unlock := lockPath(path)
+		err := remover.Remove(path)
+		unlock()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			logger.Printf("Error removing partial record %s: %v", path, err)
+			continue
+		}
+		logger.Printf("Media resumed in Plex, removed partial record %s", path)
+	}
+}
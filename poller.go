@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// pollTautulli polls Tautulli's history at the configured interval until ctx is cancelled. It
+// catches completions whose webhook never arrived. Each poll uses the configuration current returns,
+// so reloaded settings apply from the next poll on.
+func pollTautulli(ctx context.Context, current func() Config) {
+	ticker := time.NewTicker(current().PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := pollOnce(ctx, current()); err != nil && ctx.Err() == nil {
+			log.Printf("Error polling Tautulli: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pollOnce queries Tautulli for the most recent history rows and records any completion not
+// already in the dedup cache. It returns the number of rows that were written.
+func pollOnce(ctx context.Context, config Config) (int, error) {
+	params := url.Values{}
+	params.Set("cmd", "get_history")
+	params.Set("order_column", "started")
+	params.Set("order", "desc")
+	params.Set("length", strconv.Itoa(config.PollLength))
+	return recordHistory(ctx, config, params, "Poller")
+}
+
+// recordHistory runs a get_history query and records every completion in the result that is not
+// already in the dedup cache. The query shares the TAUTULLI_MAX_CONCURRENCY slots with webhooks.
+// It returns the number of rows that were written; failed writes are logged.
+func recordHistory(ctx context.Context, config Config, params url.Values, caller string) (_ int, err error) {
+	defer func() {
+		if err != nil {
+			stats.TautulliErrors.Add(1)
+		}
+	}()
+
+	config.addHistoryFilters(params)
+	if err := acquireTautulli(ctx); err != nil {
+		return 0, err
+	}
+	var tautulliResp TautulliResponse
+	err = tautulliRequest(ctx, config, params, &tautulliResp)
+	releaseTautulli()
+	if err != nil {
+		return 0, err
+	}
+	if tautulliResp.Response.Result == "error" {
+		return 0, fmt.Errorf("tautulli API error: %s", tautulliResp.Response.Message)
+	}
+
+	written := 0
+	for _, data := range tautulliResp.Response.Data.Data {
+		if ctx.Err() != nil {
+			return written, ctx.Err()
+		}
+		if !config.plexWatched(data) || dedup.Seen(plexDedupKey(data)) {
+			continue
+		}
+		if config.Debug {
+			log.Printf("%s found unrecorded completion: %s", caller, data.FullTitle)
+		}
+		reason, writeErr := processPlexRow(ctx, config, PlexEventStop, 0, data)
+		switch {
+		case writeErr != nil:
+			log.Printf("%s failed to record %s: %v", caller, data.FullTitle, writeErr)
+		case reason != "":
+			if config.Debug {
+				log.Printf("%s skipped %s: %s", caller, data.FullTitle, reason)
+			}
+		default:
+			written++
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPollOnce(t *testing.T) {
+	previous := dedup
+	cache, err := newDedupCache(time.Hour, "")
+	if err != nil {
+		t.Fatalf("newDedupCache() error = %v", err)
+	}
+	dedup = cache
+	t.Cleanup(func() {
+		dedup = previous
+	})
+
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{
+			FullTitle:        "Polled Show",
+			ParentMediaIndex: json.Number("3"),
+			MediaIndex:       json.Number("4"),
+			WatchedStatus:    1.0,
+		},
+		{
+			FullTitle:        "Unfinished Show",
+			ParentMediaIndex: json.Number("1"),
+			MediaIndex:       json.Number("1"),
+			WatchedStatus:    0.5,
+		},
+	})
+	config := Config{
+		APIHost:    strings.TrimPrefix(tautulliServer.URL, "http://"),
+		APIKey:     "test-key",
+		OutputDir:  t.TempDir(),
+		PollLength: 25,
+	}
+
+	processed, err := pollOnce(t.Context(), config)
+	if err != nil {
+		t.Fatalf("pollOnce() error = %v", err)
+	}
+	if processed != 1 {
+		t.Errorf("processed = %d, expected 1", processed)
+	}
+	outputPath := filepath.Join(config.OutputDir, "Polled Show - S3E4.json")
+	if _, err := os.Stat(outputPath); err != nil {
+		t.Fatalf("expected %s to be written: %v", outputPath, err)
+	}
+
+	// A second poll must not rewrite items that were already recorded
+	if err := os.Remove(outputPath); err != nil {
+		t.Fatalf("Error removing output: %v", err)
+	}
+	processed, err = pollOnce(t.Context(), config)
+	if err != nil {
+		t.Fatalf("pollOnce() error = %v", err)
+	}
+	if processed != 0 {
+		t.Errorf("processed = %d, expected 0", processed)
+	}
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Errorf("expected %s not to be rewritten", outputPath)
+	}
+}
+
+func TestPollOnceWriteError(t *testing.T) {
+	previous := dedup
+	cache, err := newDedupCache(time.Hour, "")
+	if err != nil {
+		t.Fatalf("newDedupCache() error = %v", err)
+	}
+	dedup = cache
+	t.Cleanup(func() {
+		dedup = previous
+	})
+	logs := captureLog(t)
+
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{FullTitle: "Unwritable Show", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("2"), WatchedStatus: 1.0},
+	})
+	// A file in place of the output directory makes every write fail
+	blocker := filepath.Join(t.TempDir(), "blocker")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatalf("Error writing blocker: %v", err)
+	}
+	config := Config{
+		APIHost:    strings.TrimPrefix(tautulliServer.URL, "http://"),
+		APIKey:     "test-key",
+		OutputDir:  filepath.Join(blocker, "output"),
+		PollLength: 25,
+	}
+
+	processed, err := pollOnce(t.Context(), config)
+	if err != nil {
+		t.Fatalf("pollOnce() error = %v", err)
+	}
+	if processed != 0 {
+		t.Errorf("processed = %d, expected 0 for a failed write", processed)
+	}
+	if !strings.Contains(logs.String(), "Poller failed to record Unwritable Show") {
+		t.Errorf("Expected the failed write to be logged, got: %s", logs.String())
+	}
+}
+
+func TestPollOnceCancelled(t *testing.T) {
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{FullTitle: "Cancelled Show", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("2"), WatchedStatus: 1.0},
+	})
+	config := Config{
+		APIHost:    strings.TrimPrefix(tautulliServer.URL, "http://"),
+		APIKey:     "test-key",
+		OutputDir:  t.TempDir(),
+		PollLength: 25,
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if _, err := pollOnce(ctx, config); !errors.Is(err, context.Canceled) {
+		t.Errorf("pollOnce() error = %v, expected %v", err, context.Canceled)
+	}
+	if _, err := os.Stat(filepath.Join(config.OutputDir, "Cancelled Show - S1E2.json")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written after cancellation")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultRecentBufferSize is the number of events kept for /recent unless RECENT_BUFFER_SIZE is set
+const defaultRecentBufferSize = 50
+
+// Results of a RecentEvent
+const (
+	RecentResultWritten = "written"
+	RecentResultIgnored = "ignored"
+	RecentResultFailed  = "failed"
+)
+
+// RecentEvent is a processed webhook item as listed by /recent
+type RecentEvent struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Title  string    `json:"title"`
+	Result string    `json:"result"`
+	// Reason is why the item was ignored or the error it failed with
+	Reason string `json:"reason,omitempty"`
+}
+
+// recentEvents is a ring buffer of the most recent events
+type recentEvents struct {
+	mu     sync.Mutex
+	events []RecentEvent
+	next   int
+	full   bool
+}
+
+// recent holds the events listed by /recent
+var recent = newRecentEvents(defaultRecentBufferSize)
+
+// newRecentEvents returns a buffer keeping the last size events, 0 keeps none
+func newRecentEvents(size int) *recentEvents {
+	return &recentEvents{events: make([]RecentEvent, size)}
+}
+
+// add records the outcome of processing an item, given as the ignore reason or error of the
+// processing function
+func (b *recentEvents) add(source, title, reason string, err error) {
+	event := RecentEvent{Time: now(), Source: source, Title: title, Result: RecentResultWritten}
+	switch {
+	case err != nil:
+		event.Result, event.Reason = RecentResultFailed, err.Error()
+	case reason != "":
+		event.Result, event.Reason = RecentResultIgnored, reason
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.events) == 0 {
+		return
+	}
+	b.events[b.next] = event
+	b.next = (b.next + 1) % len(b.events)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// list returns the recorded events, newest first
+func (b *recentEvents) list() []RecentEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	count := b.next
+	if b.full {
+		count = len(b.events)
+	}
+	events := make([]RecentEvent, 0, count)
+	for i := 1; i <= count; i++ {
+		events = append(events, b.events[(b.next-i+len(b.events))%len(b.events)])
+	}
+	return events
+}
+
+// handleRecent serves the most recent processed events, newest first
+func handleRecent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(recent.list()); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
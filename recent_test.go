@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecentEndpoint(t *testing.T) {
+	previous := recent
+	recent = newRecentEvents(10)
+	t.Cleanup(func() {
+		recent = previous
+	})
+
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{FullTitle: "Recent Show", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("2"), WatchedStatus: 1.0, PercentComplete: 100},
+	})
+	config := Config{
+		APIHost:   strings.TrimPrefix(tautulliServer.URL, "http://"),
+		APIKey:    "test-key",
+		OutputDir: t.TempDir(),
+	}
+	router := newRouter(config)
+
+	router.ServeHTTP(httptest.NewRecorder(), newJellyfinRequest("/jellyfin", `{
+		"NotificationType": "PlaybackStop",
+		"ItemType": "Episode",
+		"Name": "Pilot",
+		"SeriesName": "Recent Series",
+		"SeasonNumber": 1,
+		"EpisodeNumber": 1,
+		"MediaStatus": {"PlayedToCompletion": false}
+	}`))
+	router.ServeHTTP(httptest.NewRecorder(), newPlexRequest(t, "/plex", PlexWebhookPayload{
+		Event:    "media.stop",
+		Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+	}))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/recent", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, expected %d", rr.Code, http.StatusOK)
+	}
+	var events []RecentEvent
+	if err := json.Unmarshal(rr.Body.Bytes(), &events); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+
+	expected := []RecentEvent{
+		{Source: SourcePlex, Title: "Recent Show", Result: RecentResultWritten},
+		{Source: SourceJellyfin, Title: "Recent Series - Pilot", Result: RecentResultIgnored, Reason: "not played to completion"},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("events = %+v, expected %d", events, len(expected))
+	}
+	for i, event := range events {
+		if event.Source != expected[i].Source || event.Title != expected[i].Title ||
+			event.Result != expected[i].Result || event.Reason != expected[i].Reason {
+			t.Errorf("events[%d] = %+v, expected %+v", i, event, expected[i])
+		}
+		if event.Time.IsZero() {
+			t.Errorf("events[%d] has no time", i)
+		}
+	}
+}
+
+func TestRecentEventsRing(t *testing.T) {
+	testCases := []struct {
+		name     string
+		size     int
+		added    []string
+		expected []string
+	}{
+		{name: "Partially filled", size: 3, added: []string{"a", "b"}, expected: []string{"b", "a"}},
+		{name: "Wrapped", size: 3, added: []string{"a", "b", "c", "d", "e"}, expected: []string{"e", "d", "c"}},
+		{name: "Disabled", size: 0, added: []string{"a"}, expected: []string{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			buffer := newRecentEvents(tc.size)
+			for _, title := range tc.added {
+				buffer.add(SourcePlex, title, "", nil)
+			}
+			titles := []string{}
+			for _, event := range buffer.list() {
+				titles = append(titles, event.Title)
+			}
+			if strings.Join(titles, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("titles = %v, expected %v", titles, tc.expected)
+			}
+		})
+	}
+
+	buffer := newRecentEvents(1)
+	buffer.add(SourceJellyfin, "Broken", "", errors.New("disk full"))
+	if event := buffer.list()[0]; event.Result != RecentResultFailed || event.Reason != "disk full" {
+		t.Errorf("event = %+v, expected a failed event with the error", event)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// reloadableRouter serves requests with the router of the active configuration. A reload swaps the
+// configuration atomically, requests in flight finish with the configuration they started with.
+type reloadableRouter struct {
+	config atomic.Pointer[Config]
+	router atomic.Pointer[http.ServeMux]
+}
+
+// newReloadableRouter returns a router serving the initial configuration
+func newReloadableRouter(config Config) *reloadableRouter {
+	rr := &reloadableRouter{}
+	rr.store(config)
+	return rr
+}
+
+func (rr *reloadableRouter) store(config Config) {
+	rr.config.Store(&config)
+	rr.router.Store(newRouter(config))
+}
+
+// currentConfig returns the active configuration, for background work that outlives a reload
+func (rr *reloadableRouter) currentConfig() Config {
+	return *rr.config.Load()
+}
+
+func (rr *reloadableRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rr.router.Load().ServeHTTP(w, r)
+}
+
+// reload activates the next configuration. Settings that are only applied at startup keep their
+// running value.
+func (rr *reloadableRouter) reload(next Config) {
+	current := rr.config.Load()
+	keepStartupValue("PORT", current.Port, &next.Port)
+	keepStartupValue("REQUEST_TIMEOUT", current.RequestTimeout, &next.RequestTimeout)
+	keepStartupValue("SERVER_READ_TIMEOUT", current.ServerReadTimeout, &next.ServerReadTimeout)
+	keepStartupValue("SERVER_WRITE_TIMEOUT", current.ServerWriteTimeout, &next.ServerWriteTimeout)
+	keepStartupValue("SERVER_IDLE_TIMEOUT", current.ServerIdleTimeout, &next.ServerIdleTimeout)
+	keepStartupValue("RECENT_BUFFER_SIZE", current.RecentBufferSize, &next.RecentBufferSize)
+	keepStartupValue("MAX_CONCURRENT_REQUESTS", current.MaxConcurrentRequests, &next.MaxConcurrentRequests)
+	keepStartupValue("TAUTULLI_MAX_CONCURRENCY", current.TautulliMaxConcurrency, &next.TautulliMaxConcurrency)
+	keepStartupValue("WRITE_WORKERS", current.WriteWorkers, &next.WriteWorkers)
+	keepStartupValue("WRITE_QUEUE_SIZE", current.WriteQueueSize, &next.WriteQueueSize)
+	keepStartupValue("WRITE_QUEUE_TIMEOUT", current.WriteQueueTimeout, &next.WriteQueueTimeout)
+	keepStartupValue("ASYNC_WRITES", current.AsyncWrites, &next.AsyncWrites)
+	keepStartupValue("OUTPUT_BACKEND", current.OutputBackend, &next.OutputBackend)
+	keepStartupValue("S3_BUCKET", current.S3Bucket, &next.S3Bucket)
+	keepStartupValue("S3_PREFIX", current.S3Prefix, &next.S3Prefix)
+	keepStartupValue("S3_ENDPOINT", current.S3Endpoint, &next.S3Endpoint)
+	keepStartupValue("AWS_REGION", current.S3Region, &next.S3Region)
+	keepStartupValue("AWS_ACCESS_KEY_ID", current.S3AccessKey, &next.S3AccessKey)
+	keepStartupValue("AWS_SECRET_ACCESS_KEY", current.S3SecretKey, &next.S3SecretKey)
+	keepStartupValue("AWS_SESSION_TOKEN", current.S3SessionToken, &next.S3SessionToken)
+	keepStartupValue("DEDUP_TTL", current.DedupTTL, &next.DedupTTL)
+	keepStartupValue("DEDUP_FILE", current.DedupFile, &next.DedupFile)
+	keepStartupValue("POLL_ENABLED", current.PollEnabled, &next.PollEnabled)
+	keepStartupValue("POLL_INTERVAL", current.PollInterval, &next.PollInterval)
+	keepStartupValue("LOG_FILE", current.LogFile, &next.LogFile)
+	keepStartupValue("LOG_MAX_SIZE", current.LogMaxSize, &next.LogMaxSize)
+	keepStartupValue("LOG_STDOUT", current.LogStdoutDisabled, &next.LogStdoutDisabled)
+	rr.store(next)
+}
+
+// keepStartupValue restores a setting that changed in a reloaded configuration to its running value
+func keepStartupValue[T comparable](name string, current T, next *T) {
+	if *next != current {
+		log.Printf("Ignoring changed %s on reload, it only takes effect after a restart", name)
+		*next = current
+	}
+}
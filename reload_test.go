@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestReloadIgnoreTitleRegex(t *testing.T) {
+	outputDir := t.TempDir()
+	router := newReloadableRouter(Config{Port: 3333, OutputDir: outputDir, IgnoreTitleRegex: regexp.MustCompile(`^Sample`)})
+	body := `{
+		"NotificationType": "PlaybackStop",
+		"ItemType": "Episode",
+		"SeriesName": "Sample Series",
+		"SeasonNumber": 1,
+		"EpisodeNumber": 1,
+		"MediaStatus": {"PlayedToCompletion": true}
+	}`
+	outputPath := filepath.Join(outputDir, "Sample Series - S1E1.json")
+
+	router.ServeHTTP(httptest.NewRecorder(), newJellyfinRequest("/jellyfin", body))
+	if _, err := os.Stat(outputPath); err == nil {
+		t.Fatalf("Expected %s to be ignored before the reload", outputPath)
+	}
+
+	router.reload(Config{Port: 8080, OutputDir: outputDir, IgnoreTitleRegex: regexp.MustCompile(`^Trailer`)})
+
+	router.ServeHTTP(httptest.NewRecorder(), newJellyfinRequest("/jellyfin", body))
+	if _, err := os.Stat(outputPath); err != nil {
+		t.Errorf("Expected %s to be written after the reload: %v", outputPath, err)
+	}
+	config := router.config.Load()
+	if config.IgnoreTitleRegex.String() != `^Trailer` {
+		t.Errorf("IgnoreTitleRegex = %s, expected ^Trailer", config.IgnoreTitleRegex)
+	}
+	if config.Port != 3333 {
+		t.Errorf("Port = %d, expected the startup value 3333", config.Port)
+	}
+}
+
+func TestReadConfigInvalidRegex(t *testing.T) {
+	t.Setenv("IGNORE_TITLE_REGEX", "(unclosed")
+	if _, err := readConfig(); err == nil {
+		t.Error("readConfig() error = nil, expected an error for an invalid IGNORE_TITLE_REGEX")
+	}
+}
+
+func TestReloadConfigFile(t *testing.T) {
+	outputDir := t.TempDir()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Error writing config file: %v", err)
+		}
+	}
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("OUTPUT_DIR", outputDir)
+	t.Cleanup(func() {
+		fileConfig = nil
+	})
+
+	writeConfig("PORT: 3333\nIGNORE_TITLE_REGEX: ^Sample\n")
+	config, err := readConfig()
+	if err != nil {
+		t.Fatalf("readConfig() error = %v", err)
+	}
+	router := newReloadableRouter(config)
+
+	// An invalid file keeps the running configuration and none of its values
+	writeConfig("IGNORE_TITLE_REGEX: ^Trailer\nALLOWED_IPS: not-an-ip\n")
+	if _, err := readConfig(); err == nil {
+		t.Fatal("readConfig() error = nil, expected an error for an invalid ALLOWED_IPS")
+	}
+	if got := getEnv("IGNORE_TITLE_REGEX", ""); got != "^Sample" {
+		t.Errorf("IGNORE_TITLE_REGEX = %q after a failed reload, expected ^Sample", got)
+	}
+
+	writeConfig("PORT: 8080\nIGNORE_TITLE_REGEX: ^Trailer\n")
+	next, err := readConfig()
+	if err != nil {
+		t.Fatalf("readConfig() error = %v", err)
+	}
+	router.reload(next)
+
+	body := `{
+		"NotificationType": "PlaybackStop",
+		"ItemType": "Episode",
+		"SeriesName": "Sample Series",
+		"SeasonNumber": 1,
+		"EpisodeNumber": 1,
+		"MediaStatus": {"PlayedToCompletion": true}
+	}`
+	router.ServeHTTP(httptest.NewRecorder(), newJellyfinRequest("/jellyfin", body))
+	if _, err := os.Stat(filepath.Join(outputDir, "Sample Series - S1E1.json")); err != nil {
+		t.Errorf("Expected the reloaded IGNORE_TITLE_REGEX to apply: %v", err)
+	}
+	if current := router.currentConfig(); current.Port != 3333 {
+		t.Errorf("Port = %d, expected the startup value 3333", current.Port)
+	}
+}
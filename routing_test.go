@@ -2,10 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 )
@@ -84,9 +86,7 @@ func TestRouting(t *testing.T) {
 			contentType: "multipart/form-data; boundary=X",
 			payload: PlexWebhookPayload{
 				Event: "media.stop",
-				Metadata: struct {
-					Key string `json:"key"`
-				}{
+				Metadata: PlexMetadata{
 					Key: "/library/metadata/12345",
 				},
 			},
@@ -129,9 +129,7 @@ func TestRouting(t *testing.T) {
 			contentType: "multipart/form-data; boundary=X",
 			payload: PlexWebhookPayload{
 				Event: "media.stop",
-				Metadata: struct {
-					Key string `json:"key"`
-				}{
+				Metadata: PlexMetadata{
 					Key: "/library/metadata/12345",
 				},
 			},
@@ -221,43 +219,7 @@ func TestRouting(t *testing.T) {
 			rr := httptest.NewRecorder()
 
 			// Create the handler
-			config := loadConfig()
-			mux := http.NewServeMux()
-
-			// Set up the routes
-			mux.HandleFunc("/plex", func(w http.ResponseWriter, r *http.Request) {
-				handlePlexWebhook(w, r, config)
-			})
-
-			mux.HandleFunc("/jellyfin", func(w http.ResponseWriter, r *http.Request) {
-				handleJellyfinWebhook(w, r, config)
-			})
-
-			mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-				// If the path is exactly "/", try to detect the webhook type from the content
-				if r.URL.Path == "/" {
-					contentType := r.Header.Get("Content-Type")
-
-					// Plex webhooks are typically sent as multipart/form-data
-					if strings.Contains(contentType, "multipart/form-data") {
-						handlePlexWebhook(w, r, config)
-						return
-					}
-
-					// Jellyfin webhooks are typically sent as application/json
-					if strings.Contains(contentType, "application/json") {
-						handleJellyfinWebhook(w, r, config)
-						return
-					}
-
-					// If we can't determine the type, return an error
-					http.Error(w, "Unable to determine webhook type", http.StatusBadRequest)
-					return
-				}
-
-				// For any other path, return 404
-				http.NotFound(w, r)
-			})
+			mux := newRouter(loadConfig())
 
 			// Serve the request
 			mux.ServeHTTP(rr, req)
@@ -286,3 +248,200 @@ func TestRouting(t *testing.T) {
 		})
 	}
 }
+
+func TestRouteDetectionAcrossContentTypes(t *testing.T) {
+	tautulliServer := newTautulliServer(t, []MediaData{
+		{
+			FullTitle:        "Plex Show",
+			ParentMediaIndex: json.Number("1"),
+			MediaIndex:       json.Number("2"),
+			WatchedStatus:    1.0,
+		},
+	})
+
+	const plexPayload = `{"event": "media.stop", "Metadata": {"key": "/library/metadata/12345"}}`
+	const jellyfinPayload = `{"NotificationType": "PlaybackStop", "ItemType": "Episode", "Name": "Pilot",
+		"SeriesName": "Jellyfin Series", "SeasonNumber": 1, "EpisodeNumber": 1, "MediaStatus": {"PlayedToCompletion": true}}`
+	multipart := func(payload string) string {
+		return "--X\r\nContent-Disposition: form-data; name=\"payload\"\r\n\r\n" + payload + "\r\n--X--\r\n"
+	}
+
+	testCases := []struct {
+		name         string
+		contentType  string
+		body         string
+		expectedFile string
+	}{
+		{name: "Plex as JSON", contentType: "application/json", body: plexPayload, expectedFile: "Plex Show - S1E2.json"},
+		{name: "Jellyfin as multipart", contentType: "multipart/form-data; boundary=X", body: multipart(jellyfinPayload), expectedFile: "Jellyfin Series - S1E1.json"},
+		{name: "Plex as multipart", contentType: "multipart/form-data; boundary=X", body: multipart(plexPayload), expectedFile: "Plex Show - S1E2.json"},
+		{name: "Jellyfin as JSON", contentType: "application/json", body: jellyfinPayload, expectedFile: "Jellyfin Series - S1E1.json"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{
+				APIHost:   strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:    "test-key",
+				OutputDir: t.TempDir(),
+			}
+			req := httptest.NewRequest("POST", "/", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", tc.contentType)
+			rr := httptest.NewRecorder()
+			newRouter(config).ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Errorf("status = %d, expected %d (body %q)", rr.Code, http.StatusOK, rr.Body.String())
+			}
+			if _, err := os.Stat(filepath.Join(config.OutputDir, tc.expectedFile)); err != nil {
+				t.Errorf("expected %s to be written: %v", tc.expectedFile, err)
+			}
+		})
+	}
+}
+
+func TestDisabledHandler(t *testing.T) {
+	const plexPayload = `{"event": "media.stop", "Metadata": {"key": "/library/metadata/12345"}}`
+	const jellyfinPayload = `{"NotificationType": "PlaybackStop", "ItemType": "Episode", "Name": "Pilot",
+		"SeriesName": "Jellyfin Series", "SeasonNumber": 1, "EpisodeNumber": 1, "MediaStatus": {"PlayedToCompletion": true}}`
+
+	config := Config{OutputDir: t.TempDir(), PlexDisabled: true}
+	router := newRouter(config)
+
+	testCases := []struct {
+		name           string
+		path           string
+		body           string
+		expectedStatus int
+	}{
+		{name: "Plex endpoint", path: "/plex", body: plexPayload, expectedStatus: http.StatusNotFound},
+		{name: "Plex autodetection", path: "/", body: plexPayload, expectedStatus: http.StatusNotFound},
+		{name: "Jellyfin endpoint", path: "/jellyfin", body: jellyfinPayload, expectedStatus: http.StatusOK},
+		{name: "Jellyfin autodetection", path: "/", body: jellyfinPayload, expectedStatus: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tc.path, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("status = %d, expected %d", rr.Code, tc.expectedStatus)
+			}
+		})
+	}
+}
+
+func TestRouteDetectionChecksSenderFirst(t *testing.T) {
+	const jellyfinPayload = `{"NotificationType": "PlaybackStart"}`
+	allowedIPs, err := parseAllowedIPs("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("parseAllowedIPs returned error: %v", err)
+	}
+
+	testCases := []struct {
+		name           string
+		config         Config
+		body           string
+		setAuth        bool
+		expectedStatus int
+	}{
+		{name: "Allowed", config: Config{}, body: jellyfinPayload, expectedStatus: http.StatusOK},
+		{name: "Blocked IP", config: Config{AllowedIPs: allowedIPs}, body: jellyfinPayload, expectedStatus: http.StatusForbidden},
+		{name: "Missing credentials", config: Config{WebhookBasicUser: "plex", WebhookBasicPass: "secret"}, body: jellyfinPayload, expectedStatus: http.StatusUnauthorized},
+		{name: "Valid credentials", config: Config{WebhookBasicUser: "plex", WebhookBasicPass: "secret"}, body: jellyfinPayload, setAuth: true, expectedStatus: http.StatusOK},
+		{name: "Body too large", config: Config{MaxBodyBytes: 64}, body: `{"NotificationType": "PlaybackStart", "Padding": "` + strings.Repeat("x", 100) + `"}`, expectedStatus: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := tc.config
+			config.OutputDir = t.TempDir()
+			body := &countingReader{Reader: strings.NewReader(tc.body)}
+			req := httptest.NewRequest("POST", "/", body)
+			req.RemoteAddr = "172.16.0.1:5000"
+			req.Header.Set("Content-Type", "application/json")
+			if tc.setAuth {
+				req.SetBasicAuth("plex", "secret")
+			}
+			rr := httptest.NewRecorder()
+			newRouter(config).ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("status = %d, expected %d", rr.Code, tc.expectedStatus)
+			}
+			if (tc.expectedStatus == http.StatusForbidden || tc.expectedStatus == http.StatusUnauthorized) && body.read > 0 {
+				t.Errorf("read %d bytes of a rejected request, expected none", body.read)
+			}
+		})
+	}
+}
+
+// countingReader counts the bytes read from the wrapped reader
+type countingReader struct {
+	io.Reader
+	read int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.read += n
+	return n, err
+}
+
+func TestRootStatus(t *testing.T) {
+	router := newRouter(Config{OutputDir: t.TempDir()})
+
+	testCases := []struct {
+		name           string
+		method         string
+		body           string
+		expectedStatus int
+	}{
+		{name: "GET health check", method: "GET", expectedStatus: http.StatusOK},
+		{name: "HEAD health check", method: "HEAD", expectedStatus: http.StatusOK},
+		{name: "Unclassifiable POST", method: "POST", body: "hello=world", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("status = %d, expected %d", rr.Code, tc.expectedStatus)
+			}
+			if tc.method == "GET" {
+				var status StatusResponse
+				if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil || status.Status != "ok" {
+					t.Errorf("body = %q, expected an ok status", rr.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestEnabledWebhooks(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   Config
+		expected []string
+	}{
+		{name: "Default", config: Config{}, expected: []string{"Plex", "Jellyfin"}},
+		{name: "Plex disabled", config: Config{PlexDisabled: true}, expected: []string{"Jellyfin"}},
+		{name: "Jellyseerr enabled", config: Config{JellyseerrEnabled: true}, expected: []string{"Plex", "Jellyfin", "Jellyseerr"}},
+		{name: "None", config: Config{PlexDisabled: true, JellyfinDisabled: true}, expected: nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.config.enabledWebhooks(); !slices.Equal(got, tc.expected) {
+				t.Errorf("enabledWebhooks() = %v, expected %v", got, tc.expected)
+			}
+		})
+	}
+}
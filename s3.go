@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values for Config.OutputBackend
+const (
+	OutputBackendFile = "file"
+	OutputBackendS3   = "s3"
+)
+
+// s3Writer uploads each record as a JSON object to an S3-compatible bucket using a signed PUT
+type s3Writer struct {
+	mu     sync.RWMutex
+	closed bool
+
+	client       *http.Client
+	endpoint     string
+	bucket       string
+	prefix       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	// root is the local output directory, paths below it keep their relative layout in the bucket
+	root string
+	// dirs maps the other configured output directories to the key prefix they are uploaded under,
+	// so records outside root don't collide with each other
+	dirs map[string]string
+}
+
+// newS3Writer creates an s3Writer from the configuration
+func newS3Writer(config Config) (*s3Writer, error) {
+	if config.S3Bucket == "" {
+		return nil, fmt.Errorf("S3_BUCKET is required for the s3 output backend")
+	}
+	endpoint := config.S3Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + config.S3Region + ".amazonaws.com"
+	}
+	return &s3Writer{
+		client:       &http.Client{Timeout: 30 * time.Second},
+		endpoint:     strings.TrimSuffix(endpoint, "/"),
+		bucket:       config.S3Bucket,
+		prefix:       strings.Trim(config.S3Prefix, "/"),
+		region:       config.S3Region,
+		accessKey:    config.S3AccessKey,
+		secretKey:    config.S3SecretKey,
+		sessionToken: config.S3SessionToken,
+		root:         config.OutputDir,
+		dirs: map[string]string{
+			config.plexOutputDir():     "plex",
+			config.jellyfinOutputDir(): "jellyfin",
+			config.musicOutputDir():    "music",
+			config.newMediaDir():       "new",
+			config.PartialDir:          "partial",
+		},
+	}, nil
+}
+
+// Write uploads the media data as JSON to the object key derived from path
+func (s *s3Writer) Write(data MediaData, p string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return errWriterClosed
+	}
+
+	jsonData, err := encodeMediaData(data, p)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, s.endpoint+"/"+awsURIEncode(s.bucket+"/"+s.objectKey(p)), bytes.NewReader(jsonData))
+	if err != nil {
+		return fmt.Errorf("error creating S3 request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if strings.HasSuffix(p, gzipExtension) {
+		req.Header.Set("Content-Type", "application/gzip")
+	}
+	s.sign(req, jsonData)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error uploading to S3: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("S3 upload returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// Exists reports whether the object derived from path exists, using a HEAD request
+func (s *s3Writer) Exists(p string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return false, errWriterClosed
+	}
+
+	req, err := http.NewRequest(http.MethodHead, s.endpoint+"/"+awsURIEncode(s.bucket+"/"+s.objectKey(p)), nil)
+	if err != nil {
+		return false, fmt.Errorf("error creating S3 request: %w", err)
+	}
+	s.sign(req, nil)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("error checking S3 object: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("S3 HEAD returned status %d", resp.StatusCode)
+	}
+}
+
+// Remove deletes the object derived from path
+func (s *s3Writer) Remove(p string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return errWriterClosed
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, s.endpoint+"/"+awsURIEncode(s.bucket+"/"+s.objectKey(p)), nil)
+	if err != nil {
+		return fmt.Errorf("error creating S3 request: %w", err)
+	}
+	s.sign(req, nil)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error deleting from S3: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("S3 delete returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// Close waits for in-progress uploads to finish and rejects any further writes
+func (s *s3Writer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+// objectKey maps a local output path to its key below the configured prefix. Paths below the output
+// directory keep their relative layout, paths below another configured directory are placed under
+// its own prefix, e.g. "partial/", and any other path keeps its full layout.
+func (s *s3Writer) objectKey(p string) string {
+	if rel, ok := relativePath(s.root, p); ok {
+		return path.Join(s.prefix, filepath.ToSlash(rel))
+	}
+	var key string
+	var longest int
+	for dir, dirPrefix := range s.dirs {
+		if rel, ok := relativePath(dir, p); ok && dir != "" && len(dir) > longest {
+			key, longest = path.Join(dirPrefix, filepath.ToSlash(rel)), len(dir)
+		}
+	}
+	if key == "" {
+		key = filepath.ToSlash(strings.TrimPrefix(filepath.Clean(p), string(filepath.Separator)))
+	}
+	return path.Join(s.prefix, key)
+}
+
+// relativePath returns p relative to dir if p is below dir
+func relativePath(dir, p string) (string, bool) {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req
+func (s *s3Writer) sign(req *http.Request, body []byte) {
+	timestamp := now().UTC()
+	amzDate := timestamp.Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+// awsURIEncode percent-encodes everything but unreserved characters and slashes, as S3 expects
+func awsURIEncode(value string) string {
+	var b strings.Builder
+	for _, c := range []byte(value) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
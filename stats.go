@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// startTime is when the process started, used to report uptime
+var startTime = now()
+
+// stats holds the runtime counters exposed at /stats
+var stats struct {
+	PlexEvents       atomic.Int64
+	JellyfinEvents   atomic.Int64
+	JellyseerrEvents atomic.Int64
+	FilesWritten     atomic.Int64
+	ItemsIgnored     atomic.Int64
+	TautulliErrors   atomic.Int64
+}
+
+// Reasons an item is ignored, used as the reason label of events_ignored_total
+const (
+	IgnoreReasonEventType       = "event_type"
+	IgnoreReasonNoMetadata      = "no_metadata"
+	IgnoreReasonEmptyData       = "empty_data"
+	IgnoreReasonNotCompleted    = "not_completed"
+	IgnoreReasonBelowMinPercent = "below_min_percent"
+	IgnoreReasonDuplicate       = "duplicate"
+	IgnoreReasonZeroIndex       = "zero_index"
+	IgnoreReasonNoEpisodeInfo   = "no_episode_info"
+	IgnoreReasonUnsupportedType = "unsupported_item_type"
+	IgnoreReasonTitle           = "ignored_title"
+	IgnoreReasonMediaType       = "media_type"
+	IgnoreReasonEpisodeSpan     = "episode_span"
+)
+
+// ignored counts the ignored items per reason
+var ignored = struct {
+	sync.Mutex
+	reasons map[string]int64
+}{reasons: make(map[string]int64)}
+
+// countIgnored records an ignored item in the total and in its reason's counter
+func countIgnored(reason string) {
+	stats.ItemsIgnored.Add(1)
+	ignored.Lock()
+	ignored.reasons[reason]++
+	ignored.Unlock()
+}
+
+// ignoredReasons returns a snapshot of the ignored items per reason
+func ignoredReasons() map[string]int64 {
+	ignored.Lock()
+	defer ignored.Unlock()
+	return maps.Clone(ignored.reasons)
+}
+
+// StatsResponse is the JSON body returned by the /stats endpoint
+type StatsResponse struct {
+	UptimeSeconds  int64            `json:"uptime_seconds"`
+	EventsReceived map[string]int64 `json:"events_received"`
+	FilesWritten   int64            `json:"files_written"`
+	ItemsIgnored   int64            `json:"items_ignored"`
+	TautulliErrors int64            `json:"tautulli_errors"`
+}
+
+// handleStats serves the runtime counters collected since startup
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := StatsResponse{
+		UptimeSeconds: int64(now().Sub(startTime).Seconds()),
+		EventsReceived: map[string]int64{
+			"plex":       stats.PlexEvents.Load(),
+			"jellyfin":   stats.JellyfinEvents.Load(),
+			"jellyseerr": stats.JellyseerrEvents.Load(),
+		},
+		FilesWritten:   stats.FilesWritten.Load(),
+		ItemsIgnored:   stats.ItemsIgnored.Load(),
+		TautulliErrors: stats.TautulliErrors.Load(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// handleMetrics serves the runtime counters in the Prometheus/OpenMetrics text format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("# TYPE events_received_total counter\n")
+	fmt.Fprintf(&b, "events_received_total{source=%q} %d\n", SourcePlex, stats.PlexEvents.Load())
+	fmt.Fprintf(&b, "events_received_total{source=%q} %d\n", SourceJellyfin, stats.JellyfinEvents.Load())
+	fmt.Fprintf(&b, "events_received_total{source=%q} %d\n", SourceJellyseerr, stats.JellyseerrEvents.Load())
+	b.WriteString("# TYPE events_ignored_total counter\n")
+	reasons := ignoredReasons()
+	for _, reason := range slices.Sorted(maps.Keys(reasons)) {
+		fmt.Fprintf(&b, "events_ignored_total{reason=%q} %d\n", reason, reasons[reason])
+	}
+	b.WriteString("# TYPE files_written_total counter\n")
+	fmt.Fprintf(&b, "files_written_total %d\n", stats.FilesWritten.Load())
+	b.WriteString("# TYPE tautulli_errors_total counter\n")
+	fmt.Fprintf(&b, "tautulli_errors_total %d\n", stats.TautulliErrors.Load())
+	b.WriteString("# EOF\n")
+
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	if _, err := w.Write([]byte(b.String())); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
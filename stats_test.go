@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getStats calls the /stats handler and decodes its response
+func getStats(t *testing.T) StatsResponse {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	handleStats(rr, httptest.NewRequest("GET", "/stats", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var response StatsResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("Error decoding stats response: %v", err)
+	}
+	return response
+}
+
+func TestStatsEndpoint(t *testing.T) {
+	config := Config{OutputDir: t.TempDir()}
+	before := getStats(t)
+
+	// A Jellyfin episode played to completion is written
+	rr := httptest.NewRecorder()
+	handleJellyfinWebhook(rr, newJellyfinRequest("/jellyfin", `{
+		"NotificationType": "PlaybackStop",
+		"ItemType": "Episode",
+		"Name": "Test Episode",
+		"SeriesName": "Test Series",
+		"SeasonNumber": 1,
+		"EpisodeNumber": 2,
+		"MediaStatus": {"PlayedToCompletion": true}
+	}`), config)
+
+	// A Plex play event is ignored
+	rr = httptest.NewRecorder()
+	handlePlexWebhook(rr, newPlexRequest(t, "/plex", PlexWebhookPayload{Event: "media.play"}), config)
+
+	after := getStats(t)
+
+	if got := after.EventsReceived["jellyfin"] - before.EventsReceived["jellyfin"]; got != 1 {
+		t.Errorf("jellyfin events received increased by %d, expected 1", got)
+	}
+	if got := after.EventsReceived["plex"] - before.EventsReceived["plex"]; got != 1 {
+		t.Errorf("plex events received increased by %d, expected 1", got)
+	}
+	if got := after.FilesWritten - before.FilesWritten; got != 1 {
+		t.Errorf("files written increased by %d, expected 1", got)
+	}
+	if got := after.ItemsIgnored - before.ItemsIgnored; got != 1 {
+		t.Errorf("items ignored increased by %d, expected 1", got)
+	}
+	if got := after.TautulliErrors - before.TautulliErrors; got != 0 {
+		t.Errorf("tautulli errors increased by %d, expected 0", got)
+	}
+	if after.UptimeSeconds < 0 {
+		t.Errorf("uptime = %d, expected a non-negative value", after.UptimeSeconds)
+	}
+}
+
+func TestStatsUptimeUsesClock(t *testing.T) {
+	setNow(t, startTime.Add(90*time.Second))
+
+	if uptime := getStats(t).UptimeSeconds; uptime != 90 {
+		t.Errorf("uptime = %d, expected 90", uptime)
+	}
+}
+
+func TestIgnoredReasons(t *testing.T) {
+	config := Config{OutputDir: t.TempDir()}
+
+	testCases := []struct {
+		name     string
+		send     func(rr *httptest.ResponseRecorder)
+		expected string
+	}{
+		{
+			name: "Plex event not subscribed",
+			send: func(rr *httptest.ResponseRecorder) {
+				handlePlexWebhook(rr, newPlexRequest(t, "/plex", PlexWebhookPayload{Event: "media.play"}), config)
+			},
+			expected: IgnoreReasonEventType,
+		},
+		{
+			name: "Plex event without metadata",
+			send: func(rr *httptest.ResponseRecorder) {
+				handlePlexWebhook(rr, newPlexRequest(t, "/plex", PlexWebhookPayload{Event: "media.stop"}), config)
+			},
+			expected: IgnoreReasonNoMetadata,
+		},
+		{
+			name: "Jellyfin playback not completed",
+			send: func(rr *httptest.ResponseRecorder) {
+				handleJellyfinWebhook(rr, newJellyfinRequest("/jellyfin", `{
+					"NotificationType": "PlaybackStop",
+					"ItemType": "Episode",
+					"SeriesName": "Test Series",
+					"MediaStatus": {"PlayedToCompletion": false}
+				}`), config)
+			},
+			expected: IgnoreReasonNotCompleted,
+		},
+		{
+			name: "Jellyfin unsupported item type",
+			send: func(rr *httptest.ResponseRecorder) {
+				handleJellyfinWebhook(rr, newJellyfinRequest("/jellyfin", `{
+					"NotificationType": "PlaybackStop",
+					"ItemType": "Trailer",
+					"MediaStatus": {"PlayedToCompletion": true}
+				}`), config)
+			},
+			expected: IgnoreReasonUnsupportedType,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			before := ignoredReasons()
+			tc.send(httptest.NewRecorder())
+			after := ignoredReasons()
+
+			for reason, count := range after {
+				expected := int64(0)
+				if reason == tc.expected {
+					expected = 1
+				}
+				if got := count - before[reason]; got != expected {
+					t.Errorf("events_ignored_total{reason=%q} increased by %d, expected %d", reason, got, expected)
+				}
+			}
+			if _, ok := after[tc.expected]; !ok {
+				t.Errorf("events_ignored_total{reason=%q} missing", tc.expected)
+			}
+		})
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	countIgnored(IgnoreReasonDuplicate)
+
+	rr := httptest.NewRecorder()
+	handleMetrics(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	body := rr.Body.String()
+	for _, expected := range []string{
+		"# TYPE events_ignored_total counter\n",
+		`events_ignored_total{reason="duplicate"} `,
+		`events_received_total{source="plex"} `,
+		"# EOF\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("metrics = %q, expected it to contain %q", body, expected)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultTMDBURL is the base URL of the TMDB API
+const defaultTMDBURL = "https://api.themoviedb.org/3"
+
+// tmdbMovie is the part of a TMDB movie search result that is used
+type tmdbMovie struct {
+	ID          int    `json:"id"`
+	Title       string `json:"title"`
+	ReleaseDate string `json:"release_date"`
+}
+
+// year returns the release year of the movie, 0 when unknown
+func (m tmdbMovie) year() int {
+	year, _ := strconv.Atoi(strings.SplitN(m.ReleaseDate, "-", 2)[0])
+	return year
+}
+
+// tmdbCache remembers search results, including misses, by title and year
+var tmdbCache = struct {
+	sync.Mutex
+	movies map[string]*tmdbMovie
+}{movies: make(map[string]*tmdbMovie)}
+
+// enrichMovie fills in the TMDB ID and year of a movie that lacks either, using the provider IDs
+// and a TMDB search by title. It is best-effort: failed lookups are logged and leave data as is.
+// Episodes and music are left alone.
+func enrichMovie(ctx context.Context, config Config, data *MediaData) {
+	logger := requestLogger(ctx)
+
+	if config.TMDBAPIKey == "" || data.MediaType != "movie" {
+		return
+	}
+	if data.TMDBID == 0 {
+		if id, err := strconv.Atoi(data.ProviderIDs["tmdb"]); err == nil {
+			data.TMDBID = FlexibleInt(id)
+		}
+	}
+	if data.TMDBID != 0 && data.Year != 0 {
+		return
+	}
+
+	title := data.Title
+	if title == "" {
+		title = data.FullTitle
+	}
+	if title == "" {
+		return
+	}
+	movie, err := searchTMDBMovie(config, title, int(data.Year))
+	if err != nil {
+		logger.Printf("Error looking up %q on TMDB: %v", title, err)
+		return
+	}
+	if movie == nil {
+		if config.Debug {
+			logger.Printf("No TMDB match for %q", title)
+		}
+		return
+	}
+	if data.TMDBID == 0 {
+		data.TMDBID = FlexibleInt(movie.ID)
+	}
+	if data.Year == 0 {
+		data.Year = FlexibleInt(movie.year())
+	}
+}
+
+// searchTMDBMovie returns the first TMDB search result for the title, narrowed to the year when
+// known, or nil if there is none
+func searchTMDBMovie(config Config, title string, year int) (*tmdbMovie, error) {
+	cacheKey := fmt.Sprintf("%s|%d", strings.ToLower(title), year)
+	tmdbCache.Lock()
+	movie, ok := tmdbCache.movies[cacheKey]
+	tmdbCache.Unlock()
+	if ok {
+		return movie, nil
+	}
+
+	params := url.Values{}
+	params.Set("api_key", config.TMDBAPIKey)
+	params.Set("query", title)
+	if year != 0 {
+		params.Set("year", strconv.Itoa(year))
+	}
+	baseURL := config.TMDBURL
+	if baseURL == "" {
+		baseURL = defaultTMDBURL
+	}
+	client := &http.Client{Timeout: config.TMDBTimeout}
+	resp, err := client.Get(strings.TrimSuffix(baseURL, "/") + "/search/movie?" + params.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("error making HTTP request: %w", err)
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			log.Printf("Error closing response body: %v", closeErr)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received non-200 response: %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	var result struct {
+		Results []tmdbMovie `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error unmarshaling response: %w", err)
+	}
+	if len(result.Results) > 0 {
+		movie = &result.Results[0]
+	}
+
+	tmdbCache.Lock()
+	tmdbCache.movies[cacheKey] = movie
+	tmdbCache.Unlock()
+	return movie, nil
+}
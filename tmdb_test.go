@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTMDBEnrichment(t *testing.T) {
+	var searches atomic.Int32
+	tmdbServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		searches.Add(1)
+		if r.URL.Path != "/search/movie" || r.URL.Query().Get("api_key") != "tmdb-key" {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Query().Get("query") {
+		case "Inception":
+			fmt.Fprint(w, `{"results": [{"id": 27205, "title": "Inception", "release_date": "2010-07-15"}]}`)
+		default:
+			fmt.Fprint(w, `{"results": []}`)
+		}
+	}))
+	defer tmdbServer.Close()
+
+	testCases := []struct {
+		name           string
+		title          string
+		body           string
+		expectedID     int
+		expectedYear   int
+		expectedSearch bool
+	}{
+		{
+			name:           "Movie without year or ID",
+			title:          "Inception",
+			body:           `{"NotificationType": "PlaybackStop", "ItemType": "Movie", "Name": "Inception", "MediaStatus": {"PlayedToCompletion": true}}`,
+			expectedID:     27205,
+			expectedYear:   2010,
+			expectedSearch: true,
+		},
+		{
+			name:           "Movie with year and provider ID",
+			title:          "Arrival",
+			body:           `{"NotificationType": "PlaybackStop", "ItemType": "Movie", "Name": "Arrival", "Year": 2016, "Provider_tmdb": "329865", "MediaStatus": {"PlayedToCompletion": true}}`,
+			expectedID:     329865,
+			expectedYear:   2016,
+			expectedSearch: false,
+		},
+		{
+			name:           "No match",
+			title:          "Unknown Film",
+			body:           `{"NotificationType": "PlaybackStop", "ItemType": "Movie", "Name": "Unknown Film", "MediaStatus": {"PlayedToCompletion": true}}`,
+			expectedSearch: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			searches.Store(0)
+			config := Config{OutputDir: t.TempDir(), TMDBAPIKey: "tmdb-key", TMDBURL: tmdbServer.URL, TMDBTimeout: time.Second}
+			handleJellyfinWebhook(httptest.NewRecorder(), newJellyfinRequest("/jellyfin", tc.body), config)
+
+			fileContent, err := os.ReadFile(filepath.Join(config.OutputDir, tc.title+".json"))
+			if err != nil {
+				t.Fatalf("Error reading file: %v", err)
+			}
+			var fileData MediaData
+			if err := json.Unmarshal(fileContent, &fileData); err != nil {
+				t.Fatalf("Error unmarshaling file content: %v", err)
+			}
+			if int(fileData.TMDBID) != tc.expectedID {
+				t.Errorf("tmdb_id = %d, expected %d", fileData.TMDBID, tc.expectedID)
+			}
+			if int(fileData.Year) != tc.expectedYear {
+				t.Errorf("year = %d, expected %d", fileData.Year, tc.expectedYear)
+			}
+			if searched := searches.Load() > 0; searched != tc.expectedSearch {
+				t.Errorf("searched TMDB = %v, expected %v", searched, tc.expectedSearch)
+			}
+		})
+	}
+}
+
+func TestTMDBCache(t *testing.T) {
+	var searches atomic.Int32
+	tmdbServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		searches.Add(1)
+		fmt.Fprint(w, `{"results": [{"id": 603, "title": "The Matrix", "release_date": "1999-03-30"}]}`)
+	}))
+	defer tmdbServer.Close()
+
+	config := Config{TMDBAPIKey: "tmdb-key", TMDBURL: tmdbServer.URL, TMDBTimeout: time.Second}
+	for range 3 {
+		data := MediaData{MediaType: "movie", FullTitle: "The Matrix Cached"}
+		enrichMovie(t.Context(), config, &data)
+		if data.TMDBID != 603 {
+			t.Errorf("tmdb_id = %d, expected 603", data.TMDBID)
+		}
+	}
+	if searches.Load() != 1 {
+		t.Errorf("searches = %d, expected 1", searches.Load())
+	}
+}
+
+func TestTMDBTimeout(t *testing.T) {
+	tmdbServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer tmdbServer.Close()
+
+	config := Config{TMDBAPIKey: "tmdb-key", TMDBURL: tmdbServer.URL, TMDBTimeout: 10 * time.Millisecond}
+	data := MediaData{MediaType: "movie", FullTitle: "Slow Movie"}
+	enrichMovie(t.Context(), config, &data)
+	if data.TMDBID != 0 || data.Year != 0 {
+		t.Errorf("data = %+v, expected no enrichment after a timeout", data)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// ValidationSummary is the response to a webhook in VALIDATE_ONLY mode, describing how the payload
+// was decoded and whether it would be processed
+type ValidationSummary struct {
+	Source       string `json:"source"`
+	Event        string `json:"event"`
+	EventEnabled bool   `json:"event_enabled"`
+	// Key is the Plex metadata key that would be looked up in Tautulli
+	Key        string   `json:"key,omitempty"`
+	ItemType   string   `json:"item_type,omitempty"`
+	Title      string   `json:"title,omitempty"`
+	SeriesName string   `json:"series_name,omitempty"`
+	Season     int      `json:"season,omitempty"`
+	Episode    int      `json:"episode,omitempty"`
+	User       string   `json:"user,omitempty"`
+	Problems   []string `json:"problems,omitempty"`
+}
+
+// validatePlexPayload summarizes a decoded Plex payload without contacting Tautulli
+func validatePlexPayload(payload PlexWebhookPayload, config Config) ValidationSummary {
+	summary := ValidationSummary{
+		Source:       SourcePlex,
+		Event:        payload.Event,
+		EventEnabled: config.plexEventEnabled(payload.Event),
+		Key:          payload.Metadata.Key,
+		User:         payload.Account.Title,
+	}
+	if payload.Event == "" {
+		summary.Problems = append(summary.Problems, "missing event")
+	}
+	if payload.Metadata.Key == "" {
+		summary.Problems = append(summary.Problems, "missing Metadata.key")
+	}
+	return summary
+}
+
+// validateJellyfinPayload summarizes a decoded Jellyfin payload without writing anything
+func validateJellyfinPayload(payload JellyfinWebhookPayload, config Config) ValidationSummary {
+	event := config.jellyfinEvent(payload)
+	summary := ValidationSummary{
+		Source:       SourceJellyfin,
+		Event:        event,
+		EventEnabled: config.jellyfinEventEnabled(event),
+		ItemType:     payload.ItemType,
+		Title:        payload.Title,
+		SeriesName:   payload.SeriesName,
+		Season:       int(payload.SeasonNumber),
+		Episode:      int(payload.EpisodeNumber),
+		User:         payload.User,
+	}
+	if event == "" {
+		summary.Problems = append(summary.Problems, "missing NotificationType")
+	}
+	switch payload.ItemType {
+	case "Episode":
+		if payload.SeriesName == "" && (payload.SeriesID == "" || (config.JellyfinURL == "" && config.JellyfinSeriesPlaceholder == "")) {
+			summary.Problems = append(summary.Problems, "missing SeriesName")
+		}
+		if !payload.episodeSpanValid() {
+			summary.Problems = append(summary.Problems, fmt.Sprintf("IndexNumberEnd spans more than %d episodes", maxJellyfinEpisodeSpan))
+		}
+	case "Movie":
+		if payload.Title == "" {
+			summary.Problems = append(summary.Problems, "missing Name")
+		}
+	case "":
+		summary.Problems = append(summary.Problems, "missing ItemType")
+	default:
+		summary.Problems = append(summary.Problems, "unsupported ItemType "+payload.ItemType)
+	}
+	return summary
+}
+
+// validateJellyseerrPayload summarizes a decoded Jellyseerr payload with the given title without
+// writing anything
+func validateJellyseerrPayload(payload JellyseerrWebhookPayload, title string, config Config) ValidationSummary {
+	summary := ValidationSummary{
+		Source:       SourceJellyseerr,
+		Event:        payload.NotificationType,
+		EventEnabled: config.jellyseerrEventEnabled(payload.NotificationType),
+		ItemType:     payload.Media.MediaType,
+		Title:        title,
+	}
+	if payload.NotificationType == "" {
+		summary.Problems = append(summary.Problems, "missing notification_type")
+	}
+	if title == "" {
+		summary.Problems = append(summary.Problems, "missing subject")
+	}
+	switch payload.Media.MediaType {
+	case "movie":
+	case "tv":
+		season, seasonErr := strconv.Atoi(payload.extra("Season"))
+		episode, episodeErr := strconv.Atoi(payload.extra("Episode"))
+		if seasonErr != nil || episodeErr != nil {
+			summary.Problems = append(summary.Problems, "missing Season and Episode extra fields")
+		}
+		summary.Season, summary.Episode = season, episode
+	case "":
+		summary.Problems = append(summary.Problems, "missing media_type")
+	default:
+		summary.Problems = append(summary.Problems, "unsupported media_type "+payload.Media.MediaType)
+	}
+	return summary
+}
+
+// respondValidation writes a VALIDATE_ONLY response, a single summary or a list for batches
+func respondValidation(w http.ResponseWriter, summary any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
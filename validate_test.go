@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateOnly(t *testing.T) {
+	tautulliServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected Tautulli request in VALIDATE_ONLY mode: %s", r.URL)
+	}))
+	defer tautulliServer.Close()
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected forwarded webhook in VALIDATE_ONLY mode: %s", r.URL)
+	}))
+	defer downstream.Close()
+
+	testCases := []struct {
+		name     string
+		request  func(t *testing.T) *http.Request
+		handler  func(http.ResponseWriter, *http.Request, Config)
+		expected ValidationSummary
+	}{
+		{
+			name: "Plex",
+			request: func(t *testing.T) *http.Request {
+				return newPlexRequest(t, "/plex", PlexWebhookPayload{
+					Event:    "media.stop",
+					Account:  PlexAccount{ID: 1, Title: "alice"},
+					Metadata: PlexMetadata{Key: "/library/metadata/12345"},
+				})
+			},
+			handler: handlePlexWebhook,
+			expected: ValidationSummary{
+				Source: SourcePlex, Event: "media.stop", EventEnabled: true,
+				Key: "/library/metadata/12345", User: "alice",
+			},
+		},
+		{
+			name: "Jellyfin",
+			request: func(t *testing.T) *http.Request {
+				return newJellyfinRequest("/jellyfin", `{
+					"NotificationType": "PlaybackStop",
+					"ItemType": "Episode",
+					"Name": "Pilot",
+					"SeriesName": "Test Series",
+					"SeasonNumber": 1,
+					"EpisodeNumber": 2,
+					"MediaStatus": {"PlayedToCompletion": true}
+				}`)
+			},
+			handler: handleJellyfinWebhook,
+			expected: ValidationSummary{
+				Source: SourceJellyfin, Event: JellyfinEventPlaybackStop, EventEnabled: true,
+				ItemType: "Episode", Title: "Pilot", SeriesName: "Test Series", Season: 1, Episode: 2,
+			},
+		},
+		{
+			name: "Jellyfin missing series",
+			request: func(t *testing.T) *http.Request {
+				return newJellyfinRequest("/jellyfin", `{"NotificationType": "ItemAdded", "ItemType": "Episode"}`)
+			},
+			handler: handleJellyfinWebhook,
+			expected: ValidationSummary{
+				Source: SourceJellyfin, Event: "ItemAdded", ItemType: "Episode",
+				Problems: []string{"missing SeriesName"},
+			},
+		},
+		{
+			name: "Jellyseerr",
+			request: func(t *testing.T) *http.Request {
+				return newJellyfinRequest("/jellyseerr", `{
+					"notification_type": "MEDIA_AVAILABLE",
+					"subject": "Test Series (2008)",
+					"media": {"media_type": "tv", "tvdbId": "81189"},
+					"extra": [{"name": "Season", "value": "2"}, {"name": "Episode", "value": "5"}]
+				}`)
+			},
+			handler: handleJellyseerrWebhook,
+			expected: ValidationSummary{
+				Source: SourceJellyseerr, Event: JellyseerrEventMediaAvailable,
+				ItemType: "tv", Title: "Test Series", Season: 2, Episode: 5,
+			},
+		},
+		{
+			name: "Jellyseerr missing episode",
+			request: func(t *testing.T) *http.Request {
+				return newJellyfinRequest("/jellyseerr", `{"notification_type": "MEDIA_AVAILABLE", "subject": "Test Series", "media": {"media_type": "tv"}}`)
+			},
+			handler: handleJellyseerrWebhook,
+			expected: ValidationSummary{
+				Source: SourceJellyseerr, Event: JellyseerrEventMediaAvailable,
+				ItemType: "tv", Title: "Test Series",
+				Problems: []string{"missing Season and Episode extra fields"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := Config{
+				APIHost:      strings.TrimPrefix(tautulliServer.URL, "http://"),
+				APIKey:       "test-key",
+				OutputDir:    t.TempDir(),
+				AuditDir:     t.TempDir(),
+				ForwardURL:   downstream.URL,
+				ValidateOnly: true,
+			}
+			rr := httptest.NewRecorder()
+			tc.handler(rr, tc.request(t), config)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("status = %d, expected %d", rr.Code, http.StatusOK)
+			}
+			var summary ValidationSummary
+			if err := json.Unmarshal(rr.Body.Bytes(), &summary); err != nil {
+				t.Fatalf("Error decoding summary: %v, body: %s", err, rr.Body)
+			}
+			if !reflect.DeepEqual(summary, tc.expected) {
+				t.Errorf("summary = %+v, expected %+v", summary, tc.expected)
+			}
+
+			entries, err := os.ReadDir(config.OutputDir)
+			if err != nil {
+				t.Fatalf("Error reading output dir: %v", err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("files = %d, expected none in VALIDATE_ONLY mode", len(entries))
+			}
+			audits, err := os.ReadDir(config.AuditDir)
+			if err != nil {
+				t.Fatalf("Error reading audit dir: %v", err)
+			}
+			if len(audits) != 0 {
+				t.Errorf("audit files = %d, expected none in VALIDATE_ONLY mode", len(audits))
+			}
+		})
+	}
+}
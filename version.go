@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Build information, injected at build time via -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// VersionResponse is the JSON body returned by the /version endpoint
+type VersionResponse struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+// handleVersion serves the build information of the running binary
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := VersionResponse{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// StatusResponse is the JSON body returned for a GET on "/"
+type StatusResponse struct {
+	Status  string `json:"status"`
+	Version string `json:"version"`
+}
+
+// handleStatus reports that the server is up, for health checkers that probe "/"
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(StatusResponse{Status: "ok", Version: version}); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
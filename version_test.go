@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVersionEndpoint(t *testing.T) {
+	rr := httptest.NewRecorder()
+	handleVersion(rr, httptest.NewRequest("GET", "/version", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type = %q, expected application/json", contentType)
+	}
+
+	var response VersionResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("Error decoding version response: %v", err)
+	}
+	if response.Version != "dev" {
+		t.Errorf("response.Version = %q, expected dev", response.Version)
+	}
+	if response.Commit != "unknown" {
+		t.Errorf("response.Commit = %q, expected unknown", response.Commit)
+	}
+	if response.BuildDate != "unknown" {
+		t.Errorf("response.BuildDate = %q, expected unknown", response.BuildDate)
+	}
+}
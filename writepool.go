@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errWriteQueueFull is returned when a write could not be queued within the queue timeout
+var errWriteQueueFull = errors.New("write queue is full")
+
+// errWritePoolClosed is returned for writes arriving after the pool was closed on shutdown
+var errWritePoolClosed = errors.New("write pool is closed")
+
+// writeResult is the outcome of a queued write
+type writeResult struct {
+	path string
+	err  error
+}
+
+// writeJob is a writeMediaData call queued for a worker
+type writeJob struct {
+	// ctx carries the request logger, it is not cancelled with the request
+	ctx      context.Context
+	config   Config
+	dir      string
+	filename string
+	data     MediaData
+	// done receives the result, nil when the caller does not wait for it
+	done chan writeResult
+}
+
+// writePool runs writes on a fixed number of worker goroutines fed by a bounded queue
+type writePool struct {
+	jobs         chan writeJob
+	queueTimeout time.Duration
+	wg           sync.WaitGroup
+	// mu guards closed; enqueue holds the read lock while sending so that Close cannot close jobs
+	// under a sender
+	mu     sync.RWMutex
+	closed bool
+}
+
+// writes is the active write pool, nil writes inline in the handler goroutine
+var writes *writePool
+
+// newWritePool starts workers goroutines taking jobs from a queue of queueSize. Callers wait up to
+// queueTimeout for room in the queue before the write fails.
+func newWritePool(workers, queueSize int, queueTimeout time.Duration) *writePool {
+	p := &writePool{jobs: make(chan writeJob, queueSize), queueTimeout: queueTimeout}
+	p.wg.Add(workers)
+	for range workers {
+		go p.work()
+	}
+	return p
+}
+
+func (p *writePool) work() {
+	defer p.wg.Done()
+	for job := range p.jobs {
+		path, err := writeMediaDataNow(job.ctx, job.config, job.dir, job.filename, job.data)
+		if job.done != nil {
+			job.done <- writeResult{path: path, err: err}
+			continue
+		}
+		// Nobody waits for an asynchronous write, so its outcome is only logged
+		if err != nil {
+			requestLogger(job.ctx).Printf("Error writing media data: %v", err)
+		} else if path != "" {
+			requestLogger(job.ctx).Printf("Wrote %s", path)
+		}
+	}
+}
+
+// write queues a write. With async set it returns once the write is queued, with an empty path,
+// otherwise it waits for the write to complete.
+func (p *writePool) write(ctx context.Context, config Config, dir, filename string, data MediaData, async bool) (string, error) {
+	job := writeJob{ctx: context.WithoutCancel(ctx), config: config, dir: dir, filename: filename, data: data}
+	if !async {
+		job.done = make(chan writeResult, 1)
+	}
+
+	if err := p.enqueue(job); err != nil {
+		return "", err
+	}
+
+	if async {
+		return "", nil
+	}
+	result := <-job.done
+	return result.path, result.err
+}
+
+// enqueue waits up to the queue timeout for room in the queue, failing once the pool is closed
+func (p *writePool) enqueue(job writeJob) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return errWritePoolClosed
+	}
+
+	timer := time.NewTimer(p.queueTimeout)
+	defer timer.Stop()
+	select {
+	case p.jobs <- job:
+		return nil
+	case <-timer.C:
+		return errWriteQueueFull
+	}
+}
+
+// Close stops accepting writes and waits for the queued ones to finish. Writes arriving afterwards,
+// e.g. from handlers outliving the shutdown timeout or the poller, fail with errWritePoolClosed.
+func (p *writePool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.jobs)
+	p.mu.Unlock()
+	p.wg.Wait()
+}
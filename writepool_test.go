@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingWriter counts the writes in progress and holds each until released
+type blockingWriter struct {
+	release  chan struct{}
+	active   atomic.Int32
+	maxSeen  atomic.Int32
+	mu       sync.Mutex
+	written  []string
+	inflight chan struct{}
+}
+
+func (b *blockingWriter) Write(data MediaData, path string) error {
+	active := b.active.Add(1)
+	for {
+		seen := b.maxSeen.Load()
+		if active <= seen || b.maxSeen.CompareAndSwap(seen, active) {
+			break
+		}
+	}
+	b.inflight <- struct{}{}
+	<-b.release
+	b.active.Add(-1)
+	b.mu.Lock()
+	b.written = append(b.written, path)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *blockingWriter) Close() error {
+	return nil
+}
+
+func TestWritePool(t *testing.T) {
+	writer := &blockingWriter{release: make(chan struct{}), inflight: make(chan struct{}, 10)}
+	previous := output
+	output = writer
+	t.Cleanup(func() {
+		output = previous
+	})
+
+	const workers = 2
+	pool := newWritePool(workers, 10, time.Second)
+	config := Config{OutputDir: t.TempDir()}
+	data := MediaData{FullTitle: "Pooled Show", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("1"), WatchedStatus: 1.0}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := pool.write(t.Context(), config, config.OutputDir, fmt.Sprintf("Pooled Show - S1E%d.json", i), data, false)
+			errs <- err
+		}()
+	}
+
+	// Only as many writes as there are workers run at once
+	for range workers {
+		<-writer.inflight
+	}
+	select {
+	case <-writer.inflight:
+		t.Errorf("More than %d writes in progress", workers)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(writer.release)
+	wg.Wait()
+	pool.Close()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("write() error = %v", err)
+		}
+	}
+	if len(writer.written) != 5 {
+		t.Errorf("writes = %d, expected 5", len(writer.written))
+	}
+	if maxSeen := writer.maxSeen.Load(); maxSeen > workers {
+		t.Errorf("concurrent writes = %d, expected at most %d", maxSeen, workers)
+	}
+}
+
+func TestWritePoolAsync(t *testing.T) {
+	config := Config{OutputDir: t.TempDir()}
+	pool := newWritePool(1, 1, time.Second)
+	data := MediaData{FullTitle: "Async Show", ParentMediaIndex: json.Number("1"), MediaIndex: json.Number("2"), WatchedStatus: 1.0}
+
+	path, err := pool.write(t.Context(), config, config.OutputDir, "Async Show - S1E2.json", data, true)
+	if err != nil || path != "" {
+		t.Errorf("write() = %q, %v, expected an empty path and no error for a queued write", path, err)
+	}
+
+	// Close waits for queued writes to finish
+	pool.Close()
+	if _, err := os.Stat(filepath.Join(config.OutputDir, "Async Show - S1E2.json")); err != nil {
+		t.Errorf("Expected the queued write to complete: %v", err)
+	}
+}
+
+func TestWritePoolBackpressure(t *testing.T) {
+	writer := &blockingWriter{release: make(chan struct{}), inflight: make(chan struct{}, 10)}
+	previous := output
+	output = writer
+	t.Cleanup(func() {
+		output = previous
+	})
+
+	// One write in progress and one queued fill the pool
+	pool := newWritePool(1, 1, 20*time.Millisecond)
+	config := Config{OutputDir: t.TempDir()}
+	if _, err := pool.write(t.Context(), config, config.OutputDir, "first.json", MediaData{}, true); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+	<-writer.inflight
+	if _, err := pool.write(t.Context(), config, config.OutputDir, "second.json", MediaData{}, true); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+
+	if _, err := pool.write(t.Context(), config, config.OutputDir, "third.json", MediaData{}, true); !errors.Is(err, errWriteQueueFull) {
+		t.Errorf("write() error = %v, expected %v", err, errWriteQueueFull)
+	}
+
+	close(writer.release)
+	pool.Close()
+}
+
+func TestWritePoolClosed(t *testing.T) {
+	config := Config{OutputDir: t.TempDir()}
+	pool := newWritePool(1, 1, time.Second)
+	pool.Close()
+
+	// Late producers get an error instead of sending on the closed queue
+	for _, async := range []bool{true, false} {
+		if _, err := pool.write(t.Context(), config, config.OutputDir, "late.json", MediaData{}, async); !errors.Is(err, errWritePoolClosed) {
+			t.Errorf("write(async=%v) error = %v, expected %v", async, err, errWritePoolClosed)
+		}
+	}
+	pool.Close()
+}